@@ -0,0 +1,64 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/sidkshatriya/dontbug/engine"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var (
+	gCleanYes       bool
+	gCleanOlderThan time.Duration
+)
+
+func init() {
+	RootCmd.AddCommand(cleanCmd)
+	cleanCmd.Flags().BoolVarP(&gCleanYes, "yes", "y", false, "don't ask for confirmation before deleting")
+	cleanCmd.Flags().DurationVar(&gCleanOlderThan, "older-than", 0, "also delete rr traces older than this e.g. 72h (the latest trace is always kept)")
+}
+
+// cleanCmd represents the clean command
+var cleanCmd = &cobra.Command{
+	Use:   "clean [flags]",
+	Short: "Delete orphaned snapshots and (optionally) old rr traces to reclaim disk space",
+	Long: `
+Dontbug Debugger version 0.1
+Dontbug is a reversible debugger for PHP
+Copyright (c) Sidharth Kshatriya 2016
+
+dontbug clean
+~~~~~~~~~~~~~
+
+The 'dontbug clean' command lists rr traces and PHP source snapshots that can be deleted:
+
+- rr traces of snapshots (see 'dontbug record --take-snapshot') whose PHP sources are gone
+- PHP source snapshots that no rr trace refers to
+- rr traces older than --older-than (if specified). The latest trace is always kept
+
+It then reports the space that can be reclaimed and deletes them after asking for confirmation.
+
+Examples
+--------
+    dontbug clean
+    dontbug clean --older-than 168h --yes
+
+                                    *-*-*
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		engine.DoClean(gCleanOlderThan, gCleanYes)
+	},
+}
@@ -27,12 +27,14 @@ const (
 	dontbugDefaultRecordPort             int    = 9001
 	dontbugDefaultPhpBuiltInServerPort   int    = 8088
 	dontbugDefaultPhpBuiltInServerListen string = "127.0.0.1"
+	dontbugDefaultDbgpListen             string = "127.0.0.1"
 )
 
 var (
 	gServerListen  string
 	gPhpExecutable string
 	gArgs          string
+	gRecordDryRun  bool
 )
 
 func init() {
@@ -43,12 +45,21 @@ func init() {
 	                       Essentially, save execution trace *and* PHP sources. Recording can be replayed
 	                       anytime in future; even when there have been intervening code changes. As
 	                       most debugging sessions are after 'dontbug record', you may not need this
-	                       feature in most cases. Source snapshots are stored in $HOME/.local/share/dontbug`)
+	                       feature in most cases. Source snapshots are stored in $DONTBUG_HOME (default $HOME/.local/share/dontbug)`)
+	recordCmd.Flags().String("snapshot-name", "", "with --take-snapshot, a name for the snapshot (letters, digits, '.', '_' and '-') so that it can be replayed with 'dontbug replay --snapshot <name>'")
 	recordCmd.Flags().Int("server-port", dontbugDefaultPhpBuiltInServerPort, "default port for the PHP built in server")
-	recordCmd.Flags().StringVar(&gServerListen, "server-listen", dontbugDefaultPhpBuiltInServerListen, "default listen ip address for the PHP built in server")
+	recordCmd.Flags().StringVar(&gServerListen, "server-listen", dontbugDefaultPhpBuiltInServerListen, "default listen ip address for the PHP built in server (e.g. 0.0.0.0 to be reachable from outside a container)")
 	recordCmd.Flags().StringVar(&gPhpExecutable, "with-php", "", "PHP (>= 7.0) executable to use (default is to use php found on $PATH)")
 	recordCmd.Flags().Int("max-stack-depth", dontbugDefaultMaxStackDepth, "max depth of stack during execution")
 	recordCmd.Flags().Int("record-port", dontbugDefaultRecordPort, "dbgp client/ide port for recording")
+	recordCmd.Flags().String("dbgp-listen", dontbugDefaultDbgpListen, "listen ip address of the dbgp client that drives the recording. PHP must be able to reach it so it has to be an address of this machine (0.0.0.0 means PHP connects over loopback)")
+	recordCmd.Flags().Bool("open", false, "open the PHP built-in webserver URL in your browser once it is listening")
+	recordCmd.Flags().Bool("attach", false, "record PHP running under php-fpm (e.g. behind nginx) instead of the PHP built-in webserver")
+	recordCmd.Flags().String("fpm-command", "", "the php-fpm executable (and any arguments) that dontbug should run under rr with --attach (default is to print the command for you to run)")
+	recordCmd.Flags().BoolVar(&gRecordDryRun, "dry-run", false, "print the rr record command that would be run and exit")
+	recordCmd.Flags().String("record-until", "", "stop recording the first time this PHP file:line is executed e.g. src/cart.php:42 (file relative to <php-source-root-dir>)")
+	recordCmd.Flags().Bool("opcode-stepping", false, "also allow stepping one PHP opcode at a time during replay (dontbug_step_granularity feature). Slows down the recording")
+	recordCmd.Flags().String("stdin-file", "", "feed the contents of this file to the stdin of the PHP script being recorded (requires --php-cli-script)")
 	recordCmd.Flags().StringVarP(&gArgs, "args", "a", "", "arguments (in quotes) to be passed to PHP script (requires --php-cli-script)")
 }
 
@@ -84,6 +95,7 @@ Examples
 
     dontbug record ~/php-test/ list-supported-functions.php --php-cli-script
     dontbug record ~/php-test/ math/calculate-factorial-min-max.php --php-cli-script --args "10 20"
+    dontbug record ~/php-test/ interactive/ask-name.php --php-cli-script --stdin-file answers.txt
 
 The first example will spawn the PHP built-in webserver for recording the execution of "fancy-site"
 website (as the user navigates various URLs in a browser). The docroot of the fancy site will be
@@ -118,6 +130,16 @@ contains all the possible PHP scripts on your system. But this would impact perf
 (2) If you have sources symlinked from inside the <php-source-root-dir> to outside that dir, dontbug should be
 able to handle that (without you having to increase the scope of the <php-source-root-dir>)
 
+php-fpm
+-------
+If your PHP application runs under php-fpm (e.g. behind nginx) use --attach instead of the PHP built-in webserver:
+
+    dontbug record /var/www/fancy-site --attach
+    dontbug record /var/www/fancy-site --attach --fpm-command "php-fpm7.0 -y /etc/php/7.0/fpm/php-fpm.conf"
+
+In the first case dontbug prints the 'rr record php-fpm ...' command for you to run (after stopping your usual php-fpm).
+In the second case dontbug runs it itself. Each PHP request is then recorded as it comes in.
+
 PHP built-in webserver tips
 ---------------------------
 You may record as many http page loads for later debugging when running the PHP built in webserver
@@ -126,6 +148,17 @@ recording too many page loads may degrade performance during debugging. Addition
 may _not_ pass arguments to the PHP built-in webserver i.e. the --args flag is ignored if not used in
 conjunction with --php-cli-script.
 
+Concurrent requests are not supported during record. The PHP built-in webserver handles one request at a
+time anyway (unless PHP_CLI_SERVER_WORKERS is set) but if requests do overlap (e.g. parallel connections
+from a browser or php-fpm with several workers) dontbug records them one after the other. A request
+that is queued this way is reported. Note that a request that makes an http sub-request to the same
+site will wait forever, so please avoid recording such requests.
+
+To reach the PHP built-in webserver from another machine (e.g. a phone on your LAN) use --server-listen 0.0.0.0.
+The dbgp listener that drives the recording is separate (--dbgp-listen) and stays on loopback by default.
+PHP connects to it from this machine so --dbgp-listen must be an address of this machine. dontbug checks that
+it can connect to the dbgp listener the way PHP will before recording.
+
 Config file
 -----------
 If you find that you are frequently passing the same flags to dontbug, you may provide custom config for
@@ -146,8 +179,6 @@ file and user flags don't specify a particular parameter, the defaults mentioned
 `,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		engine.VerboseFlag = viper.GetBool("verbose")
-
 		recordPort := viper.GetInt("record-port")
 		serverPort := viper.GetInt("server-port")
 		serverListen := viper.GetString("server-listen")
@@ -158,11 +189,41 @@ file and user flags don't specify a particular parameter, the defaults mentioned
 		isCli := viper.GetBool("php-cli-script")
 		arguments := viper.GetString("args")
 		takeSnapshot := viper.GetBool("take-snapshot")
+		attach := viper.GetBool("attach")
+		stdinFile := viper.GetString("stdin-file")
 
 		if arguments != "" && !isCli {
 			color.Yellow("dontbug: --args flag used but --php-cli-script flag not used. Ignoring --args flag")
 		}
 
+		if stdinFile != "" && !isCli {
+			log.Fatal("--stdin-file requires --php-cli-script")
+		}
+
+		engine.RecordOpcodeStepping = viper.GetBool("opcode-stepping")
+		engine.RecordUntil = viper.GetString("record-until")
+		if engine.RecordUntil != "" && attach {
+			log.Fatal("--record-until can't be used with --attach")
+		}
+
+		if attach {
+			if len(args) < 1 {
+				log.Fatal("Please provide the <php-source-root-dir> argument. See dontbug record --help for more details")
+			}
+
+			engine.DoChecksAndRecordAttach(
+				phpExecutable,
+				rrExecutable,
+				args[0],
+				installLocation,
+				maxStackDepth,
+				recordPort,
+				viper.GetString("dbgp-listen"),
+				viper.GetString("fpm-command"),
+			)
+			return
+		}
+
 		docrootOrScriptRelPath := ""
 		if len(args) < 1 {
 			log.Fatal("Please provide the <php-source-root-dir> argument. See dontbug record --help for more details")
@@ -196,7 +257,12 @@ See dontbug record --help for more details`)
 			recordPort,
 			serverListen,
 			serverPort,
+			viper.GetString("dbgp-listen"),
 			takeSnapshot,
+			viper.GetString("snapshot-name"),
+			gRecordDryRun,
+			viper.GetBool("open"),
+			stdinFile,
 		)
 	},
 }
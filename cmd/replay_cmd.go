@@ -18,23 +18,44 @@ import (
 	"github.com/sidkshatriya/dontbug/engine"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	dontbugDefaultReplayPort            int    = 9000
-	dontbugDefaultGdbExtendedRemotePort int    = 9999
-	dontbugPhpIdeIP                     string = "127.0.0.1"
+	dontbugDefaultReplayPort            int           = 9000
+	dontbugXdebug3ReplayPort            int           = 9003 // The default IDE port since Xdebug 3
+	dontbugDefaultGdbExtendedRemotePort int           = 9999
+	dontbugPhpIdeIP                     string        = "127.0.0.1"
+	dontbugDefaultDiversionTimeout      time.Duration = 5 * time.Second
+	dontbugDefaultHistoryLimit          int           = 500
+	dontbugMaxReplayMaxStackDepth       int           = 100000
+	dontbugMinIdleTimeout               time.Duration = time.Second // Idleness is checked every tenth of the timeout
 )
 
 var (
 	gGdbExecutableFlag string
 	gPhpIdeIP          string
+	gReplayDryRun      bool
+
+	gReplayDumpSourceMap   bool
+	gReplaySourceMapFilter string
+	gReplaySourceMapAsJSON bool
+
+	// Not bound via viper as 'dontbug record' has a --max-stack-depth flag with a different meaning
+	gReplayMaxStackDepth int
+
+	// Not bound via viper as "snapshot" is an alias of take-snapshot
+	gReplaySnapshotName string
 )
 
 // replayCmd represents the replay command
 var replayCmd = &cobra.Command{
 	Use: `replay [flags]
   dontbug replay snaps [flags]
+  dontbug replay --snapshot <snapshot-name> [flags]
   `,
 	Long: `
 Dontbug Debugger version 0.1
@@ -94,41 +115,173 @@ workflow. Therefore: simply do a 'dontbug record' again if your PHP sources have
 `,
 	Short: "Replay and debug a previous execution",
 	Run: func(cmd *cobra.Command, args []string) {
-		engine.VerboseFlag = viper.GetBool("verbose")
-		engine.ShowGdbNotifications = viper.GetBool("gdb-notify")
+		// --gdb-notify is a shorthand for the global --show-gdb-notifications flag
+		if viper.GetBool("gdb-notify") {
+			engine.ShowGdbNotifications = true
+		}
 
 		replayHost := viper.GetString("replay-host")
-		replayPort := viper.GetInt("replay-port")
+		replayPorts := getReplayPorts(cmd)
 		installLocation := viper.GetString("install-location")
 		targedExtendedRemotePort := viper.GetInt("gdb-remote-port")
 		rrExecutable := viper.GetString("with-rr")
 		gdbExecutable := viper.GetString("with-gdb")
+		readyFile := viper.GetString("ready-file")
+		engine.DiversionTimeout = viper.GetDuration("diversion-timeout")
+		startEvent := viper.GetInt("start-event")
+		once := viper.GetBool("once")
+		noIde := viper.GetBool("no-ide")
+		if once && noIde {
+			log.Fatal("--once and --no-ide cannot be used together")
+		}
+		engine.StartAtRequest = viper.GetInt("request")
+		if engine.StartAtRequest < 0 {
+			log.Fatalf("--request should be 1 or more. Got: %v", engine.StartAtRequest)
+		}
+		if engine.StartAtRequest > 1 && startEvent != 0 {
+			log.Fatal("--request and --start-event cannot be used together")
+		}
+		if gReplayMaxStackDepth < 0 || gReplayMaxStackDepth > dontbugMaxReplayMaxStackDepth {
+			log.Fatalf("--max-stack-depth should be between 1 and %v (or 0 to use the recorded value). Got: %v", dontbugMaxReplayMaxStackDepth, gReplayMaxStackDepth)
+		}
+		engine.MaxStackDepthOverride = gReplayMaxStackDepth
+		engine.ShowRROutput = viper.GetBool("show-rr-output")
+		engine.ShowGdbOutput = viper.GetBool("show-gdb-output")
+		for _, mapping := range viper.GetStringSlice("path-map") {
+			pathMapping, err := engine.ParsePathMapping(mapping)
+			if err != nil {
+				log.Fatal(err)
+			}
+			engine.PathMappings = append(engine.PathMappings, pathMapping)
+		}
+		engine.StartInReverse = viper.GetBool("reverse")
+		engine.GdbInitFile = viper.GetString("gdb-init")
+		engine.BreakpointsFile = viper.GetString("breakpoints-file")
+		engine.JSONEventsFile = viper.GetString("json-events")
+		engine.GdbCommandTimeout = viper.GetDuration("gdb-timeout")
+		engine.GdbPrintElements = viper.GetInt("gdb-print-elements")
+		if engine.GdbPrintElements < 0 {
+			log.Fatalf("--gdb-print-elements should be 0 (unlimited) or more. Got: %v", engine.GdbPrintElements)
+		}
+		engine.HeartbeatInterval = viper.GetDuration("heartbeat")
+		engine.IdleTimeout = viper.GetDuration("idle-timeout")
+		if engine.IdleTimeout != 0 && engine.IdleTimeout < dontbugMinIdleTimeout {
+			log.Fatalf("--idle-timeout should be 0 (never) or at least %v. Got: %v", dontbugMinIdleTimeout, engine.IdleTimeout)
+		}
+		engine.IdleAction = viper.GetString("idle-action")
+		if engine.IdleAction != engine.IdleActionWarn && engine.IdleAction != engine.IdleActionStop {
+			log.Fatalf("--idle-action should be %v or %v. Got: %v", engine.IdleActionWarn, engine.IdleActionStop, engine.IdleAction)
+		}
+		engine.IdeTLS = viper.GetBool("ide-tls")
+		engine.IdeCAFile = viper.GetString("ide-ca")
+		engine.IdeCertFile = viper.GetString("ide-cert")
+		engine.IdeKeyFile = viper.GetString("ide-key")
+		if !engine.IdeTLS && (engine.IdeCAFile != "" || engine.IdeCertFile != "" || engine.IdeKeyFile != "") {
+			log.Fatal("--ide-ca, --ide-cert and --ide-key need --ide-tls")
+		}
+		if engine.IdeKeyFile != "" && engine.IdeCertFile == "" {
+			log.Fatal("--ide-key needs --ide-cert")
+		}
+		engine.HistoryFile = viper.GetString("history-file")
+		engine.HistoryLimit = viper.GetInt("history-limit")
+
+		if gReplayDumpSourceMap {
+			engine.DoDumpSourceMap(installLocation, gReplaySourceMapFilter, gReplaySourceMapAsJSON)
+			return
+		}
 
 		snapshotTagnamePortion := ""
 		if len(args) >= 1 {
 			snapshotTagnamePortion = args[0]
 		}
 
-		rrPath := engine.CheckRRExecutable(rrExecutable)
-		gdbPath := engine.CheckGdbExecutable(gdbExecutable)
+		// A dry run prints the commands even if rr or gdb are missing (or too old) on this machine
+		rrPath, gdbPath := rrExecutable, gdbExecutable
+		if !gReplayDryRun {
+			rrPath = engine.CheckRRExecutable(rrExecutable)
+			gdbPath = engine.CheckGdbExecutable(gdbExecutable)
+		}
 
 		engine.DoReplay(
 			installLocation,
 			snapshotTagnamePortion,
+			gReplaySnapshotName,
 			rrPath,
 			gdbPath,
 			replayHost,
-			replayPort,
+			replayPorts,
 			targedExtendedRemotePort,
+			readyFile,
+			startEvent,
+			once,
+			gReplayDryRun,
+			noIde,
 		)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(replayCmd)
-	replayCmd.Flags().StringVar(&gPhpIdeIP, "replay-host", dontbugPhpIdeIP, "IP address of the dbgp client i.e. the PHP IDE debugger")
+	replayCmd.Flags().StringVar(&gPhpIdeIP, "replay-host", dontbugPhpIdeIP, "hostname or IP address (IPv4 or IPv6) of the dbgp client i.e. the PHP IDE debugger")
 	replayCmd.Flags().BoolP("gdb-notify", "g", false, "show notification messages from gdb")
-	replayCmd.Flags().Int("replay-port", dontbugDefaultReplayPort, "dbgp client port i.e. PHP IDE debugger port")
-	replayCmd.Flags().Int("gdb-remote-port", dontbugDefaultGdbExtendedRemotePort, "port at which rr backend should be made available to gdb")
+	replayCmd.Flags().Int("replay-port", dontbugDefaultReplayPort, "dbgp client port i.e. PHP IDE debugger port (only this port is tried if given)")
+	replayCmd.Flags().String("ide-ports", "", "comma separated dbgp client ports to try in order e.g. 9003,9000 (default is 9000 and then 9003)")
+	replayCmd.Flags().Bool("ide-tls", false, "connect to the IDE with TLS (verifying its certificate) e.g. when it is on another host. Plain TCP is the default")
+	replayCmd.Flags().String("ide-ca", "", "with --ide-tls, PEM file of the CA certificate(s) to verify the IDE's certificate with (default is the system's)")
+	replayCmd.Flags().String("ide-cert", "", "with --ide-tls, PEM file of a client certificate to present to the IDE (or a TLS proxy in front of it)")
+	replayCmd.Flags().String("ide-key", "", "with --ide-cert, PEM file of the client certificate's key (default is to look for it in --ide-cert)")
+	replayCmd.Flags().Int("gdb-remote-port", dontbugDefaultGdbExtendedRemotePort, "port at which rr backend should be made available to gdb (0 means any free port; a free port is also chosen if this one is busy)")
 	replayCmd.Flags().StringVar(&gGdbExecutableFlag, "with-gdb", "", "the gdb (>= 7.11.1) executable (default is to assume gdb exists in $PATH)")
+	replayCmd.Flags().Duration("diversion-timeout", dontbugDefaultDiversionTimeout, "interrupt IDE commands like eval that take longer than this in the diversion session (0 means no limit)")
+	replayCmd.Flags().Int("start-event", 0, "start the replay at the first PHP statement after this rr event (see 'rr dump' or 'when' in gdb) instead of at the beginning")
+	replayCmd.Flags().Int("request", 0, "start the replay at the first PHP statement of this PHP request (counting from 1) when several requests were recorded")
+	replayCmd.Flags().StringVar(&gReplaySnapshotName, "snapshot", "", "replay the snapshot with this name (see --snapshot-name in 'dontbug record') without asking")
+	replayCmd.Flags().BoolVar(&gReplayDryRun, "dry-run", false, "print the rr and gdb commands that would be run and exit")
+	replayCmd.Flags().BoolVar(&gReplayDumpSourceMap, "dump-sourcemap", false, "print the recorded PHP files that breakpoints can be set in and exit (to diagnose breakpoints that won't bind)")
+	replayCmd.Flags().StringVar(&gReplaySourceMapFilter, "sourcemap-filter", "", "with --dump-sourcemap, only print files whose path contains this")
+	replayCmd.Flags().BoolVar(&gReplaySourceMapAsJSON, "json", false, "with --dump-sourcemap, print JSON instead")
+	replayCmd.Flags().String("history-file", "", "the (dontbug) prompt history file (default is $DONTBUG_HISTORY, else $HOME/.dontbug.history if it exists, else history in $DONTBUG_HOME)")
+	replayCmd.Flags().Int("history-limit", dontbugDefaultHistoryLimit, "max number of entries kept in the (dontbug) prompt history")
+	replayCmd.Flags().Duration("heartbeat", 0, "while a run/step is in progress report that it is still running this often e.g. 10s (0 means never)")
+	replayCmd.Flags().Duration("idle-timeout", 0, "warn when neither the IDE nor the dontbug prompt has been used for this long e.g. 30m (0 means never)")
+	replayCmd.Flags().String("idle-action", engine.IdleActionWarn, "what to do after --idle-timeout: warn, or stop i.e. end the replay so that rr frees its memory")
+	replayCmd.Flags().IntVar(&gReplayMaxStackDepth, "max-stack-depth", 0, "raise the max stack depth that was used during 'dontbug record' (default is to use the recorded value)")
+	replayCmd.Flags().Bool("show-rr-output", false, "pass the output of rr through to the terminal (always done with --verbose)")
+	replayCmd.Flags().Bool("show-gdb-output", false, "pass the output of gdb through to the terminal (always done with --verbose)")
+	replayCmd.Flags().StringSlice("path-map", nil, "map a directory as seen by the IDE to where it was recorded e.g. /home/me/site=/var/www/site (can be repeated)")
+	replayCmd.Flags().String("gdb-init", "", "file of extra gdb commands to run at the start of the replay (one per line; prefix gdb/mi commands with -)")
+	replayCmd.Flags().Duration("gdb-timeout", engine.GdbCommandTimeout, "give up on a gdb command that takes longer than this e.g. if rr is stuck (0 means no limit)")
+	replayCmd.Flags().String("breakpoints-file", "", "file of PHP breakpoints (one file.php:line per line) to set before the IDE connects")
+	replayCmd.Flags().String("json-events", "", "append a line of JSON to this file for every status change, breakpoint hit and stop e.g. for external tools (/dev/fd/N for a file descriptor)")
+	replayCmd.Flags().Int("gdb-print-elements", 0, "max characters gdb prints for a value e.g. to stop a huge PHP variable from freezing dontbug (0 means unlimited). "+
+		"Any IDE response with more xml than this (e.g. a property_get of a large array) fails with an error instead")
+	replayCmd.Flags().Bool("reverse", false, "start in reverse mode i.e. the IDE's step/run commands go backwards (toggle with t at the dontbug prompt)")
+	replayCmd.Flags().Bool("no-ide", false, "don't connect to a debugger IDE. Use the (dontbug) prompt only e.g. with # dbgp and - gdb commands")
+	replayCmd.Flags().Bool("once", false, "exit after the IDE disconnects instead of keeping the dontbug prompt (exit status is non-zero unless the IDE sent stop or detach)")
+	replayCmd.Flags().String("ready-file", "", "write the 'dontbug: ready ...' line to this file once the replay is ready for the IDE to connect")
+}
+
+// An explicit --replay-port wins. Otherwise the ports in --ide-ports are tried in order and, if that is not given
+// either, the classic 9000 and then 9003 (the Xdebug 3 default) so that IDEs set up either way just work
+func getReplayPorts(cmd *cobra.Command) []int {
+	replayPort := viper.GetInt("replay-port")
+	if cmd.Flags().Changed("replay-port") || replayPort != dontbugDefaultReplayPort {
+		return []int{replayPort}
+	}
+
+	idePorts := viper.GetString("ide-ports")
+	if idePorts == "" {
+		return []int{dontbugDefaultReplayPort, dontbugXdebug3ReplayPort}
+	}
+
+	var ports []int
+	for _, port := range strings.Split(idePorts, ",") {
+		portNum, err := strconv.Atoi(strings.TrimSpace(port))
+		if err != nil || portNum <= 0 || portNum > 65535 {
+			log.Fatalf("Invalid port %q in --ide-ports", port)
+		}
+		ports = append(ports, portNum)
+	}
+
+	return ports
 }
@@ -17,8 +17,10 @@ package cmd
 import (
 	"fmt"
 	"github.com/fatih/color"
+	"github.com/sidkshatriya/dontbug/engine"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"log"
 	"os"
 )
 
@@ -36,6 +38,20 @@ var (
 var RootCmd = &cobra.Command{
 	Use:   "dontbug",
 	Short: "Dontbug is a reversible debugger for PHP\nVersion 0.1\nCopyright (c) Sidharth Kshatriya 2016",
+	// Runs before any subcommand so that diagnostics are available from the very start of a session
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		logLevel, err := engine.ParseLogLevel(viper.GetString("log-level"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		engine.MinLogLevel = logLevel
+		engine.VerboseFlag = viper.GetBool("verbose") || logLevel == engine.LogLevelDebug
+		engine.ShowGdbNotifications = viper.GetBool("show-gdb-notifications")
+		if traceDir := viper.GetString("trace-dir"); traceDir != "" {
+			engine.SetRRTraceDir(traceDir)
+		}
+	},
 }
 
 // Execute adds all child commands to the root command sets flags appropriately.
@@ -50,9 +66,13 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	RootCmd.PersistentFlags().BoolP("verbose", "v", false, "print more messages to know what dontbug is doing")
-	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.dontbug.yaml)")
+	RootCmd.PersistentFlags().String("log-level", "info", "least important messages to show: debug, info, warn or error (--verbose is the same as debug)")
+	RootCmd.PersistentFlags().Bool("show-gdb-notifications", false, "show notification messages from gdb (can be toggled in the dontbug prompt later)")
+	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is .dontbug.yaml in $DONTBUG_HOME if set, else $HOME/.dontbug.yaml)")
 	RootCmd.PersistentFlags().StringVarP(&gInstallLocationFlag, "install-location", "l", "", "location of dontbug src folder (default is $GOPATH/src/github.com/sidkshatriya/dontbug)")
 	RootCmd.PersistentFlags().StringVar(&gRRExecutableFlag, "with-rr", "", "the rr (>= 4.3.0) executable (default is to assume rr is in $PATH)")
+	RootCmd.PersistentFlags().String("trace-dir", "", "directory rr saves traces in and replays them from (default is $_RR_TRACE_DIR or else rr's default)")
+	RootCmd.PersistentFlags().Bool("no-color", false, "don't use colors in output (also disabled if NO_COLOR is set or output is not a terminal)")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -63,8 +83,11 @@ func initConfig() {
 	}
 
 	viper.SetConfigName(".dontbug") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")    // adding home directory as first search path
-	viper.AutomaticEnv()            // read in environment variables that match
+	if dontbugHome := os.Getenv("DONTBUG_HOME"); dontbugHome != "" {
+		viper.AddConfigPath(dontbugHome) // so that everything of dontbug can be in one place
+	}
+	viper.AddConfigPath("$HOME") // adding home directory as a search path
+	viper.AutomaticEnv()         // read in environment variables that match
 	viper.SetConfigType("yaml")
 
 	viper.BindPFlag("record-port", recordCmd.Flags().Lookup("record-port"))
@@ -75,16 +98,54 @@ func initConfig() {
 	viper.BindPFlag("php-cli-script", recordCmd.Flags().Lookup("php-cli-script"))
 	viper.BindPFlag("args", recordCmd.Flags().Lookup("args"))
 	viper.BindPFlag("take-snapshot", recordCmd.Flags().Lookup("take-snapshot"))
+	viper.BindPFlag("snapshot-name", recordCmd.Flags().Lookup("snapshot-name"))
+	viper.BindPFlag("attach", recordCmd.Flags().Lookup("attach"))
+	viper.BindPFlag("open", recordCmd.Flags().Lookup("open"))
+	viper.BindPFlag("fpm-command", recordCmd.Flags().Lookup("fpm-command"))
+	viper.BindPFlag("stdin-file", recordCmd.Flags().Lookup("stdin-file"))
+	viper.BindPFlag("record-until", recordCmd.Flags().Lookup("record-until"))
+	viper.BindPFlag("opcode-stepping", recordCmd.Flags().Lookup("opcode-stepping"))
+	viper.BindPFlag("dbgp-listen", recordCmd.Flags().Lookup("dbgp-listen"))
 
 	viper.BindPFlag("replay-host", replayCmd.Flags().Lookup("replay-host"))
 	viper.BindPFlag("replay-port", replayCmd.Flags().Lookup("replay-port"))
+	viper.BindPFlag("ide-ports", replayCmd.Flags().Lookup("ide-ports"))
+	viper.BindPFlag("ide-tls", replayCmd.Flags().Lookup("ide-tls"))
+	viper.BindPFlag("ide-ca", replayCmd.Flags().Lookup("ide-ca"))
+	viper.BindPFlag("ide-cert", replayCmd.Flags().Lookup("ide-cert"))
+	viper.BindPFlag("ide-key", replayCmd.Flags().Lookup("ide-key"))
 	viper.BindPFlag("gdb-notify", replayCmd.Flags().Lookup("gdb-notify"))
 	viper.BindPFlag("gdb-remote-port", replayCmd.Flags().Lookup("gdb-remote-port"))
 	viper.BindPFlag("with-gdb", replayCmd.Flags().Lookup("with-gdb"))
+	viper.BindPFlag("ready-file", replayCmd.Flags().Lookup("ready-file"))
+	viper.BindPFlag("diversion-timeout", replayCmd.Flags().Lookup("diversion-timeout"))
+	viper.BindPFlag("start-event", replayCmd.Flags().Lookup("start-event"))
+	viper.BindPFlag("request", replayCmd.Flags().Lookup("request"))
+	viper.BindPFlag("once", replayCmd.Flags().Lookup("once"))
+	viper.BindPFlag("no-ide", replayCmd.Flags().Lookup("no-ide"))
+	viper.BindPFlag("show-rr-output", replayCmd.Flags().Lookup("show-rr-output"))
+	viper.BindPFlag("show-gdb-output", replayCmd.Flags().Lookup("show-gdb-output"))
+	viper.BindPFlag("path-map", replayCmd.Flags().Lookup("path-map"))
+	viper.BindPFlag("gdb-init", replayCmd.Flags().Lookup("gdb-init"))
+	viper.BindPFlag("breakpoints-file", replayCmd.Flags().Lookup("breakpoints-file"))
+	viper.BindPFlag("json-events", replayCmd.Flags().Lookup("json-events"))
+	viper.BindPFlag("gdb-print-elements", replayCmd.Flags().Lookup("gdb-print-elements"))
+	viper.BindPFlag("gdb-timeout", replayCmd.Flags().Lookup("gdb-timeout"))
+	viper.BindPFlag("reverse", replayCmd.Flags().Lookup("reverse"))
+	viper.BindPFlag("heartbeat", replayCmd.Flags().Lookup("heartbeat"))
+	viper.BindPFlag("idle-timeout", replayCmd.Flags().Lookup("idle-timeout"))
+	viper.BindPFlag("idle-action", replayCmd.Flags().Lookup("idle-action"))
+	viper.BindPFlag("history-file", replayCmd.Flags().Lookup("history-file"))
+	viper.BindPFlag("history-limit", replayCmd.Flags().Lookup("history-limit"))
 
-	viper.BindPFlag("install-location", RootCmd.Flags().Lookup("install-location"))
-	viper.BindPFlag("with-rr", RootCmd.Flags().Lookup("with-rr"))
-	viper.BindPFlag("verbose", RootCmd.Flags().Lookup("verbose"))
+	// These are persistent flags and need to be looked up as such
+	viper.BindPFlag("install-location", RootCmd.PersistentFlags().Lookup("install-location"))
+	viper.BindPFlag("with-rr", RootCmd.PersistentFlags().Lookup("with-rr"))
+	viper.BindPFlag("verbose", RootCmd.PersistentFlags().Lookup("verbose"))
+	viper.BindPFlag("log-level", RootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("show-gdb-notifications", RootCmd.PersistentFlags().Lookup("show-gdb-notifications"))
+	viper.BindPFlag("trace-dir", RootCmd.PersistentFlags().Lookup("trace-dir"))
+	viper.BindPFlag("no-color", RootCmd.PersistentFlags().Lookup("no-color"))
 
 	viper.SetDefault("with-rr", "rr")
 	viper.SetDefault("with-gdb", "gdb")
@@ -98,21 +159,75 @@ func initConfig() {
 	viper.RegisterAlias("gdb_notify", "gdb-notify")
 	viper.RegisterAlias("replay_host", "replay-host")
 	viper.RegisterAlias("replay_port", "replay-port")
+	viper.RegisterAlias("ide_ports", "ide-ports")
+	viper.RegisterAlias("ide_tls", "ide-tls")
+	viper.RegisterAlias("ide_ca", "ide-ca")
+	viper.RegisterAlias("ide_cert", "ide-cert")
+	viper.RegisterAlias("ide_key", "ide-key")
 	viper.RegisterAlias("max_stack_depth", "max-stack-depth")
 	viper.RegisterAlias("install_location", "install-location")
 	viper.RegisterAlias("gdb_remote_port", "gdb-remote-port")
 	viper.RegisterAlias("with_gdb", "with-gdb")
+	viper.RegisterAlias("ready_file", "ready-file")
+	viper.RegisterAlias("diversion_timeout", "diversion-timeout")
+	viper.RegisterAlias("start_event", "start-event")
+	viper.RegisterAlias("history_file", "history-file")
+	viper.RegisterAlias("no_ide", "no-ide")
+	viper.RegisterAlias("gdb_init", "gdb-init")
+	viper.RegisterAlias("breakpoints_file", "breakpoints-file")
+	viper.RegisterAlias("json_events", "json-events")
+	viper.RegisterAlias("gdb_print_elements", "gdb-print-elements")
+	viper.RegisterAlias("gdb_timeout", "gdb-timeout")
+	viper.RegisterAlias("path_map", "path-map")
+	viper.RegisterAlias("show_rr_output", "show-rr-output")
+	viper.RegisterAlias("show_gdb_output", "show-gdb-output")
+	viper.RegisterAlias("history_limit", "history-limit")
+	viper.RegisterAlias("idle_timeout", "idle-timeout")
+	viper.RegisterAlias("idle_action", "idle-action")
 	viper.RegisterAlias("with_rr", "with-rr")
+	viper.RegisterAlias("log_level", "log-level")
+	viper.RegisterAlias("trace_dir", "trace-dir")
 	viper.RegisterAlias("with_php", "with-php")
 	viper.RegisterAlias("php_cli_script", "php-cli-script")
 	viper.RegisterAlias("arguments", "args")
 	viper.RegisterAlias("argument", "args")
 	viper.RegisterAlias("arg", "args")
 	viper.RegisterAlias("take_snapshot", "take-snapshot")
+	viper.RegisterAlias("snapshot_name", "snapshot-name")
+	viper.RegisterAlias("fpm_command", "fpm-command")
+	viper.RegisterAlias("stdin_file", "stdin-file")
+	viper.RegisterAlias("record_until", "record-until")
+	viper.RegisterAlias("opcode_stepping", "opcode-stepping")
+	viper.RegisterAlias("dbgp_listen", "dbgp-listen")
 	viper.RegisterAlias("snapshot", "take-snapshot")
+	viper.RegisterAlias("no_color", "no-color")
+	viper.RegisterAlias("show_gdb_notifications", "show-gdb-notifications")
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	err := viper.ReadInConfig()
+
+	// Color needs to be decided before anything is output. See https://no-color.org for NO_COLOR
+	_, noColorEnv := os.LookupEnv("NO_COLOR")
+	if viper.GetBool("no-color") || noColorEnv || !isTerminal(os.Stdout) {
+		disableColor()
+	}
+
+	if err == nil {
 		color.Yellow("dontbug: Using config file:%v", viper.ConfigFileUsed())
 	}
 }
+
+// Also takes care of the log prefix that was colored in main()
+func disableColor() {
+	color.NoColor = true
+	log.SetPrefix("dontbug: fatal error: ")
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,100 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/sidkshatriya/dontbug/engine"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"log"
+	"strconv"
+)
+
+func init() {
+	RootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotExportCmd)
+	snapshotCmd.AddCommand(snapshotImportCmd)
+}
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "List, export and import snapshots (see 'dontbug record --take-snapshot')",
+	Long: `
+Dontbug Debugger version 0.1
+Dontbug is a reversible debugger for PHP
+Copyright (c) Sidharth Kshatriya 2016
+
+dontbug snapshot
+~~~~~~~~~~~~~~~~
+
+A snapshot comprises PHP sources at a point in time along with an rr execution trace.
+To share a reproducible bug, export a snapshot to a single archive and hand it to a colleague
+who can then import it and replay it with 'dontbug replay snaps'.
+
+The archive is compressed with zstd if it ends in .zst (the zstd executable needs to be in $PATH),
+with gzip if it ends in .gz or .tgz and is a plain tar otherwise.
+
+Note: the paths of the PHP sources are baked into the rr trace. After an import, your PHP IDE will need to
+map the original path of the sources to where they were imported. Both are shown after the import.
+
+Examples
+--------
+    dontbug snapshot list
+    dontbug snapshot export 0 bug-1234.tar.zst
+    dontbug snapshot import bug-1234.tar.zst
+
+                                    *-*-*
+`,
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List snapshots along with their index",
+	Run: func(cmd *cobra.Command, args []string) {
+		engine.DoSnapshotList()
+	},
+}
+
+var snapshotExportCmd = &cobra.Command{
+	Use:   "export <index> <archive>",
+	Short: "Export a snapshot (rr trace, PHP sources and metadata) to a single archive",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			log.Fatal("Please provide the snapshot index (see 'dontbug snapshot list') and the archive filename")
+		}
+
+		index, err := strconv.Atoi(args[0])
+		if err != nil {
+			log.Fatalf("Snapshot index should be a number. Got: %v", args[0])
+		}
+
+		rrPath := engine.CheckRRExecutable(viper.GetString("with-rr"))
+		engine.DoSnapshotExport(viper.GetString("install-location"), rrPath, index, args[1])
+	},
+}
+
+var snapshotImportCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Import a snapshot archive made by 'dontbug snapshot export'",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Fatal("Please provide the archive filename")
+		}
+
+		engine.DoSnapshotImport(args[0])
+	},
+}
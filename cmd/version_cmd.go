@@ -0,0 +1,67 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sidkshatriya/dontbug/engine"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"log"
+)
+
+// Version of dontbug. Override at build time with:
+// go build -ldflags "-X github.com/sidkshatriya/dontbug/cmd.Version=x.y.z"
+var Version = "0.1"
+
+var gVersionJSON bool
+
+func init() {
+	RootCmd.AddCommand(versionCmd)
+	versionCmd.Flags().BoolVar(&gVersionJSON, "json", false, "output in JSON")
+}
+
+// versionCmd represents the version command
+var versionCmd = &cobra.Command{
+	Use:   "version [flags]",
+	Short: "Print the version of dontbug along with the versions of rr, gdb and the dontbug zend extension it finds",
+	Run: func(cmd *cobra.Command, args []string) {
+		dv := engine.DetectVersions(
+			viper.GetString("with-rr"),
+			viper.GetString("with-gdb"),
+			viper.GetString("install-location"),
+		)
+
+		if gVersionJSON {
+			out := struct {
+				Dontbug string `json:"dontbug"`
+				engine.DetectedVersions
+			}{Version, dv}
+
+			jsonResult, err := json.MarshalIndent(out, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(jsonResult))
+			return
+		}
+
+		fmt.Printf("dontbug:                 %v\n", Version)
+		fmt.Printf("rr:                      %v %v\n", dv.RR, dv.RRPath)
+		fmt.Printf("gdb:                     %v %v\n", dv.Gdb, dv.GdbPath)
+		fmt.Printf("dontbug zend extension:  %v %v\n", dv.Extension, dv.ExtDir)
+	},
+}
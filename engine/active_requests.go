@@ -0,0 +1,87 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The PHP requests being recorded right now. The built-in webserver can serve several requests at
+// the same time and a request that never finishes would otherwise be hard to spot
+type activeRequest struct {
+	num     int
+	fileURI string
+	started time.Time
+}
+
+var gActiveRequests = struct {
+	sync.Mutex
+	requests map[int]*activeRequest
+}{requests: make(map[int]*activeRequest)}
+
+func addActiveRequest(num int, fileURI string) {
+	gActiveRequests.Lock()
+	defer gActiveRequests.Unlock()
+	gActiveRequests.requests[num] = &activeRequest{num, fileURI, time.Now()}
+}
+
+func removeActiveRequest(num int) {
+	gActiveRequests.Lock()
+	defer gActiveRequests.Unlock()
+	delete(gActiveRequests.requests, num)
+}
+
+// Lists the requests in progress (oldest first) whenever dontbug receives SIGUSR1
+func listActiveRequestsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	logInfof(color.FgYellow, "dontbug: To list the PHP requests being recorded: kill -USR1 %v", os.Getpid())
+
+	go func() {
+		for range c {
+			printActiveRequests()
+		}
+	}()
+}
+
+func printActiveRequests() {
+	gActiveRequests.Lock()
+	defer gActiveRequests.Unlock()
+
+	if len(gActiveRequests.requests) == 0 {
+		logInfof(color.FgCyan, "dontbug: No PHP requests being recorded right now")
+		return
+	}
+
+	nums := make([]int, 0, len(gActiveRequests.requests))
+	for num := range gActiveRequests.requests {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	logInfof(color.FgCyan, "dontbug: %v PHP request(s) being recorded:", len(nums))
+	for _, num := range nums {
+		request := gActiveRequests.requests[num]
+		elapsed := time.Since(request.started) / time.Second * time.Second
+		fmt.Printf("  #%-5v %-10v %v\n", request.num, elapsed, request.fileURI)
+	}
+}
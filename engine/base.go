@@ -32,13 +32,19 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	dontbugCstepLineNumTemp int = 91
-	dontbugCstepLineNum     int = 99
-	dontbugCpathStartsAt    int = 6
-	dontbugMasterBp             = "1"
+	dontbugMasterBp = "1"
+
+	// Sent instead of a breakpoint id on breakStopNotify when the PHP program has terminated
+	programExitedID = "exited"
+
+	stepGranularityStatement = "statement"
+	stepGranularityOpcode    = "opcode"
 
 	statusStarting engineStatus = "starting"
 	statusStopping engineStatus = "stopping"
@@ -50,21 +56,73 @@ const (
 	reasonError      engineReason = "error"
 	reasonAborted    engineReason = "aborted"
 	reasonExeception engineReason = "exception"
+
+	// dbgp error codes not specific to breakpoints
+	dbgpErrorCodeInvalidOptions      = 3
+	dbgpErrorCodeUnimplemented       = 4
+	dbgpErrorCodeCommandNotAvailable = 5
+	dbgpErrorCodeStackDepthInvalid   = 301
+	dbgpErrorCodeEvalError           = 206 // i.e. "error evaluating code"
+	dbgpErrorCodeInternal            = 998 // i.e. "an internal exception in the debugger occurred"
 )
 
 var (
-	VerboseFlag          bool // Flag used to check if extra info should be outputted
-	ShowGdbNotifications bool
+	VerboseFlag           bool // Flag used to check if extra info should be outputted
+	ShowGdbNotifications  bool
+	ExplainMoves          bool          // Describe every run/step command from the IDE before it is run (toggled with e at the prompt)
+	ShowRROutput          bool          // Pass the output of rr through to the terminal. Always done in verbose mode
+	ShowGdbOutput         bool          // Pass the (console) output of gdb through to the terminal. Always done in verbose mode
+	DiversionTimeout      time.Duration // How long a diversion session command may take. 0 means no limit
+	HeartbeatInterval     time.Duration // How often to report that a run/step is still in progress. 0 means never
+	MaxStackDepthOverride int           // Raises the max stack depth recorded in dontbug_break.c during replay. 0 means no override
+
+	// How long any single gdb command may take. 0 means no limit
+	GdbCommandTimeout = 2 * time.Minute
+
+	// Max characters of a string gdb prints e.g. the xml of a property_get. 0 means unlimited
+	// A limit avoids huge values taking forever but a response that is cut short is broken xml for the IDE. So every
+	// diversion session response longer than this (the whole xml, not just one value) is an error instead
+	GdbPrintElements = 0
+
+	// How long the replay may take to reach the first PHP statement before dontbug gives up on the trace
+	InitialStopTimeout = 30 * time.Second
+
+	StartAtRequest int    // Start the replay at this PHP request (counting from 1) of a trace with several. 0 means the first
+	StartInReverse bool   // Interpret the IDE's step/run commands in reverse from the first command (toggled with t at the prompt)
+	GdbInitFile    string // Extra gdb commands to run once the replay has started. "" means none
+
+	BreakpointsFile string // PHP line breakpoints to set before the IDE connects. "" means none
+
+	IdleTimeout time.Duration // Warn when neither the IDE nor the prompt has been used for this long. 0 means never
+	IdleAction  = IdleActionWarn
+
+	HistoryFile  string // The (dontbug) prompt history file. "" means the default
+	HistoryLimit int    // Max entries in the (dontbug) prompt history. 0 means the readline default
 )
 
 type engineState struct {
 	breakStopNotify chan string
+	otherStopNotify chan struct{} // Delivers when gdb stops other than at a breakpoint or the end e.g. after an rr restart
+	exitNotify      chan programExit
+	programExit     *programExit // Set when we're at the end of the execution
 	gdbSession      *gdb.Gdb
 	ideConnection   net.Conn
 	rrFile          *os.File
 	rrCmd           *exec.Cmd
 	entryFilePHP    string
 	lastSequenceNum int
+	sequenceNumSeen bool              // Whether lastSequenceNum is from the current IDE connection
+	moveMutex       sync.Mutex        // Guards lastMoveCmd and lastMoveReverse. The prompt reads them while the IDE moves
+	lastMoveCmd     *dbgpCmd          // The last run/step command from the IDE. See bounceLastMove()
+	evalResults     map[string]string // Synthetic variable name => expression. See handleEval()
+	evalResultCount int
+	rrExited        chan struct{} // Closed when rr exits. See monitorRR()
+	closing         chan struct{} // Closed when the session is being torn down on purpose
+	endSession      chan string   // Delivers why the session should end e.g. the IDE sent stop. The (dontbug) prompt then exits so that rr and gdb are torn down
+	activityMutex   sync.Mutex
+	lastActivity    time.Time // See noteActivity()
+	bookmarks       map[string]*bookmark
+	lastMoveReverse bool // The direction of the last continueExecution(). See emitStopEvent()
 	status          engineStatus
 	reason          engineReason
 	featureMap      map[string]engineFeatureValue
@@ -72,6 +130,67 @@ type engineState struct {
 	sourceMap       map[string]int
 	maxStackDepth   int
 	levelAr         []int
+	funcLocMap      map[engineBreakpointType]int
+	opcodeBp        string // internal breakpoint used for opcode granularity stepping
+	watches         []string
+	gdbRemotePort   int // rr serves gdb at this port
+
+	// Guards breakpoints (the map and its entries) as both the IDE and the (dontbug) prompt use it
+	// Never held while waiting for gdb
+	breakpointsMutex sync.Mutex
+
+	// Guards watches as both the IDE and the (dontbug) prompt add and remove them
+	// Never held while evaluating them. See getWatches()
+	watchesMutex sync.Mutex
+
+	// status and reason may be read (e.g. for the status command) while a continuation is in progress
+	// statusMutex also guards engineReleased
+	statusMutex sync.Mutex
+
+	// Only one continuation (run/step) or IDE command that needs gdb may hold the engine at a time. Not nil while
+	// the engine is held and closed when it is released. See startContinuation() and waitForEngine()
+	engineReleased chan struct{}
+}
+
+func setStatus(es *engineState, status engineStatus, reason engineReason) {
+	es.statusMutex.Lock()
+	es.status = status
+	es.reason = reason
+	es.statusMutex.Unlock()
+	emitStatusEvent(status, reason)
+}
+
+func getStatus(es *engineState) (engineStatus, engineReason) {
+	es.statusMutex.Lock()
+	defer es.statusMutex.Unlock()
+	return es.status, es.reason
+}
+
+// How the PHP program terminated
+type programExit struct {
+	code   int
+	signal string // Set if the program was terminated by a signal (code is meaningless then)
+}
+
+func (exit programExit) String() string {
+	if exit.signal != "" {
+		return fmt.Sprintf("was terminated by signal %v", exit.signal)
+	}
+
+	return fmt.Sprintf("exited with code %v", exit.code)
+}
+
+// The ok reason is used only if the program ran to completion successfully
+func (exit programExit) reason() engineReason {
+	if exit.signal != "" {
+		return reasonAborted
+	}
+
+	if exit.code != 0 {
+		return reasonError
+	}
+
+	return reasonOk
 }
 
 type engineStatus string
@@ -85,23 +204,112 @@ type dbgpCmd struct {
 	reverse     bool // Run this command in reverse. Does not make sense for all commands
 }
 
+// A gdb command that does not complete in GdbCommandTimeout means gdb (or rr) is wedged. Instead of hanging forever
+// we panic. The IDE connection and diversion session commands recover from that like from any other failure
 func sendGdbCommand(gdbSession *gdb.Gdb, command string, arguments ...string) map[string]interface{} {
-	if VerboseFlag {
-		color.Green("dontbug -> gdb: %v %v", command, strings.Join(arguments, " "))
+	result, err := trySendGdbCommand(gdbSession, command, arguments...)
+	if err == errGdbCommandTimeout {
+		panic(&gdbTimeoutError{strings.TrimSpace(command + " " + strings.Join(arguments, " "))})
 	}
-	result, err := gdbSession.Send(command, arguments...)
 
 	// Note we're not panicing here. We really can't do anything here
 	fatalIf(err)
+	return result
+}
 
-	if VerboseFlag {
-		continued := ""
-		if len(result) > 300 {
-			continued = "..."
+var errGdbCommandTimeout = errors.New("gdb command timed out")
+
+// sendGdbCommand() panics with this on a timeout so that handlers can return it as an error. See recoverGdbTimeout()
+type gdbTimeoutError struct {
+	command string
+}
+
+func (e *gdbTimeoutError) Error() string {
+	return fmt.Sprintf("gdb did not complete %v in %v", e.command, GdbCommandTimeout)
+}
+
+// To be deferred with a pointer to the error result of a handler (or prompt command) that does not call
+// trySendGdbCommand() itself. A gdb timeout is then returned as its error instead of taking down the IDE
+// connection or, at the (dontbug) prompt, dontbug itself. Any other panic is passed on
+func recoverGdbTimeout(errPtr *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	timeoutErr, ok := r.(*gdbTimeoutError)
+	if !ok {
+		panic(r)
+	}
+	*errPtr = timeoutErr
+}
+
+// 1 while gdb runs the program i.e. between the *running and *stopped notifications. See noteGdbRunState()
+var gGdbRunning int32
+
+// Called with every gdb notification
+func noteGdbRunState(notification map[string]interface{}) {
+	if notification["type"] != "exec" {
+		return
+	}
+
+	switch notification["class"] {
+	case "running":
+		atomic.StoreInt32(&gGdbRunning, 1)
+	case "stopped":
+		atomic.StoreInt32(&gGdbRunning, 0)
+	}
+}
+
+// How gdb/mi commands are sent to gdb. Tests replace this with a fake gdb
+var gSendToGdb = (*gdb.Gdb).Send
+
+// Like sendGdbCommand() but returns errGdbCommandTimeout (or any other error) instead
+// Note that runs and steps only start a continuation in gdb. Waiting for the stop is done separately
+func trySendGdbCommand(gdbSession *gdb.Gdb, command string, arguments ...string) (map[string]interface{}, error) {
+	logDebugf(color.FgGreen, "dontbug -> gdb: %v %v", command, strings.Join(arguments, " "))
+
+	type sendResult struct {
+		result map[string]interface{}
+		err    error
+	}
+	resultChan := make(chan sendResult, 1)
+	go func() {
+		result, err := gSendToGdb(gdbSession, command, arguments...)
+		resultChan <- sendResult{result, err}
+	}()
+
+	// A timeout of 0 means wait forever (a nil channel never delivers)
+	var timeoutChan <-chan time.Time
+	if GdbCommandTimeout > 0 {
+		timeoutChan = time.After(GdbCommandTimeout)
+	}
+
+	var result map[string]interface{}
+	select {
+	case sent := <-resultChan:
+		if sent.err != nil {
+			return nil, sent.err
+		}
+		result = sent.result
+	case <-timeoutChan:
+		// Best effort e.g. an evaluation in the diversion session that is stuck. Any response that turns up
+		// later is simply dropped. There is nothing to interrupt if gdb is not running the program
+		if atomic.LoadInt32(&gGdbRunning) == 1 {
+			logErrorf(color.FgRed, "dontbug: gdb did not complete %v in %v. Interrupting it", command, GdbCommandTimeout)
+			gdbSession.Interrupt()
+		} else {
+			logErrorf(color.FgRed, "dontbug: gdb did not complete %v in %v", command, GdbCommandTimeout)
 		}
-		color.Cyan("gdb -> dontbug: %.300v%v", result, continued)
+		return nil, errGdbCommandTimeout
 	}
-	return result
+
+	continued := ""
+	if len(result) > 300 {
+		continued = "..."
+	}
+	logDebugf(color.FgCyan, "gdb -> dontbug: %.300v%v", result, continued)
+	return result, nil
 }
 
 func sendGdbCommandNoisy(gdbSession *gdb.Gdb, command string, arguments ...string) map[string]interface{} {
@@ -126,21 +334,50 @@ func parseGdbStringResponse(gdbResponse string) (string, error) {
 	return unquote, nil
 }
 
+// Decodes the C escapes gdb uses when printing a string: \" \\ \n etc. and octal escapes like \303 for
+// bytes it does not print as is (e.g. parts of non-ASCII characters). Unknown escapes are kept as they are
 func unquoteGdbStringResult(input string) string {
 	l := len(input)
 	var buf bytes.Buffer
-	skip := false
-	for i, c := range input {
-		if skip {
-			skip = false
+	for i := 0; i < l; i++ {
+		c := input[i]
+		if c != '\\' || i+1 == l {
+			buf.WriteByte(c)
 			continue
 		}
 
-		if c == '\\' && i < l && input[i+1] == '"' {
-			buf.WriteRune('"')
-			skip = true
-		} else {
-			buf.WriteRune(c)
+		i++
+		switch e := input[i]; e {
+		case '"', '\\', '\'', '?':
+			buf.WriteByte(e)
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'v':
+			buf.WriteByte('\v')
+		case 'e':
+			buf.WriteByte(033)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// Up to 3 octal digits
+			value := 0
+			j := i
+			for ; j < l && j < i+3 && input[j] >= '0' && input[j] <= '7'; j++ {
+				value = value*8 + int(input[j]-'0')
+			}
+			buf.WriteByte(byte(value))
+			i = j - 1
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(e)
 		}
 	}
 
@@ -201,63 +438,191 @@ func parseCommand(fullCommand string, reverseMode bool) dbgpCmd {
 }
 
 func xSlashSgdb(gdbSession *gdb.Gdb, expression string) string {
-	resultString := xGdbCmdValue(gdbSession, expression)
-	finalString, err := parseGdbStringResponse(resultString)
-	panicIf(err)
+	finalString, err := tryXSlashSgdb(gdbSession, expression)
+	panicIfGdbError(err)
 	return finalString
 }
 
 func xSlashDgdb(gdbSession *gdb.Gdb, expression string) int {
-	resultString := xGdbCmdValue(gdbSession, expression)
-	intResult, err := strconv.Atoi(resultString)
-	panicIf(err)
+	intResult, err := tryXSlashDgdb(gdbSession, expression)
+	panicIfGdbError(err)
 	return intResult
 }
 
-func xGdbCmdValue(gdbSession *gdb.Gdb, expression string) string {
-	result := sendGdbCommand(gdbSession, "data-evaluate-expression", expression)
-	class, ok := result["class"]
+// A gdb timeout is passed on as it is so that recoverGdbTimeout() can tell it apart
+func panicIfGdbError(err error) {
+	if timeoutErr, ok := err.(*gdbTimeoutError); ok {
+		panic(timeoutErr)
+	}
+	panicIf(err)
+}
+
+// Like xSlashSgdb() but returns an error (e.g. a gdb timeout) instead of panicking
+func tryXSlashSgdb(gdbSession *gdb.Gdb, expression string) (string, error) {
+	resultString, err := tryXGdbCmdValue(gdbSession, expression)
+	if err != nil {
+		return "", err
+	}
+	return parseGdbStringResponse(resultString)
+}
+
+// Like xSlashDgdb() but returns an error (e.g. a gdb timeout) instead of panicking
+func tryXSlashDgdb(gdbSession *gdb.Gdb, expression string) (int, error) {
+	resultString, err := tryXGdbCmdValue(gdbSession, expression)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(resultString)
+}
+
+// The PHP location e.g. file:///a.php:3 (from the variables of dontbug.c at the master breakpoint location)
+func currentPhpLocation(es *engineState) (string, error) {
+	filename, err := tryXSlashSgdb(es.gdbSession, "filename")
+	if err != nil {
+		return "", err
+	}
+
+	lineno, err := tryXSlashDgdb(es.gdbSession, "lineno")
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%v:%v", filename, lineno), nil
+}
+
+func tryXGdbCmdValue(gdbSession *gdb.Gdb, expression string) (string, error) {
+	result, err := trySendGdbCommand(gdbSession, "data-evaluate-expression", expression)
+	if err == errGdbCommandTimeout {
+		return "", &gdbTimeoutError{"data-evaluate-expression " + expression}
+	}
+	fatalIf(err)
 
+	class, ok := result["class"]
 	commandWas := "data-evaluate-expression " + expression
 	if !ok {
-		panicWith("Could not execute the gdb/mi command: " + commandWas)
+		return "", errors.New("Could not execute the gdb/mi command: " + commandWas)
 	}
 
 	if class != "done" {
-		panicWith("Not completed the gdb/mi command: " + commandWas)
+		return "", errors.New("Not completed the gdb/mi command: " + commandWas)
 	}
 
 	payload := result["payload"].(map[string]interface{})
 	resultString := payload["value"].(string)
 
-	return resultString
+	return resultString, nil
+}
+
+// Returns the program exit status if the gdb notification is for the program (i.e. the recorded PHP process) terminating
+// The exit code is given by gdb in octal
+func programExitGetStatus(notification map[string]interface{}) (programExit, bool) {
+	class, ok := notification["class"].(string)
+	if !ok || class != "stopped" {
+		return programExit{}, false
+	}
+
+	payload, ok := notification["payload"].(map[string]interface{})
+	if !ok {
+		return programExit{}, false
+	}
+
+	reason, _ := payload["reason"].(string)
+	switch reason {
+	case "exited-normally":
+		return programExit{}, true
+	case "exited":
+		exitCodeString, _ := payload["exit-code"].(string)
+		exitCode, err := strconv.ParseInt(exitCodeString, 8, 32)
+		if err != nil {
+			logWarnf(color.FgYellow, "dontbug: Could not understand the exit code %q reported by gdb", exitCodeString)
+			exitCode = -1
+		}
+		return programExit{code: int(exitCode)}, true
+	case "exited-signalled":
+		signalName, _ := payload["signal-name"].(string)
+		return programExit{signal: signalName}, true
+	}
+
+	return programExit{}, false
 }
 
 // Returns breakpoint id, true if stopped on a PHP breakpoint
+// A PHP breakpoint whose hit condition is not satisfied is counted but execution simply continues
 func continueExecution(es *engineState, reverse bool) (string, bool) {
-	es.status = statusRunning
-	if reverse {
-		sendGdbCommand(es.gdbSession, "exec-continue", "--reverse")
-	} else {
-		sendGdbCommand(es.gdbSession, "exec-continue")
-	}
+	es.moveMutex.Lock()
+	es.lastMoveReverse = reverse
+	es.moveMutex.Unlock()
+	for {
+		// rr lets us run backwards from the end of the execution
+		es.programExit = nil
+		if reverse {
+			sendGdbCommand(es.gdbSession, "exec-continue", "--reverse")
+		} else {
+			sendGdbCommand(es.gdbSession, "exec-continue")
+		}
+
+		// Wait for the corresponding breakpoint hit break id
+		breakID := waitForStop(es, reverse)
+		if breakID == programExitedID {
+			exit := <-es.exitNotify
+			es.programExit = &exit
+			logInfof(color.FgYellow, "dontbug: Reached the end of the execution. The PHP program %v", exit)
+			return breakID, false
+		}
+
+		// The IDE or the (dontbug) prompt may remove or disable the breakpoint at any time so look it up only once
+		es.breakpointsMutex.Lock()
+		bp, ok := es.breakpoints[breakID]
+		if !ok || bp.state != breakpointStateEnabled || bp.bpType == breakpointTypeInternal {
+			es.breakpointsMutex.Unlock()
+			return breakID, false
+		}
+		bp.hitCount++
+		satisfied := isHitConditionSatisfied(bp)
+		es.breakpointsMutex.Unlock()
+		if !satisfied {
+			continue
+		}
 
-	// Wait for the corresponding breakpoint hit break id
-	breakID := <-es.breakStopNotify
-	es.status = statusBreak
+		// Probably not a good idea to pass out breakId for a breakpoint that is gone
+		// But we're not using breakId currently
+		emitBreakpointEvent(es, bp)
+		if isEnabledPhpTemporaryBreakpoint(es, breakID) {
+			removeGdbBreakpoint(es, breakID)
+		}
 
-	// Probably not a good idea to pass out breakId for a breakpoint that is gone
-	// But we're not using breakId currently
-	if isEnabledPhpTemporaryBreakpoint(es, breakID) {
-		delete(es.breakpoints, breakID)
 		return breakID, true
 	}
+}
 
-	if isEnabledPhpBreakpoint(es, breakID) {
-		return breakID, true
+// Long runs (especially in reverse) can look like a hang. If HeartbeatInterval is set we say we're still running
+// gdb cannot be asked about the position (e.g. rr's event number) while the target is running so the elapsed time is shown
+// If rr dies while we wait there will never be a stop so we panic instead
+func waitForStop(es *engineState, reverse bool) string {
+	direction := "forward"
+	if reverse {
+		direction = "in reverse"
 	}
 
-	return breakID, false
+	// A nil channel never delivers
+	var tickerChan <-chan time.Time
+	if HeartbeatInterval > 0 {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		tickerChan = ticker.C
+	}
+
+	start := time.Now()
+	for {
+		select {
+		case breakID := <-es.breakStopNotify:
+			return breakID
+		case <-es.rrExited:
+			panicWith("rr exited while running " + direction)
+		case <-tickerChan:
+			logInfof(color.FgCyan, "dontbug: Still running %v (%v so far)", direction, time.Since(start)/time.Second*time.Second)
+		}
+	}
 }
 
 func constructDbgpPacket(payload string) []byte {
@@ -279,6 +644,20 @@ func makeNoisy(f func(*engineState, dbgpCmd) string, es *engineState, dCmd dbgpC
 	return result
 }
 
+// Joins the command and its arguments so that the result can be pasted into a shell
+func shellQuoteCommand(commandAr []string) string {
+	quoted := make([]string, len(commandAr))
+	for i, arg := range commandAr {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=.,/:@+%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+
+	return strings.Join(quoted, " ")
+}
+
 // Output a fatal error if there is anything wrong with path
 // Otherwise output the absolute path of the directory/file (and follow any symlinks)
 func getAbsNoSymlinkPath(path string) string {
@@ -305,7 +684,7 @@ func findExec(file string) (string, error) {
 		return "", fmt.Errorf("Could not find %v. %v", file, err)
 	}
 
-	color.Yellow("dontbug: Using %v from path %v", name, path)
+	logInfof(color.FgYellow, "dontbug: Using %v from path %v", name, path)
 	return path, nil
 }
 
@@ -381,33 +760,46 @@ func getPathAndVersionLineOrFatal(file string) (string, string) {
 	path, err := findExec(file)
 	fatalIf(err)
 
-	output, err := exec.Command(path, "--version").Output()
+	firstLine, err := getVersionLine(path)
 	fatalIf(err)
 
+	return path, firstLine
+}
+
+// Returns the first line of the --version output of the executable
+func getVersionLine(path string) (string, error) {
+	output, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+
 	outString := string(output)
 	firstLine := strings.Split(outString, "\n")[0]
 
-	return path, firstLine
+	return firstLine, nil
 }
 
+// Verboseln prints at the debug log level
 func Verboseln(a ...interface{}) (n int, err error) {
-	if VerboseFlag {
+	if logEnabled(LogLevelDebug) {
 		return fmt.Println(a...)
 	}
 
 	return 0, nil
 }
 
+// Verbosef prints at the debug log level
 func Verbosef(format string, a ...interface{}) (n int, err error) {
-	if VerboseFlag {
+	if logEnabled(LogLevelDebug) {
 		return fmt.Printf(format, a...)
 	}
 
 	return 0, nil
 }
 
+// Verbose prints at the debug log level
 func Verbose(a ...interface{}) (n int, err error) {
-	if VerboseFlag {
+	if logEnabled(LogLevelDebug) {
 		return fmt.Print(a...)
 	}
 
@@ -416,13 +808,13 @@ func Verbose(a ...interface{}) (n int, err error) {
 
 func panicIf(err error) {
 	if err != nil {
-		panic(fmt.Sprintf("dontbug: \x1b[101mPanic:\x1b[0m %v\n%s\n", err, debug.Stack()))
+		panic(fmt.Sprintf("dontbug: %v %v\n%s\n", color.New(color.BgHiRed).Sprint("Panic:"), err, debug.Stack()))
 	}
 }
 
 func panicWith(errStr string) {
 	if errStr != "" {
-		panic(fmt.Errorf("dontbug: \x1b[101mPanic:\x1b[0m %v\n%s\n", errStr, debug.Stack()))
+		panic(fmt.Errorf("dontbug: %v %v\n%s\n", color.New(color.BgHiRed).Sprint("Panic:"), errStr, debug.Stack()))
 	}
 }
 
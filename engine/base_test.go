@@ -0,0 +1,95 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"github.com/cyrus-and/gdb"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGdbStringResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		expected string
+	}{
+		{`0x7f44a33a9c1e ""`, ``},
+		{`0x7f261d8624e8 "<property name=\"$x\"/>"`, `<property name="$x"/>`},
+		{`0x7f261d8624e8 "caf\303\251"`, "café"},
+		{`0x7f261d8624e8 "a\\b\nc"`, "a\\b\nc"},
+	}
+
+	for _, test := range tests {
+		result, err := parseGdbStringResponse(test.response)
+		if err != nil {
+			t.Errorf("%v: %v", test.response, err)
+		} else if result != test.expected {
+			t.Errorf("%v: got %q instead of %q", test.response, result, test.expected)
+		}
+	}
+
+	_, err := parseGdbStringResponse("0x7f261d8624e8")
+	if err == nil {
+		t.Error("A response without a string should be an error")
+	}
+}
+
+// gdb takes too long to disable breakpoints. gdb is not running the program so it is not interrupted either (the
+// fake has no gdb session to interrupt)
+func TestGdbTimeoutIsAnError(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0, 3, 0)...)
+	defer f.close()
+	mustSetBreakpoint(t, es, "file:///a.php", 2)
+
+	defer func(timeout time.Duration) {
+		GdbCommandTimeout = timeout
+	}(GdbCommandTimeout)
+	GdbCommandTimeout = 50 * time.Millisecond
+
+	// The timed out sends carry on in the background. Wait for them before touching the fake gdb again
+	delayed := make(chan struct{}, 1)
+	gSendToGdb = func(gdbSession *gdb.Gdb, command string, arguments ...string) (map[string]interface{}, error) {
+		if command == "break-disable" {
+			defer func() { delayed <- struct{}{} }()
+			time.Sleep(200 * time.Millisecond)
+		}
+		return f.send(gdbSession, command, arguments...)
+	}
+
+	// At the (dontbug) prompt
+	_, err := gotoPhpLocation(es, "a.php:3", false)
+	if _, ok := err.(*gdbTimeoutError); !ok {
+		t.Errorf("g should fail with the gdb timeout. Got: %v", err)
+	}
+	if status, reason := getStatus(es); status != statusBreak || reason != reasonError {
+		t.Errorf("Expected status %v/%v after the timeout. Got %v/%v", statusBreak, reasonError, status, reason)
+	}
+	<-delayed
+
+	err = evalInAllFrames(es, "$x")
+	if _, ok := err.(*gdbTimeoutError); !ok {
+		t.Errorf("evalall should fail with the gdb timeout. Got: %v", err)
+	}
+	<-delayed
+
+	// From the IDE
+	response := dispatchMappedIdeRequest(es, "eval -i 5 -- "+base64.StdEncoding.EncodeToString([]byte("$x")), false)
+	if !strings.Contains(response, "<error") || !strings.Contains(response, "gdb did not complete break-disable") {
+		t.Errorf("eval should get an error response. Got: %v", response)
+	}
+	<-delayed
+}
@@ -0,0 +1,236 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long rr may take to go back to a checkpoint
+const bookmarkRestartTimeout = 30 * time.Second
+
+// A named replay position for the mark and goto prompt commands. An rr checkpoint is what we actually go back to.
+// The rr event is only informational e.g. for use with replay --start-event in a later session
+type bookmark struct {
+	name       string
+	checkpoint int
+	event      int // -1 if rr did not tell us
+	location   string
+}
+
+func (b *bookmark) String() string {
+	if b.event < 0 {
+		return fmt.Sprintf("%v at %v", b.name, b.location)
+	}
+
+	return fmt.Sprintf("%v at %v (rr event %v)", b.name, b.location, b.event)
+}
+
+var (
+	gCheckpointRegexp = regexp.MustCompile(`Checkpoint (\d+)`)
+	gRREventRegexp    = regexp.MustCompile(`event:? (\d+)`)
+)
+
+// gdb console commands (e.g. checkpoint, when) only report what they did as console output and not in their
+// gdb/mi result. The gdb notification callback hands the console output to us while a capture is in progress
+var gGdbConsoleCapture = struct {
+	sync.Mutex
+	capturing bool
+	output    bytes.Buffer
+}{}
+
+// Called from the gdb notification callback
+func captureGdbConsoleOutput(notification map[string]interface{}) {
+	if notification["type"] != "console" {
+		return
+	}
+
+	payload, ok := notification["payload"].(string)
+	if !ok {
+		return
+	}
+
+	gGdbConsoleCapture.Lock()
+	defer gGdbConsoleCapture.Unlock()
+	if gGdbConsoleCapture.capturing {
+		gGdbConsoleCapture.output.WriteString(payload)
+	}
+}
+
+// There is only the one capture so console commands are run one at a time e.g. a status from the IDE (when) and
+// a mark at the prompt (checkpoint) would otherwise get each other's output
+var gGdbConsoleCommandMutex sync.Mutex
+
+// Runs a gdb console command and returns its console output
+func gdbConsoleCommand(es *engineState, command string) (string, error) {
+	gGdbConsoleCommandMutex.Lock()
+	defer gGdbConsoleCommandMutex.Unlock()
+
+	gGdbConsoleCapture.Lock()
+	gGdbConsoleCapture.capturing = true
+	gGdbConsoleCapture.output.Reset()
+	gGdbConsoleCapture.Unlock()
+
+	result, err := trySendGdbCommand(es.gdbSession, "interpreter-exec", "console", strconv.Quote(command))
+
+	gGdbConsoleCapture.Lock()
+	gGdbConsoleCapture.capturing = false
+	output := gGdbConsoleCapture.output.String()
+	gGdbConsoleCapture.Unlock()
+
+	if err != nil {
+		return "", fmt.Errorf("%q failed: %v", command, err)
+	}
+
+	if result["class"] != "done" && result["class"] != "running" {
+		return "", fmt.Errorf("%q failed: %v", command, result["payload"])
+	}
+
+	return output, nil
+}
+
+// For the mark prompt command. Marking an existing name again moves the bookmark
+func markBookmark(es *engineState, name string) (_ *bookmark, err error) {
+	if name == "" {
+		return nil, errors.New("Please provide a name for the bookmark e.g. mark before-save")
+	}
+
+	if !startContinuation(es) {
+		return nil, errors.New("Last continuation not yet complete")
+	}
+	defer endContinuation(es, &err)
+
+	if es.programExit != nil {
+		return nil, fmt.Errorf("Can't bookmark the end of the execution. %v", es.programExit)
+	}
+
+	checkpoint, err := createCheckpoint(es)
+	if err != nil {
+		return nil, err
+	}
+
+	event := -1
+	output, err := gdbConsoleCommand(es, "when")
+	if matches := gRREventRegexp.FindStringSubmatch(output); err == nil && matches != nil {
+		event, _ = strconv.Atoi(matches[1])
+	}
+
+	if old, ok := es.bookmarks[name]; ok {
+		gdbConsoleCommand(es, fmt.Sprintf("delete checkpoint %v", old.checkpoint))
+	}
+
+	location, err := currentPhpLocation(es)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bookmark{
+		name:       name,
+		checkpoint: checkpoint,
+		event:      event,
+		location:   location,
+	}
+
+	if es.bookmarks == nil {
+		es.bookmarks = make(map[string]*bookmark)
+	}
+	es.bookmarks[name] = b
+	return b, nil
+}
+
+// For the goto prompt command. Works in either direction
+func gotoBookmark(es *engineState, name string) (_ *bookmark, err error) {
+	b, ok := es.bookmarks[name]
+	if !ok {
+		return nil, fmt.Errorf("No bookmark named %q. See mark", name)
+	}
+
+	if !startContinuation(es) {
+		return nil, errors.New("Last continuation not yet complete")
+	}
+	defer endContinuation(es, &err)
+
+	err = restartCheckpoint(es, b.checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Could not go back to %v: %v", b, err)
+	}
+
+	notifyIde(es, "dontbug_goto", fmt.Sprintf("Went to %v. Step to see the new location", b))
+	return b, nil
+}
+
+// An rr checkpoint of the current position. Checkpoints are what bookmarks and the diff prompt command go back to
+func createCheckpoint(es *engineState) (int, error) {
+	output, err := gdbConsoleCommand(es, "checkpoint")
+	if err != nil {
+		return 0, err
+	}
+
+	matches := gCheckpointRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		return 0, fmt.Errorf("Could not understand the checkpoint reported by rr: %q", output)
+	}
+
+	checkpoint, _ := strconv.Atoi(matches[1])
+	return checkpoint, nil
+}
+
+// Goes (forward or back) to checkpoint and waits for rr to get there
+func restartCheckpoint(es *engineState, checkpoint int) error {
+	// A stale stop e.g. from an interrupted diversion session command
+	select {
+	case <-es.otherStopNotify:
+	default:
+	}
+
+	_, err := gdbConsoleCommand(es, fmt.Sprintf("restart %v", checkpoint))
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-es.otherStopNotify:
+	case <-time.After(bookmarkRestartTimeout):
+		return fmt.Errorf("rr did not go back to checkpoint %v in %v", checkpoint, bookmarkRestartTimeout)
+	}
+
+	// We may have gone back from the end of the execution
+	es.programExit = nil
+	return nil
+}
+
+func printBookmarks(es *engineState) {
+	if len(es.bookmarks) == 0 {
+		fmt.Println("No bookmarks. See mark")
+		return
+	}
+
+	var names []string
+	for name := range es.bookmarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Println(es.bookmarks[name])
+	}
+}
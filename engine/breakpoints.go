@@ -18,7 +18,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fatih/color"
+	"html"
+	"io/ioutil"
 	"log"
+	"net/url"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -48,6 +53,7 @@ const (
 	// Error codes returned when a user (php) breakpoint cannot be set
 	breakpointErrorCodeCouldNotSet      engineBreakpointErrorCode = 200
 	breakpointErrorCodeTypeNotSupported engineBreakpointErrorCode = 201
+	breakpointErrorCodeNoSuchBreakpoint engineBreakpointErrorCode = 205
 )
 
 type engineBreakpointError struct {
@@ -72,6 +78,8 @@ type engineBreakPoint struct {
 	hitCondition engineBreakpointCondition
 	exception    string
 	expression   string
+	function     string // Only for call and return breakpoints
+	class        string // Optional, only for call and return breakpoints
 }
 
 func stringToBreakpointType(t string) (engineBreakpointType, error) {
@@ -119,58 +127,189 @@ func breakpointStopGetID(notification map[string]interface{}) (string, bool) {
 	return breakPointNumString, true
 }
 
-func handleBreakpointUpdate(es *engineState, dCmd dbgpCmd) string {
+func handleBreakpointUpdate(es *engineState, dCmd dbgpCmd) (string, error) {
 	d, ok := dCmd.options["d"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide breakpoint number for breakpoint_update. Got:", dCmd.fullCommand))
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide breakpoint number for breakpoint_update. Got: %v", dCmd.fullCommand)
 	}
 
-	_, ok = dCmd.options["n"]
-	if ok {
-		panicWith(fmt.Sprint("Line number updates are currently unsupported in breakpoint_update. Got:", dCmd.fullCommand))
+	bp, ok := lookupPhpBreakpoint(es, d)
+	if !ok {
+		return "", newDbgpError(int(breakpointErrorCodeNoSuchBreakpoint), "No such breakpoint: %v", d)
 	}
 
-	_, ok = dCmd.options["h"]
-	if ok {
-		panicWith(fmt.Sprint("Hit condition/value update is currently not supported in breakpoint_update. Got:", dCmd.fullCommand))
+	s, sOk := dCmd.options["s"]
+	n, nOk := dCmd.options["n"]
+	_, hOk := dCmd.options["h"]
+	_, oOk := dCmd.options["o"]
+	if !sOk && !nOk && !hOk && !oOk {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide a new breakpoint status, line number or hit condition/value in breakpoint_update. Got: %v", dCmd.fullCommand)
 	}
 
-	_, ok = dCmd.options["o"]
-	if ok {
-		panicWith(fmt.Sprint("Hit condition/value update is currently not supported in breakpoint_update. Got:", dCmd.fullCommand))
+	// Validate everything before we change anything
+	es.breakpointsMutex.Lock()
+	hitValue, hitCondition, err := parseHitOptions(dCmd, bp.hitValue, bp.hitCondition)
+	es.breakpointsMutex.Unlock()
+	if err != nil {
+		return "", newDbgpError(int(breakpointErrorCodeCouldNotSet), "%v", err)
 	}
 
-	s, ok := dCmd.options["s"]
-	if !ok {
-		panicWith(fmt.Sprint("Please provide new breakpoint status in breakpoint_update. Got:", dCmd.fullCommand))
+	if sOk && s != "disabled" && s != "enabled" {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Unknown breakpoint status %v for breakpoint_update", s)
+	}
+
+	if nOk && bp.bpType != breakpointTypeLine {
+		return "", newDbgpError(int(breakpointErrorCodeCouldNotSet), "Only line breakpoints can have their line number updated")
+	}
+
+	phpLineno := 0
+	if nOk {
+		phpLineno, err = strconv.Atoi(n)
+		if err != nil {
+			return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Invalid line number: %v", n)
+		}
+
+		err = checkPhpBreakpointLine(bp.filename, phpLineno)
+		if err != nil {
+			warning := fmt.Sprintf("dontbug: Breakpoint can't be moved to %v:%v going by the current file on disk "+
+				"(not the recorded source, which may differ if the file changed since): %v", bp.filename, phpLineno, err)
+			logInfof(color.FgYellow, "%v", warning)
+			return "", newDbgpError(int(breakpointErrorCodeCouldNotSet), "%v", warning)
+		}
 	}
 
+	if nOk {
+		// The gdb breakpoint is already on the correct line in dontbug_break.c for this file
+		// We only need to change the PHP line number in its condition
+		result, err := trySendGdbCommand(es.gdbSession, "break-condition", d, fmt.Sprintf("lineno == %v", phpLineno))
+		if err != nil || result["class"] != "done" {
+			warning := fmt.Sprintf("dontbug: Could not move breakpoint %v in gdb backend to %v:%v", d, bp.filename, phpLineno)
+			logWarnf(color.FgRed, "%v", warning)
+			return "", newDbgpError(int(breakpointErrorCodeCouldNotSet), "%v", warning)
+		}
+		es.breakpointsMutex.Lock()
+		bp.lineno = phpLineno
+		es.breakpointsMutex.Unlock()
+	}
+
+	es.breakpointsMutex.Lock()
+	bp.hitValue = hitValue
+	bp.hitCondition = hitCondition
+	es.breakpointsMutex.Unlock()
+
 	if s == "disabled" {
 		disableGdbBreakpoint(es, d)
 	} else if s == "enabled" {
 		enableGdbBreakpoint(es, d)
-	} else {
-		panicWith(fmt.Sprintf("Unknown breakpoint status %v for breakpoint_update", s))
 	}
 
-	return fmt.Sprintf(gBreakpointRemoveOrUpdateXMLResponseFormat, "breakpoint_update", dCmd.seqNum)
+	return fmt.Sprintf(gBreakpointRemoveOrUpdateXMLResponseFormat, "breakpoint_update", dCmd.seqNum), nil
+}
+
+// Reads the -h (hit value) and -o (hit condition) options of a breakpoint_set/breakpoint_update
+// If an option was not provided, the value passed in is returned unchanged
+func parseHitOptions(dCmd dbgpCmd, hitValue int, hitCondition engineBreakpointCondition) (int, engineBreakpointCondition, error) {
+	h, ok := dCmd.options["h"]
+	if ok {
+		var err error
+		hitValue, err = strconv.Atoi(h)
+		if err != nil || hitValue < 0 {
+			return 0, "", fmt.Errorf("Invalid hit value: %v", h)
+		}
+
+		// As per the dbgp spec
+		if hitCondition == "" {
+			hitCondition = breakpointHitCondGtEq
+		}
+	}
+
+	o, ok := dCmd.options["o"]
+	if ok {
+		switch engineBreakpointCondition(o) {
+		case breakpointHitCondGtEq, breakpointHitCondEq, breakpointHitCondMod:
+			hitCondition = engineBreakpointCondition(o)
+		default:
+			return 0, "", fmt.Errorf("Unknown hit condition: %v", o)
+		}
+	}
+
+	return hitValue, hitCondition, nil
+}
+
+// Should we stop at this breakpoint given its hit count (which includes the current hit)?
+func isHitConditionSatisfied(bp *engineBreakPoint) bool {
+	if bp.hitValue == 0 {
+		return true
+	}
+
+	switch bp.hitCondition {
+	case breakpointHitCondEq:
+		return bp.hitCount == bp.hitValue
+	case breakpointHitCondMod:
+		return bp.hitCount%bp.hitValue == 0
+	default:
+		return bp.hitCount >= bp.hitValue
+	}
+}
+
+func handleBreakpointGet(es *engineState, dCmd dbgpCmd) (string, error) {
+	d, ok := dCmd.options["d"]
+	if !ok {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide breakpoint id for breakpoint_get. Got: %v", dCmd.fullCommand)
+	}
+
+	bp, ok := lookupPhpBreakpoint(es, d)
+	if !ok {
+		return "", newDbgpError(int(breakpointErrorCodeNoSuchBreakpoint), "No such breakpoint: %v", d)
+	}
+
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+	return fmt.Sprintf(gBreakpointGetXMLResponseFormat, dCmd.seqNum, breakpointXMLElement(bp)), nil
+}
+
+func breakpointXMLElement(bp *engineBreakPoint) string {
+	temporary := 0
+	if bp.temporary {
+		temporary = 1
+	}
+
+	return fmt.Sprintf(gBreakpointXMLElementFormat,
+		bp.id,
+		bp.bpType,
+		bp.state,
+		html.EscapeString(bp.filename),
+		bp.lineno,
+		html.EscapeString(bp.function),
+		html.EscapeString(bp.class),
+		temporary,
+		bp.hitCount,
+		bp.hitValue,
+		html.EscapeString(string(bp.hitCondition)),
+		html.EscapeString(bp.expression))
 }
 
-func handleBreakpointRemove(es *engineState, dCmd dbgpCmd) string {
+func handleBreakpointRemove(es *engineState, dCmd dbgpCmd) (string, error) {
 	d, ok := dCmd.options["d"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide breakpoint id to remove. Got:", dCmd.fullCommand))
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide breakpoint id to remove. Got: %v", dCmd.fullCommand)
+	}
+
+	// Removing an internal breakpoint would break stepping
+	_, ok = lookupPhpBreakpoint(es, d)
+	if !ok {
+		return "", newDbgpError(int(breakpointErrorCodeNoSuchBreakpoint), "No such breakpoint: %v", d)
 	}
 
 	removeGdbBreakpoint(es, d)
 
-	return fmt.Sprintf(gBreakpointRemoveOrUpdateXMLResponseFormat, "breakpoint_remove", dCmd.seqNum)
+	return fmt.Sprintf(gBreakpointRemoveOrUpdateXMLResponseFormat, "breakpoint_remove", dCmd.seqNum), nil
 }
 
-func handleBreakpointSetLineBreakpoint(es *engineState, dCmd dbgpCmd) string {
+func handleBreakpointSetLineBreakpoint(es *engineState, dCmd dbgpCmd) (string, error) {
 	phpFilename, ok := dCmd.options["f"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide filename option -f in breakpoint_set. Got: ", dCmd.fullCommand))
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide filename option -f in breakpoint_set. Got: %v", dCmd.fullCommand)
 	}
 
 	status, ok := dCmd.options["s"]
@@ -179,7 +318,7 @@ func handleBreakpointSetLineBreakpoint(es *engineState, dCmd dbgpCmd) string {
 		if status == "disabled" {
 			disabled = true
 		} else if status != "enabled" {
-			panicWith("Unknown breakpoint status: " + status)
+			return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Unknown breakpoint status: %v", status)
 		}
 	} else {
 		status = "enabled"
@@ -187,7 +326,7 @@ func handleBreakpointSetLineBreakpoint(es *engineState, dCmd dbgpCmd) string {
 
 	phpLinenoString, ok := dCmd.options["n"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide line number option -n in breakpoint_set. Got:", dCmd.fullCommand))
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide line number option -n in breakpoint_set. Got: %v", dCmd.fullCommand)
 	}
 
 	r, ok := dCmd.options["r"]
@@ -196,45 +335,144 @@ func handleBreakpointSetLineBreakpoint(es *engineState, dCmd dbgpCmd) string {
 		temporary = true
 	}
 
-	_, ok = dCmd.options["h"]
-	if ok {
-		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Hit condition/value is currently not supported")
+	hitValue, hitCondition, err := parseHitOptions(dCmd, 0, "")
+	if err != nil {
+		return "", newDbgpError(int(breakpointErrorCodeCouldNotSet), "%v", err)
+	}
+
+	phpLineno, err := strconv.Atoi(phpLinenoString)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Invalid line number: %v", phpLinenoString)
+	}
+
+	id, breakErr := setPhpBreakpointInGdb(es, phpFilename, phpLineno, disabled, temporary)
+	if breakErr != nil {
+		return "", newDbgpError(int(breakErr.code), "%v", breakErr.message)
+	}
+
+	es.breakpointsMutex.Lock()
+	es.breakpoints[id].hitValue = hitValue
+	es.breakpoints[id].hitCondition = hitCondition
+	es.breakpointsMutex.Unlock()
+
+	return fmt.Sprintf(gBreakpointSetLineXMLResponseFormat, dCmd.seqNum, status, id), nil
+}
+
+// The PHP breakpoint types we're able to set, each with its breakpoint_set handler
+// What we advertise to the IDE via feature_get -n breakpoint_types is derived from this table
+var gBreakpointSetHandlers = map[engineBreakpointType]dbgpCmdHandler{
+	breakpointTypeLine:   handleBreakpointSetLineBreakpoint,
+	breakpointTypeCall:   handleBreakpointSetFunctionBreakpoint,
+	breakpointTypeReturn: handleBreakpointSetFunctionBreakpoint,
+}
+
+// Returns a space separated list of the breakpoint types we support in the order given by the dbgp spec
+func supportedBreakpointTypes() string {
+	allTypes := []engineBreakpointType{
+		breakpointTypeLine,
+		breakpointTypeCall,
+		breakpointTypeReturn,
+		breakpointTypeException,
+		breakpointTypeConditional,
+		breakpointTypeWatch,
+	}
+
+	var supported []string
+	for _, t := range allTypes {
+		if _, ok := gBreakpointSetHandlers[t]; ok {
+			supported = append(supported, string(t))
+		}
+	}
+
+	return strings.Join(supported, " ")
+}
+
+// Handles both call and return breakpoints
+func handleBreakpointSetFunctionBreakpoint(es *engineState, dCmd dbgpCmd) (string, error) {
+	bpType, err := stringToBreakpointType(dCmd.options["t"])
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "%v", err)
+	}
+
+	function, ok := dCmd.options["m"]
+	if !ok {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide function name option -m in breakpoint_set. Got: %v", dCmd.fullCommand)
 	}
 
-	_, ok = dCmd.options["o"]
+	status, ok := dCmd.options["s"]
+	disabled := false
 	if ok {
-		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Hit condition/value is currently not supported")
+		if status == "disabled" {
+			disabled = true
+		} else if status != "enabled" {
+			return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Unknown breakpoint status: %v", status)
+		}
+	} else {
+		status = "enabled"
 	}
 
-	phpLineno, err := strconv.Atoi(phpLinenoString)
-	panicIf(err)
+	temporary := dCmd.options["r"] == "1"
 
-	id, breakErr := setPhpBreakpointInGdb(es, phpFilename, phpLineno, disabled, temporary)
+	// Some IDEs send Class::method instead of using the -a option
+	class := dCmd.options["a"]
+	if parts := strings.SplitN(function, "::", 2); len(parts) == 2 {
+		class, function = parts[0], parts[1]
+	}
+
+	hitValue, hitCondition, err := parseHitOptions(dCmd, 0, "")
+	if err != nil {
+		return "", newDbgpError(int(breakpointErrorCodeCouldNotSet), "%v", err)
+	}
+
+	id, breakErr := setPhpFunctionBreakpointInGdb(es, bpType, function, class, disabled, temporary)
 	if breakErr != nil {
-		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakErr.code, breakErr.message)
+		return "", newDbgpError(int(breakErr.code), "%v", breakErr.message)
 	}
 
-	return fmt.Sprintf(gBreakpointSetLineXMLResponseFormat, dCmd.seqNum, status, id)
+	es.breakpointsMutex.Lock()
+	es.breakpoints[id].hitValue = hitValue
+	es.breakpoints[id].hitCondition = hitCondition
+	es.breakpointsMutex.Unlock()
+
+	return fmt.Sprintf(gBreakpointSetLineXMLResponseFormat, dCmd.seqNum, status, id), nil
 }
 
-func handleBreakpointSet(es *engineState, dCmd dbgpCmd) string {
+func handleBreakpointSet(es *engineState, dCmd dbgpCmd) (string, error) {
 	t, ok := dCmd.options["t"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide breakpoint type option -t in breakpoint_set. Got:", dCmd.fullCommand))
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide breakpoint type option -t in breakpoint_set. Got: %v", dCmd.fullCommand)
 	}
 
 	tt, err := stringToBreakpointType(t)
-	panicIf(err)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "%v", err)
+	}
 
-	switch tt {
-	case breakpointTypeLine:
-		return handleBreakpointSetLineBreakpoint(es, dCmd)
-	default:
-		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Breakpoint type "+tt+" is not supported")
+	handler, ok := gBreakpointSetHandlers[tt]
+	if !ok {
+		return "", newDbgpError(int(breakpointErrorCodeTypeNotSupported), "Breakpoint type %v is not supported", tt)
 	}
+
+	return handler(es, dCmd)
+}
+
+// Internal breakpoints are not visible to the IDE
+func lookupPhpBreakpoint(es *engineState, id string) (*engineBreakPoint, bool) {
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
+	bp, ok := es.breakpoints[id]
+	if !ok || bp.bpType == breakpointTypeInternal {
+		return nil, false
+	}
+
+	return bp, true
 }
 
 func getEnabledPhpBreakpoints(es *engineState) []string {
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
 	var enabledPhpBreakpoints []string
 	for name, bp := range es.breakpoints {
 		if bp.state == breakpointStateEnabled && bp.bpType != breakpointTypeInternal {
@@ -245,17 +483,10 @@ func getEnabledPhpBreakpoints(es *engineState) []string {
 	return enabledPhpBreakpoints
 }
 
-func isEnabledPhpBreakpoint(es *engineState, id string) bool {
-	for name, bp := range es.breakpoints {
-		if name == id && bp.state == breakpointStateEnabled && bp.bpType != breakpointTypeInternal {
-			return true
-		}
-	}
-
-	return false
-}
-
 func isEnabledPhpTemporaryBreakpoint(es *engineState, id string) bool {
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
 	for name, bp := range es.breakpoints {
 		if name == id &&
 			bp.state == breakpointStateEnabled &&
@@ -272,12 +503,7 @@ func disableGdbBreakpoints(es *engineState, bpList []string) {
 	if len(bpList) > 0 {
 		commandArgs := fmt.Sprintf("%v", strings.Join(bpList, " "))
 		sendGdbCommand(es.gdbSession, "break-disable", commandArgs)
-		for _, el := range bpList {
-			bp, ok := es.breakpoints[el]
-			if ok {
-				bp.state = breakpointStateDisabled
-			}
-		}
+		setBreakpointsState(es, bpList, breakpointStateDisabled)
 	}
 }
 
@@ -289,32 +515,46 @@ func disableGdbBreakpoint(es *engineState, bp string) {
 // Note that not all "internal" breakpoints are stored in the breakpoints table
 func disableAllGdbBreakpoints(es *engineState) {
 	sendGdbCommand(es.gdbSession, "break-disable")
-	for _, bp := range es.breakpoints {
-		bp.state = breakpointStateDisabled
-	}
+	setBreakpointsState(es, nil, breakpointStateDisabled)
 }
 
 func enableAllGdbBreakpoints(es *engineState) {
 	sendGdbCommand(es.gdbSession, "break-enable")
-	for _, bp := range es.breakpoints {
-		bp.state = breakpointStateEnabled
-	}
+	setBreakpointsState(es, nil, breakpointStateEnabled)
 }
 
 func enableGdbBreakpoints(es *engineState, bpList []string) {
 	if len(bpList) > 0 {
 		commandArgs := fmt.Sprintf("%v", strings.Join(bpList, " "))
 		sendGdbCommand(es.gdbSession, "break-enable", commandArgs)
-		for _, el := range bpList {
-			bp, ok := es.breakpoints[el]
-			if ok {
-				bp.state = breakpointStateEnabled
-			}
+		setBreakpointsState(es, bpList, breakpointStateEnabled)
+	}
+}
+
+// A nil bpList means all breakpoints
+func setBreakpointsState(es *engineState, bpList []string, state engineBreakpointState) {
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
+	if bpList == nil {
+		for _, bp := range es.breakpoints {
+			bp.state = state
+		}
+		return
+	}
+
+	for _, el := range bpList {
+		bp, ok := es.breakpoints[el]
+		if ok {
+			bp.state = state
 		}
 	}
 }
 
 func getAssocEnabledPhpBreakpoint(es *engineState, filename string, lineno int) (string, bool) {
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
 	for name, bp := range es.breakpoints {
 		if bp.filename == filename &&
 			bp.lineno == lineno &&
@@ -332,13 +572,56 @@ func enableGdbBreakpoint(es *engineState, bp string) {
 	enableGdbBreakpoints(es, []string{bp})
 }
 
+// IDEs percent encode file:// URIs e.g. spaces as %20 but the source map has plain paths
+func normalizeIdeFilename(phpFilename string) string {
+	if !strings.HasPrefix(phpFilename, "file://") {
+		return phpFilename
+	}
+
+	filePath := phpFilename[len("file://"):]
+	unescaped, err := url.PathUnescape(filePath)
+	if err == nil {
+		filePath = unescaped
+	}
+
+	return "file://" + path.Clean(filePath)
+}
+
+// To help diagnose path mapping problems
+func sourceMapFilesNamed(es *engineState, baseName string) []string {
+	var candidates []string
+	for filename := range es.sourceMap {
+		if path.Base(filename) == baseName {
+			candidates = append(candidates, filename)
+		}
+	}
+
+	sort.Strings(candidates)
+	return candidates
+}
+
 // Sets an equivalent breakpoint in gdb for PHP
 // Also inserts the breakpoint into es.Breakpoints table
 func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, disabled bool, temporary bool) (string, *engineBreakpointError) {
+	phpFilename = normalizeIdeFilename(phpFilename)
 	internalLineno, ok := es.sourceMap[phpFilename]
 	if !ok {
-		warning := fmt.Sprintf("dontbug: [This warning is usually harmless and can be ignored] Warning: Not able to find %v to add a breakpoint. The IDE is either trying to set a breakpoint for a file from a different project or the root directory command line parameter was not specified correctly.", phpFilename)
-		color.Yellow(warning)
+		warning := fmt.Sprintf("dontbug: Breakpoint at %v:%v is unresolved as %v is not among the PHP sources that were recorded. "+
+			"Either the file is outside the <php-source-root-dir> given to 'dontbug record' or the IDE path mappings (see also dontbug replay --path-map) are not correct.",
+			phpFilename, phpLineno, phpFilename)
+		candidates := sourceMapFilesNamed(es, path.Base(phpFilename))
+		if len(candidates) > 0 {
+			warning += fmt.Sprintf(" Files with the same name that were recorded: %v", strings.Join(candidates, ", "))
+		}
+		logInfof(color.FgYellow, "%v", warning)
+		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+	}
+
+	err := checkPhpBreakpointLine(phpFilename, phpLineno)
+	if err != nil {
+		warning := fmt.Sprintf("dontbug: Breakpoint at %v:%v can't be hit going by the current file on disk "+
+			"(not the recorded source, which may differ if the file changed since): %v", phpFilename, phpLineno, err)
+		logInfof(color.FgYellow, "%v", warning)
 		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
 	}
 
@@ -349,18 +632,15 @@ func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, d
 		breakpointState = breakpointStateDisabled
 	}
 
-	temporaryFlag := ""
-	if temporary {
-		temporaryFlag = "-t " // Note the space after -t
-	}
-
+	// Note that temporary breakpoints are not set with -t in gdb. gdb would delete them on the first hit
+	// even if the hit condition was not satisfied. We remove them ourselves in continueExecution()
 	// @TODO for some reason this break-insert command stops working if we break sendGdbCommand call into operation, argument params
-	result := sendGdbCommand(es.gdbSession,
-		fmt.Sprintf("break-insert %v%v-f -c \"lineno == %v\" --source dontbug_break.c --line %v", temporaryFlag, disabledFlag, phpLineno, internalLineno))
+	result, err := trySendGdbCommand(es.gdbSession,
+		fmt.Sprintf("break-insert %v-f -c \"lineno == %v\" --source dontbug_break.c --line %v", disabledFlag, phpLineno, internalLineno))
 
-	if result["class"] != "done" {
+	if err != nil || result["class"] != "done" {
 		warning := fmt.Sprintf("dontbug: Could not set breakpoint in gdb backend at %v:%v. Something is probably wrong with breakpoint parameters", phpFilename, phpLineno)
-		color.Red(warning)
+		logWarnf(color.FgRed, "%v", warning)
 		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
 	}
 
@@ -368,6 +648,9 @@ func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, d
 	bkpt := payload["bkpt"].(map[string]interface{})
 	id := bkpt["number"].(string)
 
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
 	_, ok = es.breakpoints[id]
 	if ok {
 		log.Fatal("Breakpoint number returned by gdb not unique: ", id)
@@ -385,15 +668,80 @@ func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, d
 	return id, nil
 }
 
+// Sets a gdb breakpoint for a PHP call or return breakpoint
+// dontbug_function_location() in dontbug_break.c has a location for each and
+// the gdb breakpoint condition filters on the hash of the function (and class) name
+// Note that function names are matched case sensitively
+// Also inserts the breakpoint into es.Breakpoints table
+func setPhpFunctionBreakpointInGdb(es *engineState, bpType engineBreakpointType, function, class string, disabled bool, temporary bool) (string, *engineBreakpointError) {
+	internalLineno, ok := es.funcLocMap[bpType]
+	if !ok {
+		warning := fmt.Sprintf("dontbug: dontbug_break.c does not support %v breakpoints. Please do a 'dontbug record' again to regenerate it", bpType)
+		logWarnf(color.FgYellow, "%v", warning)
+		return "", &engineBreakpointError{breakpointErrorCodeTypeNotSupported, warning}
+	}
+
+	breakpointState := breakpointStateEnabled
+	disabledFlag := ""
+	if disabled {
+		disabledFlag = "-d " // Note the space after -d
+		breakpointState = breakpointStateDisabled
+	}
+
+	condition := fmt.Sprintf("function_hash == %v", phpStringHash(function))
+	if class != "" {
+		condition += fmt.Sprintf(" && class_hash == %v", phpStringHash(class))
+	}
+
+	result, err := trySendGdbCommand(es.gdbSession,
+		fmt.Sprintf("break-insert %v-f -c \"%v\" --source dontbug_break.c --line %v", disabledFlag, condition, internalLineno))
+
+	if err != nil || result["class"] != "done" {
+		warning := fmt.Sprintf("dontbug: Could not set %v breakpoint in gdb backend for function %v", bpType, function)
+		logWarnf(color.FgRed, "%v", warning)
+		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+	}
+
+	payload := result["payload"].(map[string]interface{})
+	bkpt := payload["bkpt"].(map[string]interface{})
+	id := bkpt["number"].(string)
+
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
+	_, ok = es.breakpoints[id]
+	if ok {
+		log.Fatal("Breakpoint number returned by gdb not unique: ", id)
+	}
+
+	es.breakpoints[id] = &engineBreakPoint{
+		id:        id,
+		function:  function,
+		class:     class,
+		state:     breakpointState,
+		temporary: temporary,
+		bpType:    bpType,
+	}
+
+	return id, nil
+}
+
 // Does not make an entry in breakpoints table
-func setPhpStackDepthLevelBreakpointInGdb(es *engineState, level int) string {
-	if level > es.maxStackDepth {
-		log.Fatalf("Max stack depth is %v but asked to set breakpoint at depth %v\n", es.maxStackDepth, level+1)
+// Returns an error if dontbug_break.c does not have a location for this stack level
+func setPhpStackDepthLevelBreakpointInGdb(es *engineState, level int) (string, error) {
+	if level < 0 || level >= len(es.levelAr) {
+		Verbosef("dontbug: Asked to set a breakpoint at PHP stack level %v but dontbug_break.c only has locations "+
+			"for levels 0 to %v. The PHP program probably recursed deeper than the --max-stack-depth (%v) used during 'dontbug record'\n",
+			level, len(es.levelAr)-1, len(es.levelAr))
+		return "", fmt.Errorf("PHP stack level %v exceeds the recorded max stack depth of %v. Please record again with a higher --max-stack-depth", level, len(es.levelAr))
 	}
 	line := es.levelAr[level]
 
 	params := fmt.Sprintf("-f --source dontbug_break.c --line %v", line)
-	result := sendGdbCommand(es.gdbSession, "break-insert", params)
+	result, err := trySendGdbCommand(es.gdbSession, "break-insert", params)
+	if err != nil {
+		return "", err
+	}
 
 	if result["class"] != "done" {
 		log.Fatal("breakpoint was not set successfully in gdb backend. Command was:", "break-insert", params)
@@ -403,20 +751,60 @@ func setPhpStackDepthLevelBreakpointInGdb(es *engineState, level int) string {
 	bkpt := payload["bkpt"].(map[string]interface{})
 	id := bkpt["number"].(string)
 
-	return id
+	return id, nil
 }
 
+// All per breakpoint state (hit count, hit condition, temporary etc.) lives in the engineBreakPoint so
+// nothing stale can apply to a breakpoint that is set again later at the same location
 func removeGdbBreakpoint(es *engineState, id string) {
-	sendGdbCommand(es.gdbSession, "break-delete", id)
-	_, ok := es.breakpoints[id]
-	if ok {
-		delete(es.breakpoints, id)
+	result := sendGdbCommand(es.gdbSession, "break-delete", id)
+	if result["class"] != "done" {
+		panicWith(fmt.Sprintf("Could not delete breakpoint %v in gdb backend", id))
 	}
+
+	es.breakpointsMutex.Lock()
+	delete(es.breakpoints, id)
+	es.breakpointsMutex.Unlock()
 }
 
 func gotoMasterBpLocation(es *engineState, reverse bool) (string, bool) {
-	enableGdbBreakpoint(es, dontbugMasterBp)
+	return gotoInternalBpLocation(es, dontbugMasterBp, reverse)
+}
+
+func gotoOpcodeBpLocation(es *engineState, reverse bool) (string, bool) {
+	return gotoInternalBpLocation(es, es.opcodeBp, reverse)
+}
+
+func gotoInternalBpLocation(es *engineState, internalBp string, reverse bool) (string, bool) {
+	enableGdbBreakpoint(es, internalBp)
 	id, ok := continueExecution(es, reverse)
-	disableGdbBreakpoint(es, dontbugMasterBp)
+	disableGdbBreakpoint(es, internalBp)
 	return id, ok
 }
+
+// dontbug_break.c only knows about files and not about the lines in them. So the PHP source is consulted instead
+// to reject lines beyond the end of the file and blank lines (as these can't have a statement)
+// Note that this is the file as it is on disk now and not as it was recorded (unless it is in a snapshot)
+// If the source can't be read (e.g. an imported snapshot whose sources were elsewhere) the line is accepted
+func checkPhpBreakpointLine(phpFilename string, phpLineno int) error {
+	if phpLineno < 1 {
+		return fmt.Errorf("Invalid line number %v", phpLineno)
+	}
+
+	contents, err := ioutil.ReadFile(strings.TrimPrefix(phpFilename, "file://"))
+	if err != nil {
+		return nil
+	}
+
+	// The newline at the end of the last line does not start another line
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if phpLineno > len(lines) {
+		return fmt.Errorf("The file only has %v lines", len(lines))
+	}
+
+	if strings.TrimSpace(lines[phpLineno-1]) == "" {
+		return errors.New("The line is blank")
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBreakpointUpdateDisabledDoesNotStop(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0, 3, 0, 4, 0)...)
+	defer f.close()
+
+	id := mustSetBreakpoint(t, es, "file:///a.php", 3)
+	mustHandle(t, es, "breakpoint_update -i 2 -d "+id+" -s disabled")
+
+	// Still known to the IDE, only disabled
+	response := mustHandle(t, es, "breakpoint_get -i 3 -d "+id)
+	if !strings.Contains(response, `state="disabled"`) {
+		t.Errorf("breakpoint_get after disabling: %v", response)
+	}
+
+	mustHandle(t, es, "run -i 4")
+	if es.programExit == nil {
+		t.Errorf("run stopped at %v although the breakpoint there is disabled", f.location())
+	}
+}
+
+func TestBreakpointUpdateEnableAgainAndMove(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0, 3, 0, 4, 0)...)
+	defer f.close()
+
+	id := mustSetBreakpoint(t, es, "file:///a.php", 2)
+	mustHandle(t, es, "breakpoint_update -i 2 -d "+id+" -s disabled")
+	mustHandle(t, es, "breakpoint_update -i 3 -d "+id+" -s enabled -n 3")
+
+	mustHandle(t, es, "run -i 4")
+	if location := f.location(); location != "file:///a.php:3" {
+		t.Errorf("run stopped at %v instead of the moved breakpoint at file:///a.php:3", location)
+	}
+}
+
+func TestBreakpointUpdateInvalidStatusChangesNothing(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0, 3, 0, 4, 0)...)
+	defer f.close()
+
+	id := mustSetBreakpoint(t, es, "file:///a.php", 2)
+	response := dispatchMappedIdeRequest(es, "breakpoint_update -i 2 -d "+id+" -s bogus -n 3 -h 5", false)
+	if !strings.Contains(response, "<error") {
+		t.Errorf("breakpoint_update with an unknown status should fail. Got: %v", response)
+	}
+
+	response = mustHandle(t, es, "breakpoint_get -i 3 -d "+id)
+	if !strings.Contains(response, `lineno="2"`) || !strings.Contains(response, `hit_value="0"`) {
+		t.Errorf("A failed breakpoint_update changed the breakpoint: %v", response)
+	}
+}
+
+func TestBreakpointGetEscapesFilename(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a&b<c>.php", 1, 0, 2, 0)...)
+	defer f.close()
+
+	id := mustSetBreakpoint(t, es, "file:///a&b<c>.php", 2)
+	response := mustHandle(t, es, "breakpoint_get -i 3 -d "+id)
+	if !strings.Contains(response, `filename="file:///a&amp;b&lt;c&gt;.php"`) {
+		t.Errorf("The filename should be escaped: %v", response)
+	}
+}
+
+// a.php:2 runs three times
+func TestBreakpointRemoveAndSetAgain(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0, 2, 0, 2, 0, 3, 0)...)
+	defer f.close()
+
+	response := mustHandle(t, es, "breakpoint_set -i 1 -t line -f file:///a.php -n 2 -h 3 -o >=")
+	id := gFakeResponseIDRegexp.FindStringSubmatch(response)[1]
+	mustHandle(t, es, "breakpoint_remove -i 2 -d "+id)
+
+	if _, ok := lookupPhpBreakpoint(es, id); ok {
+		t.Errorf("Breakpoint %v is still known after breakpoint_remove", id)
+	}
+	if len(f.commands("break-delete "+id)) != 1 {
+		t.Errorf("Breakpoint %v was not deleted in gdb. Commands: %v", id, f.commands("break-delete"))
+	}
+
+	// The hit condition of the removed breakpoint must not apply to the new one
+	newID := mustSetBreakpoint(t, es, "file:///a.php", 2)
+	if newID == id {
+		t.Fatalf("gdb reused breakpoint number %v", id)
+	}
+
+	mustHandle(t, es, "run -i 4")
+	if es.programExit != nil || f.location() != "file:///a.php:2" {
+		t.Fatalf("run should stop at the new breakpoint. Program exited: %v", es.programExit != nil)
+	}
+
+	response = mustHandle(t, es, "breakpoint_get -i 5 -d "+newID)
+	if !strings.Contains(response, `hit_count="1"`) || !strings.Contains(response, `hit_value="0"`) {
+		t.Errorf("breakpoint_get of the new breakpoint: %v", response)
+	}
+}
+
+func TestCheckPhpBreakpointLine(t *testing.T) {
+	file, err := ioutil.TempFile("", "dontbug-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("<?php\n\necho 1;\n")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lineno int
+		ok     bool
+	}{
+		{0, false},
+		{1, true},
+		{2, false}, // blank
+		{3, true},
+		{4, false}, // after the newline at the end of the file
+	}
+	for _, test := range tests {
+		err := checkPhpBreakpointLine("file://"+file.Name(), test.lineno)
+		if (err == nil) != test.ok {
+			t.Errorf("Line %v: expected ok to be %v. Got error: %v", test.lineno, test.ok, err)
+		}
+	}
+}
+
+func TestBreakpointUpdateChecksTheNewLine(t *testing.T) {
+	file, err := ioutil.TempFile("", "dontbug-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("<?php\n\necho 1;\n")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := "file://" + file.Name()
+	es, f := newFakeReplay(t, fakeProgram(filename, 1, 0, 3, 0)...)
+	defer f.close()
+
+	id := mustSetBreakpoint(t, es, filename, 3)
+	for seq, lineno := range []int{2, 4} {
+		response := dispatchMappedIdeRequest(es, fmt.Sprintf("breakpoint_update -i %v -d %v -n %v", seq+2, id, lineno), false)
+		if !strings.Contains(response, "<error") {
+			t.Errorf("Moving the breakpoint to line %v should fail. Got: %v", lineno, response)
+		}
+	}
+
+	response := mustHandle(t, es, "breakpoint_get -i 4 -d "+id)
+	if !strings.Contains(response, `lineno="3"`) {
+		t.Errorf("A rejected move changed the breakpoint: %v", response)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type cleanCandidate struct {
+	dir    string
+	reason string
+	size   int64
+}
+
+// DoClean finds rr traces and dontbug source snapshots that can be deleted and deletes them
+// after asking the user (unless assumeYes is true)
+//
+// The following are candidates for deletion:
+// - rr traces of snapshots whose PHP sources snapshot is gone
+// - PHP source snapshots that are not referred to by any rr trace
+// - rr traces older than olderThan (if olderThan is non-zero). The latest trace is always kept
+func DoClean(olderThan time.Duration, assumeYes bool) {
+	rrHome := getRRTraceHome()
+	latestTrace, _ := filepath.EvalSymlinks(rrHome + "/latest-trace")
+
+	candidates := make([]cleanCandidate, 0, 20)
+	deletedTraces := make(map[string]bool)
+
+	if olderThan > 0 {
+		matches, err := filepath.Glob(rrHome + "/*")
+		fatalIf(err)
+
+		for _, v := range matches {
+			info, err := os.Lstat(v)
+			if err != nil || !info.IsDir() || v == latestTrace {
+				continue
+			}
+
+			if time.Since(info.ModTime()) > olderThan {
+				candidates = append(candidates, cleanCandidate{v, fmt.Sprintf("rr trace older than %v", olderThan), 0})
+				deletedTraces[v] = true
+			}
+		}
+	}
+
+	referencedSnaps := make(map[string]bool)
+	for _, info := range getSnapInfos() {
+		snapRootDir := path.Clean(info.snapRootDir)
+		_, err := os.Stat(snapRootDir)
+		if os.IsNotExist(err) {
+			if !deletedTraces[info.snapRRTraceDir] && info.snapRRTraceDir != latestTrace {
+				candidates = append(candidates, cleanCandidate{info.snapRRTraceDir, "rr trace of a snapshot whose PHP sources are gone", 0})
+				deletedTraces[info.snapRRTraceDir] = true
+			}
+			continue
+		}
+
+		if !deletedTraces[info.snapRRTraceDir] {
+			referencedSnaps[snapRootDir] = true
+		}
+	}
+
+	snapDirs, err := filepath.Glob(getOrCreateDontbugSharePath() + "*/snap-*")
+	fatalIf(err)
+	for _, v := range snapDirs {
+		if !referencedSnaps[path.Clean(v)] {
+			candidates = append(candidates, cleanCandidate{v, "PHP sources snapshot without an rr trace", 0})
+		}
+	}
+
+	if len(candidates) == 0 {
+		logInfof(color.FgGreen, "dontbug: Nothing to clean")
+		return
+	}
+
+	var total int64
+	for i := range candidates {
+		candidates[i].size = dirSize(candidates[i].dir)
+		total += candidates[i].size
+		fmt.Printf("%10v  %v (%v)\n", humanSize(candidates[i].size), candidates[i].dir, candidates[i].reason)
+	}
+
+	// Source snapshots share unchanged files via hard links so this is an upper bound
+	fmt.Printf("Up to %v can be reclaimed\n", humanSize(total))
+
+	if !assumeYes {
+		fmt.Print("Delete the above? [y/N]> ")
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			color.Yellow("Nothing deleted.")
+			return
+		}
+	}
+
+	for _, c := range candidates {
+		Verboseln("dontbug: rm -rf", c.dir)
+		err := os.RemoveAll(c.dir)
+		if err != nil {
+			logErrorf(color.FgRed, "dontbug: Could not delete %v: %v", c.dir, err)
+		}
+	}
+
+	logInfof(color.FgGreen, "dontbug: Deleted %v item(s)", len(candidates))
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for ; value >= 1024 && i < len(units)-1; i++ {
+		value /= 1024
+	}
+
+	return fmt.Sprintf("%.1f %v", value, units[i])
+}
@@ -0,0 +1,96 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"strings"
+)
+
+var (
+	// The (dontbug) prompt commands. See gHelpText
+	gPromptCommands = []string{"h", "q", "r", "f", "t", "v", "n", "s", "w", "wd", "where", "g", "c", "b", "e", "evalall", "mark", "marks", "goto", "diff", "files", "#", "-"}
+
+	// The dbgp commands that make sense to run directly in the diversion session via "#"
+	gPromptDbgpCommands = []string{
+		"context_get",
+		"context_names",
+		"eval",
+		"property_get",
+		"property_value",
+		"source",
+		"stack_depth",
+		"stack_get",
+		"typemap_get",
+	}
+
+	// @TODO this is just a list of commonly used ones. gdb has many more
+	gPromptGdbMiCommands = []string{
+		"break-info",
+		"break-list",
+		"data-evaluate-expression",
+		"exec-continue",
+		"exec-finish",
+		"exec-next",
+		"exec-step",
+		"gdb-show",
+		"interpreter-exec",
+		"stack-info-frame",
+		"stack-list-arguments",
+		"stack-list-frames",
+		"stack-list-locals",
+		"thread-info",
+		"var-create",
+		"var-evaluate-expression",
+	}
+)
+
+// Implements readline.AutoCompleter for the (dontbug) prompt
+type promptCompleter struct{}
+
+// Returns the suffixes that would complete the word being typed and the length of that word
+func (c promptCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	typed := string(line[:pos])
+
+	// Only the first word after "#" or "-" is completed. Options are left to the user
+	if strings.Contains(typed, " ") {
+		return nil, 0
+	}
+
+	if strings.HasPrefix(typed, "#") {
+		return completeFrom(gPromptDbgpCommands, typed[1:])
+	}
+
+	if strings.HasPrefix(typed, "-") {
+		return completeFrom(gPromptGdbMiCommands, typed[1:])
+	}
+
+	// The other prompt commands are just a letter or two. List them all
+	if typed == "" {
+		return completeFrom(gPromptCommands, "")
+	}
+
+	return nil, 0
+}
+
+func completeFrom(candidates []string, typed string) ([][]rune, int) {
+	var suffixes [][]rune
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, typed) {
+			suffixes = append(suffixes, []rune(candidate[len(typed):]))
+		}
+	}
+
+	return suffixes, len([]rune(typed))
+}
@@ -0,0 +1,45 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"html"
+)
+
+// An error a dbgp command handler returns to the IDE with a specific dbgp error code
+// Any other error returned by a handler is reported with dbgpErrorCodeInternal
+type dbgpError struct {
+	code    int
+	message string
+}
+
+func (e *dbgpError) Error() string {
+	return e.message
+}
+
+func newDbgpError(code int, format string, a ...interface{}) *dbgpError {
+	return &dbgpError{code, fmt.Sprintf(format, a...)}
+}
+
+// The one place where handler errors are turned into dbgp error responses
+func dbgpErrorResponse(dCmd dbgpCmd, err error) string {
+	code := dbgpErrorCodeInternal
+	if dErr, ok := err.(*dbgpError); ok {
+		code = dErr.code
+	}
+
+	return fmt.Sprintf(gErrorXMLResponseFormat, dCmd.command, dCmd.seqNum, code, html.EscapeString(err.Error()))
+}
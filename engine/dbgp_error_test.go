@@ -0,0 +1,61 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+var gErrorResponseRegexp = regexp.MustCompile(`(?s)transaction_id="(\d+)">\s*<error code="(\d+)">\s*<message>(.*)</message>`)
+
+func TestDispatchErrorResponses(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	gDbgpCmdHandlers["dontbug_test_dbgp_error"] = func(es *engineState, dCmd dbgpCmd) (string, error) {
+		return "", newDbgpError(dbgpErrorCodeStackDepthInvalid, "No frame at depth %v", 3)
+	}
+	gDbgpCmdHandlers["dontbug_test_plain_error"] = func(es *engineState, dCmd dbgpCmd) (string, error) {
+		return "", errors.New(`Could not evaluate $a < $b && "c"`)
+	}
+	defer delete(gDbgpCmdHandlers, "dontbug_test_dbgp_error")
+	defer delete(gDbgpCmdHandlers, "dontbug_test_plain_error")
+
+	tests := []struct {
+		command     string
+		transaction string
+		code        string
+		message     string
+	}{
+		{"no_such_command -i 1", "1", "4", "Unimplemented command: no_such_command"},
+		{"dontbug_test_dbgp_error -i 2", "2", "301", "No frame at depth 3"},
+		{"dontbug_test_plain_error -i 3", "3", "998", "Could not evaluate $a &lt; $b &amp;&amp; &#34;c&#34;"},
+	}
+
+	for _, test := range tests {
+		response := dispatchMappedIdeRequest(es, test.command, false)
+		matches := gErrorResponseRegexp.FindStringSubmatch(response)
+		if matches == nil {
+			t.Errorf("%v: not an error response: %v", test.command, response)
+			continue
+		}
+
+		if matches[1] != test.transaction || matches[2] != test.code || matches[3] != test.message {
+			t.Errorf("%v: expected transaction %v, code %v and message %q. Got: %v", test.command, test.transaction, test.code, test.message, response)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+// Dumps the goroutine stacks and a summary of the engine state whenever dontbug receives SIGUSR1 e.g. to see
+// what a replay that seems hung is waiting on. SIGQUIT is left alone i.e. Go dumps the goroutines and exits
+// Only signal.Notify is used so the terminal handling of readline at the (dontbug) prompt is not affected
+func dumpStateOnSignal(es *engineState) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	logInfof(color.FgYellow, "dontbug: If dontbug seems hung, see what it is doing with: kill -USR1 %v", os.Getpid())
+
+	go func() {
+		for range c {
+			dumpState(es)
+		}
+	}()
+}
+
+// Deliberately takes no locks: the hang being diagnosed could be somebody holding one. So the values may be
+// slightly stale
+func dumpState(es *engineState) {
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	fmt.Fprintf(os.Stderr, "\ndontbug: ---- goroutines ----\n%s\n", buf[:n])
+
+	fmt.Fprintln(os.Stderr, "dontbug: ---- engine state ----")
+	fmt.Fprintf(os.Stderr, "status:               %v\n", es.status)
+	fmt.Fprintf(os.Stderr, "reason:               %v\n", es.reason)
+	fmt.Fprintf(os.Stderr, "engine held:          %v\n", es.engineReleased != nil)
+	fmt.Fprintf(os.Stderr, "at end of execution:  %v\n", es.programExit != nil)
+	fmt.Fprintf(os.Stderr, "IDE connected:        %v\n", es.ideConnection != nil)
+	fmt.Fprintf(os.Stderr, "last sequence number: %v\n", es.lastSequenceNum)
+	fmt.Fprintf(os.Stderr, "rr exited:            %v\n", rrHasExited(es))
+	fmt.Fprintf(os.Stderr, "breakStopNotify:      %v/%v queued\n", len(es.breakStopNotify), cap(es.breakStopNotify))
+	fmt.Fprintf(os.Stderr, "exitNotify:           %v/%v queued\n", len(es.exitNotify), cap(es.exitNotify))
+	fmt.Fprintf(os.Stderr, "otherStopNotify:      %v/%v queued\n", len(es.otherStopNotify), cap(es.otherStopNotify))
+	fmt.Fprintf(os.Stderr, "endSession:           %v/%v queued\n", len(es.endSession), cap(es.endSession))
+	fmt.Print("(dontbug) ")
+}
@@ -0,0 +1,130 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+)
+
+// One side of the diff prompt command
+type diffSide struct {
+	location string
+	value    string
+	err      error
+}
+
+func (d diffSide) String() string {
+	if d.err != nil {
+		return fmt.Sprintf("error: %v", d.err)
+	}
+
+	return d.value
+}
+
+// Evaluates expression at the current stop, steps once in the direction given, evaluates it again and then
+// goes back to where we started (through an rr checkpoint). Either evaluation may fail without the other failing
+func diffAcrossStep(es *engineState, expression string, reverse bool) (err error) {
+	if expression == "" {
+		return errors.New("Please provide a PHP expression e.g. diff $this->count")
+	}
+
+	if status, _ := getStatus(es); status != statusBreak {
+		return fmt.Errorf("Can only diff at a break. The status is: %v", status)
+	}
+
+	if es.programExit != nil {
+		return errors.New("Can't diff at the end of the execution")
+	}
+
+	if isEvalSafeEnabled(es) {
+		err := checkEvalSafe(expression)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !startContinuation(es) {
+		return errors.New("Last continuation not yet complete")
+	}
+	defer endContinuation(es, &err)
+
+	before := evalForDiff(es, expression)
+
+	checkpoint, err := createCheckpoint(es)
+	if err != nil {
+		return err
+	}
+	defer gdbConsoleCommand(es, fmt.Sprintf("delete checkpoint %v", checkpoint))
+
+	// PHP breakpoints on the next statement would stop us at its break location, short of the master location
+	bpList := getEnabledPhpBreakpoints(es)
+	disableGdbBreakpoints(es, bpList)
+	defer enableGdbBreakpoints(es, bpList)
+	stepOnce(es, reverse)
+
+	var after diffSide
+	if es.programExit != nil {
+		after = diffSide{location: "(end)", err: errors.New("reached the end of the execution")}
+	} else {
+		after = evalForDiff(es, expression)
+	}
+
+	err = restartCheckpoint(es, checkpoint)
+	if err != nil {
+		return fmt.Errorf("Could not go back to where the diff started: %v", err)
+	}
+
+	afterLabel := "after step"
+	if reverse {
+		afterLabel = "after reverse step"
+	}
+
+	width := len(before.location)
+	if len(after.location) > width {
+		width = len(after.location)
+	}
+
+	fmt.Printf("%-18v %-*v %v\n", "before", width, before.location, before)
+	fmt.Printf("%-18v %-*v %v\n", afterLabel, width, after.location, after)
+	if before.err == nil && after.err == nil && before.value == after.value {
+		color.Yellow("(unchanged)")
+	}
+
+	return nil
+}
+
+// Breakpoints are disabled as the expression may call PHP code that has breakpoints in it
+func evalForDiff(es *engineState, expression string) diffSide {
+	side := diffSide{
+		location: fmt.Sprintf("%v:%v", xSlashSgdb(es.gdbSession, "filename"), xSlashDgdb(es.gdbSession, "lineno")),
+	}
+
+	bpList := getEnabledPhpBreakpoints(es)
+	disableAllGdbBreakpoints(es)
+	defer enableGdbBreakpoints(es, bpList)
+
+	command := fmt.Sprintf("eval -i %v -- %v", internalTransactionID, base64.StdEncoding.EncodeToString([]byte(expression)))
+	result, err := diversionSessionCmdInFrame(es, 0, command)
+	if err != nil {
+		side.err = err
+		return side
+	}
+
+	side.value, side.err = summarizeEvalResult(result)
+	return side
+}
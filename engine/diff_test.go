@@ -0,0 +1,59 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+)
+
+// The breakpoint at a.php:2 must not stop the step at the break location of a.php:2, short of its master location
+func TestDiffStepIgnoresPhpBreakpoints(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0)...)
+	defer f.close()
+	id := mustSetBreakpoint(t, es, "file:///a.php", 2)
+
+	// The fake gdb is locked while these are called so f.pos can be used as it is
+	var evaluatedAt []int
+	f.evaluate = func(expression string) (string, bool) {
+		evaluatedAt = append(evaluatedAt, f.pos)
+		return fakeGdbString(`<response command="eval"><property type="int"><![CDATA[1]]></property></response>`), true
+	}
+	checkpointPos := 0
+	f.console = func(command string) (string, bool) {
+		switch command {
+		case "checkpoint":
+			checkpointPos = f.pos
+			return "Checkpoint 1 at 0x0\n", true
+		case "restart 1":
+			f.pos = checkpointPos
+			es.otherStopNotify <- struct{}{}
+		}
+		return "", true
+	}
+
+	err := diffAcrossStep(es, "$x", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{fakeLocMaster, fakeLocsPerStatement + fakeLocMaster}
+	if len(evaluatedAt) != 2 || evaluatedAt[0] != expected[0] || evaluatedAt[1] != expected[1] {
+		t.Errorf("Expected the evaluations at locations %v. Got: %v", expected, evaluatedAt)
+	}
+
+	if bp, ok := lookupPhpBreakpoint(es, id); !ok || bp.state != breakpointStateEnabled {
+		t.Errorf("The breakpoint should be enabled again after the diff. Got: %v", bp)
+	}
+}
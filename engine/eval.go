@@ -0,0 +1,316 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An eval result is returned like a property_get of a synthetic variable e.g. $__dontbug_eval_3 so that
+// max_depth/max_children/max_data apply and the IDE can fetch deeper levels and further pages of a large
+// result with property_get -n $__dontbug_eval_3['some']['key'] as usual.
+//
+// Nothing survives a diversion session so the synthetic variable is not really kept anywhere. Instead we
+// remember the expression and assign it to the variable again just before every property_get of it. Values are
+// therefore always those at the current replay point. The expressions are forgotten on every continuation
+const evalResultVarPrefix = "$__dontbug_eval_"
+
+var gEvalResultVarRegexp = regexp.MustCompile(`^\$__dontbug_eval_\d+`)
+
+func handleEval(es *engineState, dCmd dbgpCmd) (string, error) {
+	if !strings.Contains(dCmd.fullCommand, " -- ") {
+		return handleInDiversionSessionWithNoGdbBpts(es, dCmd)
+	}
+
+	expression, err := evalCommandExpression(dCmd)
+	if err != nil {
+		// xdebug may still make something of it but it could not be checked
+		if isEvalSafeEnabled(es) {
+			return "", newDbgpError(dbgpErrorCodeInvalidOptions, "%v. Use feature_set -n dontbug_eval_safe -v 0 to "+
+				"have xdebug evaluate it anyway", err)
+		}
+		return handleInDiversionSessionWithNoGdbBpts(es, dCmd)
+	}
+
+	if isEvalSafeEnabled(es) {
+		err = checkEvalSafe(expression)
+		if err != nil {
+			return "", newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+		}
+	}
+
+	es.evalResultCount++
+	name := fmt.Sprintf("%v%v", evalResultVarPrefix, es.evalResultCount)
+	command := fmt.Sprintf("property_get -i %v -n %v", dCmd.seqNum, name)
+	if page, ok := dCmd.options["p"]; ok {
+		command += " -p " + page
+	}
+
+	result, err := evalResultCmd(es, dCmd, name, expression, command)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+	}
+
+	// e.g. a syntax error in the expression. Let xdebug report it as it usually does for eval
+	if strings.Contains(result, "<error") {
+		return handleInDiversionSessionWithNoGdbBpts(es, dCmd)
+	}
+
+	if es.evalResults == nil {
+		es.evalResults = make(map[string]string)
+	}
+	es.evalResults[name] = expression
+
+	return strings.Replace(result, `command="property_get"`, `command="eval"`, 1), nil
+}
+
+// For property_get -n $__dontbug_eval_N... Returns false if the name is not that of a remembered eval result
+// Note that the eval result is always in the innermost frame (i.e. -d 0) as that is where the eval was done
+//
+// Every call evaluates the whole expression again (see evalResultVarPrefix), even for the next page or a nested
+// key of the same result. So an expensive expression is paid for on each fetch and any side effects it has
+// (e.g. $i++) happen again in the diversion session, though never in the replay.
+// A non deterministic expression (e.g. rand() or microtime()) may give a different value on each fetch
+func handleEvalResultPropertyGet(es *engineState, dCmd dbgpCmd) (string, bool, error) {
+	name := gEvalResultVarRegexp.FindString(dCmd.options["n"])
+	expression, ok := es.evalResults[name]
+	if name == "" || !ok {
+		return "", false, nil
+	}
+
+	result, err := evalResultCmd(es, dCmd, name, expression, dCmd.fullCommand)
+	if err != nil {
+		return "", true, newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+	}
+
+	return result, true, nil
+}
+
+// property_value returns the whole value of a property (e.g. for copying it in the IDE) so max_data does not apply
+// If the IDE gives -m (and optionally -p) the value is returned in pages of m bytes instead. Page p (from 0) is returned
+// and the size attribute is still that of the whole value so that the IDE knows how many pages there are
+func handlePropertyValue(es *engineState, dCmd dbgpCmd) (string, error) {
+	err := checkStackDepthOption(es, dCmd)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeStackDepthInvalid, "%v", err)
+	}
+
+	pageSize, _ := strconv.Atoi(dCmd.options["m"])
+	page, _ := strconv.Atoi(dCmd.options["p"])
+
+	// xdebug pages children and not the data. So ask it for everything and do the paging here
+	fullCommand := dCmd
+	fullCommand.fullCommand = gPagingOptionsRegexp.ReplaceAllString(dCmd.fullCommand, "") + " -m 0"
+
+	result, ok, err := handleEvalResultPropertyGet(es, fullCommand)
+	if !ok {
+		result, err = handleInDiversionSessionInFrame(es, fullCommand)
+	}
+
+	if err != nil || pageSize <= 0 || strings.Contains(result, "<error") {
+		return result, err
+	}
+
+	return pagePropertyValue(result, pageSize, page), nil
+}
+
+var (
+	gPagingOptionsRegexp = regexp.MustCompile(`\s-[mp]\s+\S+`)
+	gCdataRegexp         = regexp.MustCompile(`(?s)<!\[CDATA\[(.*)\]\]>`)
+)
+
+func pagePropertyValue(result string, pageSize, page int) string {
+	matches := gCdataRegexp.FindStringSubmatchIndex(result)
+	if matches == nil {
+		return result
+	}
+
+	value := result[matches[2]:matches[3]]
+	isBase64 := strings.Contains(result[:matches[0]], `encoding="base64"`)
+	if isBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return result
+		}
+		value = string(decoded)
+	}
+
+	start := page * pageSize
+	if start > len(value) {
+		start = len(value)
+	}
+	end := start + pageSize
+	if end > len(value) {
+		end = len(value)
+	}
+
+	value = value[start:end]
+	if isBase64 {
+		value = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	return result[:matches[2]] + value + result[matches[3]:]
+}
+
+func handlePropertyGet(es *engineState, dCmd dbgpCmd) (string, error) {
+	result, ok, err := handleEvalResultPropertyGet(es, dCmd)
+	if ok {
+		return result, err
+	}
+
+	return handleInDiversionSessionAtStackDepth(es, dCmd)
+}
+
+// Runs command in a diversion session right after assigning expression to the synthetic variable name
+func evalResultCmd(es *engineState, dCmd dbgpCmd, name, expression, command string) (string, error) {
+	assignment := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%v = (%v)", name, expression)))
+	setupCommand := fmt.Sprintf("eval -i %v -- %v", dCmd.seqNum, assignment)
+
+	bpList := getEnabledPhpBreakpoints(es)
+	disableAllGdbBreakpoints(es)
+	defer enableGdbBreakpoints(es, bpList)
+
+	return diversionSessionCmdWithSetup(es, setupCommand, command)
+}
+
+// The expressions were evaluated at the previous replay point
+func forgetEvalResults(es *engineState) {
+	es.evalResults = nil
+}
+
+// For the evalall prompt command. Evaluates expression in every PHP frame from the innermost outwards
+// Frames in which the expression can't be evaluated (e.g. an undefined variable) are skipped
+func evalInAllFrames(es *engineState, expression string) (err error) {
+	defer recoverGdbTimeout(&err)
+	if expression == "" {
+		return errors.New("Please provide a PHP expression e.g. evalall $this->count")
+	}
+
+	if status, _ := getStatus(es); status != statusBreak {
+		return fmt.Errorf("Can only evaluate at a break. The status is: %v", status)
+	}
+
+	if isEvalSafeEnabled(es) {
+		err := checkEvalSafe(expression)
+		if err != nil {
+			return err
+		}
+	}
+
+	bpList := getEnabledPhpBreakpoints(es)
+	disableAllGdbBreakpoints(es)
+	defer enableGdbBreakpoints(es, bpList)
+
+	command := fmt.Sprintf("eval -i %v -- %v", internalTransactionID, base64.StdEncoding.EncodeToString([]byte(expression)))
+	// Only the frames that exist right now rather than the (possibly raised, see --max-stack-depth) max stack depth
+	frames, err := currentStackFrames(es)
+	if err != nil {
+		return err
+	}
+
+	if frames > es.maxStackDepth {
+		frames = es.maxStackDepth
+	}
+
+	skipped := 0
+	for depth := 0; depth < frames; depth++ {
+		result, err := diversionSessionCmdInFrame(es, depth, command)
+		if err != nil {
+			return fmt.Errorf("Stopped at frame %v: %v", depth, err)
+		}
+
+		// No more frames
+		if result == "" {
+			break
+		}
+
+		summary, err := summarizeEvalResult(result)
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		fmt.Printf("#%-3v %v\n", depth, summary)
+	}
+
+	if skipped > 0 {
+		fmt.Printf("(skipped %v frame(s) in which the expression could not be evaluated)\n", skipped)
+	}
+
+	return nil
+}
+
+type evalResultProperty struct {
+	Type        string `xml:"type,attr"`
+	ClassName   string `xml:"classname,attr"`
+	Encoding    string `xml:"encoding,attr"`
+	NumChildren int    `xml:"numchildren,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type evalResultResponse struct {
+	Property *evalResultProperty `xml:"property"`
+	Error    *struct {
+		Message string `xml:"message"`
+	} `xml:"error"`
+}
+
+// A one line description of the value in an eval response e.g. string "abc" or array(3)
+func summarizeEvalResult(result string) (string, error) {
+	var response evalResultResponse
+	err := xml.Unmarshal([]byte(result), &response)
+	if err != nil {
+		return "", err
+	}
+
+	if response.Error != nil {
+		return "", errors.New(response.Error.Message)
+	}
+
+	property := response.Property
+	if property == nil {
+		return "", fmt.Errorf("Unexpected eval response: %v", result)
+	}
+
+	switch property.Type {
+	case "array":
+		return fmt.Sprintf("array(%v)", property.NumChildren), nil
+	case "object":
+		return fmt.Sprintf("object(%v)", property.ClassName), nil
+	case "null", "uninitialized":
+		return property.Type, nil
+	}
+
+	value := strings.TrimSpace(property.Value)
+	if property.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", err
+		}
+		value = string(decoded)
+	}
+
+	if property.Type == "string" {
+		return fmt.Sprintf("string %q", value), nil
+	}
+
+	return fmt.Sprintf("%v %v", property.Type, value), nil
+}
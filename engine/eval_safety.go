@@ -0,0 +1,83 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Side effects of an eval don't survive the diversion session but some constructs end the diversion session
+// itself (exit, die) or run arbitrary code (eval, include, require). With the dontbug_eval_safe feature on (the
+// default) expressions containing them are refused. This is a lightweight check of the expression text and
+// not a PHP parser: string literals and comments are ignored and so are variables, properties and class
+// constants of the same name e.g. $exit, $obj->die, $obj?->die or Foo::exit. Anything else before them
+// (e.g. the : of a ternary or the => of an arrow function) does not make them safe
+var (
+	gEvalStringsAndCommentsRegexp = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"|/\*(?s:.*?)\*/|(?://|#)[^\n]*`)
+	gEvalUnsafeConstructRegexp    = regexp.MustCompile(`(?i)(\$|->|::)?\s*\b(exit|die|eval|include|include_once|require|require_once)\b`)
+)
+
+func isEvalSafeEnabled(es *engineState) bool {
+	return es.featureMap["dontbug_eval_safe"].String() == "1"
+}
+
+func checkEvalSafe(expression string) error {
+	stripped := gEvalStringsAndCommentsRegexp.ReplaceAllString(expression, "''")
+	for _, matches := range gEvalUnsafeConstructRegexp.FindAllStringSubmatch(stripped, -1) {
+		// A variable, property or class constant
+		if matches[1] != "" {
+			continue
+		}
+
+		return fmt.Errorf("Refusing to evaluate an expression with %v as it could end or change the replay's diversion session. "+
+			"Use feature_set -n dontbug_eval_safe -v 0 to allow it", strings.ToLower(matches[2]))
+	}
+
+	return nil
+}
+
+// The PHP expression of an eval command i.e. its base64 encoded data after --
+func evalCommandExpression(dCmd dbgpCmd) (string, error) {
+	dataIndex := strings.Index(dCmd.fullCommand, " -- ")
+	if dataIndex == -1 {
+		return "", errors.New("The eval command has no expression")
+	}
+
+	expression, err := base64.StdEncoding.DecodeString(strings.TrimSpace(dCmd.fullCommand[dataIndex+len(" -- "):]))
+	if err != nil {
+		return "", fmt.Errorf("The expression of the eval command is not valid base64: %v", err)
+	}
+
+	return string(expression), nil
+}
+
+// For a dbgp command that is passed on to xdebug as it is e.g. # eval -i 1 -- ZXhpdCgp at the (dontbug) prompt
+func checkEvalCommandSafe(es *engineState, command string) error {
+	dCmd := parseCommand(command, false)
+	if dCmd.command != "eval" || !isEvalSafeEnabled(es) {
+		return nil
+	}
+
+	expression, err := evalCommandExpression(dCmd)
+	if err != nil {
+		return err
+	}
+
+	return checkEvalSafe(expression)
+}
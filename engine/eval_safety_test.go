@@ -0,0 +1,93 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCheckEvalSafe(t *testing.T) {
+	tests := []struct {
+		expression string
+		safe       bool
+	}{
+		{"$this->count + 1", true},
+		{"$exit", true},
+		{"$obj->die", true},
+		{"$obj -> die", true},
+		{"$obj?->exit", true},
+		{"Foo::exit", true},
+		{"'exit' . \"die\"", true},
+		{"$a /* exit() */ + 1 // die()", true},
+		{"$required", true},
+		{"exit()", false},
+		{"DIE('x')", false},
+		{"eval('1')", false},
+		{"include 'a.php'", false},
+		{"require_once('a.php')", false},
+		{"true?1:exit()", false},
+		{"$a?:die()", false},
+		{"(fn()=>exit())()", false},
+		{"$a && exit", false},
+		{"[$a, die()]", false},
+	}
+
+	for _, test := range tests {
+		err := checkEvalSafe(test.expression)
+		if (err == nil) != test.safe {
+			t.Errorf("%v: expected safe to be %v. Got error: %v", test.expression, test.safe, err)
+		}
+	}
+}
+
+func TestEvalSafeCoversEveryEval(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	encode := func(expression string) string {
+		return base64.StdEncoding.EncodeToString([]byte(expression))
+	}
+
+	if err := checkEvalCommandSafe(es, "eval -i 1 -- "+encode("$x + 1")); err != nil {
+		t.Errorf("A safe eval was refused: %v", err)
+	}
+	if err := checkEvalCommandSafe(es, "eval -i 2 -- "+encode("exit()")); err == nil {
+		t.Error("# eval of exit() should be refused")
+	}
+	if err := checkEvalCommandSafe(es, "eval -i 3 -- not*base64"); err == nil {
+		t.Error("An eval that can't be decoded (and so checked) should be refused")
+	}
+	if err := checkEvalCommandSafe(es, "property_get -i 4 -n $exit"); err != nil {
+		t.Errorf("Only evals are checked. Got: %v", err)
+	}
+
+	dCmd := parseCommand("eval -i 5 -- not*base64", false)
+	if _, err := handleEval(es, dCmd); err == nil {
+		t.Error("An eval from the IDE that can't be decoded should be refused")
+	}
+	dCmd = parseCommand("feature_set -i 5 -n dontbug_watch -v die()", false)
+	if _, err := handleFeatureSet(es, dCmd); err == nil || len(getWatches(es)) != 0 {
+		t.Errorf("A watch of die() should be refused. Watches: %v", getWatches(es))
+	}
+	if _, err := continueUntilCondition(es, "$i > 3 || exit()", false); err == nil {
+		t.Error("c with exit() should be refused")
+	}
+
+	mustHandle(t, es, "feature_set -i 5 -n dontbug_eval_safe -v 0")
+	if err := checkEvalCommandSafe(es, "eval -i 6 -- "+encode("exit()")); err != nil {
+		t.Errorf("Nothing should be refused with dontbug_eval_safe off. Got: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// b.php:10 is in a method called from a.php. The eval (the setup command assigning to the synthetic variable) and the
+// property_get of the result must both be done in that method's frame so that $this is the method's object
+func TestEvalThisInMethodFrame(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgramWithCall()...)
+	defer f.close()
+	fakeGoto(t, es, f, "file:///b.php:10")
+
+	var evaluated []string
+	f.evaluate = func(expression string) (string, bool) {
+		evaluated = append(evaluated, expression)
+		return fakeGdbString(`<response command="property_get"><property name="$__dontbug_eval_1" type="int"><![CDATA[42]]></property></response>`), true
+	}
+
+	expression := base64.StdEncoding.EncodeToString([]byte("$this->someField"))
+	response := mustHandle(t, es, "eval -i 5 -- "+expression)
+	if !strings.Contains(response, `command="eval"`) || !strings.Contains(response, "42") {
+		t.Errorf("Unexpected eval response: %v", response)
+	}
+
+	assignment := base64.StdEncoding.EncodeToString([]byte("$__dontbug_eval_1 = ($this->someField)"))
+	expected := fmt.Sprintf(`dontbug_xdebug_cmd_with_options("eval -i 5 -- %v", "property_get -i 5 -n $__dontbug_eval_1", `, assignment)
+	if len(evaluated) != 1 || !strings.HasPrefix(evaluated[0], expected) {
+		t.Fatalf("The eval should be run in the innermost frame with %v...). Evaluated: %v", expected, evaluated)
+	}
+
+	evaluated = nil
+	mustHandle(t, es, "property_get -i 6 -n $__dontbug_eval_1")
+	expected = fmt.Sprintf(`dontbug_xdebug_cmd_with_options("eval -i 6 -- %v", "property_get -i 6 -n $__dontbug_eval_1", `, assignment)
+	if len(evaluated) != 1 || !strings.HasPrefix(evaluated[0], expected) {
+		t.Errorf("Fetching the eval result should evaluate $this->someField again in the innermost frame. Evaluated: %v", evaluated)
+	}
+}
+
+// max_depth 2 only returns $config['db'] but not what is in it. The IDE fetches the deeper levels (and the next page of
+// children) with property_get of the synthetic variable
+func TestEvalNestedArrayDeeperLevels(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	mustHandle(t, es, "feature_set -i 1 -n max_depth -v 2")
+	mustHandle(t, es, "feature_set -i 2 -n max_children -v 10")
+
+	var evaluated []string
+	f.evaluate = func(expression string) (string, bool) {
+		evaluated = append(evaluated, expression)
+		if strings.Contains(expression, `-n $__dontbug_eval_1['db']['primary']`) {
+			return fakeGdbString(`<response command="property_get"><property name="$__dontbug_eval_1['db']['primary']" ` +
+				`type="array" children="1" numchildren="12" page="1" pagesize="10">` +
+				`<property name="port" type="int"><![CDATA[3306]]></property></property></response>`), true
+		}
+
+		return fakeGdbString(`<response command="property_get"><property name="$__dontbug_eval_1" type="array" ` +
+			`children="1" numchildren="1"><property name="db" type="array" children="1" numchildren="2">` +
+			`<property name="primary" type="array" children="1" numchildren="12"></property>` +
+			`<property name="replica" type="array" children="1" numchildren="12"></property>` +
+			`</property></property></response>`), true
+	}
+
+	// i.e. show_hidden, max_children, max_data, max_depth and extended_properties
+	const options = `, 0, 10, 2048, 2, 0)`
+
+	expression := base64.StdEncoding.EncodeToString([]byte("$config"))
+	response := mustHandle(t, es, "eval -i 3 -- "+expression)
+	if !strings.Contains(response, `command="eval"`) || !strings.Contains(response, `name="primary"`) {
+		t.Errorf("Unexpected eval response: %v", response)
+	}
+	if len(evaluated) != 1 || !strings.HasSuffix(evaluated[0], options) {
+		t.Fatalf("max_children and max_depth should be passed on to the eval. Evaluated: %v", evaluated)
+	}
+
+	evaluated = nil
+	response = mustHandle(t, es, "property_get -i 4 -n $__dontbug_eval_1['db']['primary'] -p 1")
+	if !strings.Contains(response, `name="port"`) || !strings.Contains(response, "3306") {
+		t.Errorf("The deeper level should be returned. Got: %v", response)
+	}
+
+	assignment := base64.StdEncoding.EncodeToString([]byte("$__dontbug_eval_1 = ($config)"))
+	expected := fmt.Sprintf(`dontbug_xdebug_cmd_with_options("eval -i 4 -- %v", "property_get -i 4 -n $__dontbug_eval_1['db']['primary'] -p 1"`, assignment)
+	if len(evaluated) != 1 || !strings.HasPrefix(evaluated[0], expected) || !strings.HasSuffix(evaluated[0], options) {
+		t.Errorf("Expected %v...%v to fetch the deeper level. Evaluated: %v", expected, options, evaluated)
+	}
+}
+
+func TestPagePropertyValue(t *testing.T) {
+	// 1 MB so that a page is a small part of it
+	large := strings.Repeat("0123456789abcdef", 1<<16)
+	plain := `<response command="property_value" size="1048576"><![CDATA[` + large + `]]></response>`
+	encoded := `<response command="property_value" size="1048576" encoding="base64"><![CDATA[` +
+		base64.StdEncoding.EncodeToString([]byte(large)) + `]]></response>`
+
+	// 1048576 is not a multiple of the page size so the last page is only partly full
+	const pageSize = 1000
+	lastPage := len(large) / pageSize
+	tests := []struct {
+		name     string
+		page     int
+		expected string
+	}{
+		{"first page", 0, large[:pageSize]},
+		{"middle page", 7, large[7*pageSize : 8*pageSize]},
+		{"last partial page", lastPage, large[lastPage*pageSize:]},
+		{"page past the end", lastPage + 1, ""},
+	}
+
+	for _, test := range tests {
+		result := pagePropertyValue(plain, pageSize, test.page)
+		expected := `<response command="property_value" size="1048576"><![CDATA[` + test.expected + `]]></response>`
+		if result != expected {
+			t.Errorf("%v (plain): got %.200v...", test.name, result)
+		}
+
+		result = pagePropertyValue(encoded, pageSize, test.page)
+		expected = `<response command="property_value" size="1048576" encoding="base64"><![CDATA[` +
+			base64.StdEncoding.EncodeToString([]byte(test.expected)) + `]]></response>`
+		if result != expected {
+			t.Errorf("%v (base64): got %.200v...", test.name, result)
+		}
+	}
+}
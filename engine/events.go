@@ -0,0 +1,151 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"github.com/fatih/color"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONEventsFile receives a line of JSON for every status change, breakpoint hit and stop during a replay
+// e.g. for a timeline UI. "" means no events. Use /dev/fd/N for an already open file descriptor
+var JSONEventsFile string
+
+const (
+	eventStatus     = "status"     // The engine status changed e.g. to running
+	eventBreakpoint = "breakpoint" // A PHP breakpoint was hit (with its hit condition satisfied)
+	eventStop       = "stop"       // A run/step (or prompt command like g) ended. Either at a break or at the end
+)
+
+type engineEvent struct {
+	Time       string `json:"time"`
+	Event      string `json:"event"`
+	Status     string `json:"status,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Filename   string `json:"filename,omitempty"`
+	Lineno     int    `json:"lineno,omitempty"`
+	Direction  string `json:"direction,omitempty"` // "forward" or "reverse"
+	Breakpoint string `json:"breakpoint,omitempty"`
+}
+
+var gEventStream = struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}{}
+
+func openEventStream(filename string) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Could not open the --json-events file: %v", err)
+	}
+
+	gEventStream.Lock()
+	defer gEventStream.Unlock()
+	gEventStream.file = file
+	gEventStream.encoder = json.NewEncoder(file)
+}
+
+func closeEventStream() {
+	gEventStream.Lock()
+	defer gEventStream.Unlock()
+	if gEventStream.file != nil {
+		gEventStream.file.Close()
+		gEventStream.file = nil
+		gEventStream.encoder = nil
+	}
+}
+
+func eventsEnabled() bool {
+	gEventStream.Lock()
+	defer gEventStream.Unlock()
+	return gEventStream.encoder != nil
+}
+
+// json.Encoder writes a newline after every event
+func emitEvent(event engineEvent) {
+	gEventStream.Lock()
+	defer gEventStream.Unlock()
+	if gEventStream.encoder == nil {
+		return
+	}
+
+	event.Time = time.Now().Format(time.RFC3339Nano)
+	err := gEventStream.encoder.Encode(event)
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not write to the --json-events file. No more events will be written: %v", err)
+		gEventStream.encoder = nil
+	}
+}
+
+func directionName(reverse bool) string {
+	if reverse {
+		return "reverse"
+	}
+
+	return "forward"
+}
+
+func lastMoveDirection(es *engineState) string {
+	es.moveMutex.Lock()
+	defer es.moveMutex.Unlock()
+	return directionName(es.lastMoveReverse)
+}
+
+func emitStatusEvent(status engineStatus, reason engineReason) {
+	emitEvent(engineEvent{Event: eventStatus, Status: string(status), Reason: string(reason)})
+}
+
+func emitBreakpointEvent(es *engineState, bp *engineBreakPoint) {
+	es.breakpointsMutex.Lock()
+	event := engineEvent{
+		Event:      eventBreakpoint,
+		Filename:   bp.filename,
+		Lineno:     bp.lineno,
+		Breakpoint: bp.id,
+	}
+	es.breakpointsMutex.Unlock()
+
+	event.Direction = lastMoveDirection(es)
+	emitEvent(event)
+}
+
+// The current location is only known at the stepping location in dontbug.c. If we're not there, there is no location
+func emitStopEvent(es *engineState) {
+	if !eventsEnabled() {
+		return
+	}
+
+	event := engineEvent{Event: eventStop, Direction: lastMoveDirection(es)}
+	if es.programExit != nil {
+		event.Reason = string(es.programExit.reason())
+		emitEvent(event)
+		return
+	}
+
+	func() {
+		defer func() {
+			recover()
+		}()
+		event.Filename = xSlashSgdb(es.gdbSession, "filename")
+		event.Lineno = xSlashDgdb(es.gdbSession, "lineno")
+	}()
+	event.Reason = string(reasonOk)
+	emitEvent(event)
+}
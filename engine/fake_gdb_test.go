@@ -0,0 +1,427 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/cyrus-and/gdb"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A PHP statement of the fake recording
+type fakeStatement struct {
+	filename string // A file:// URI
+	lineno   int
+	level    int // The PHP stack level i.e. 0 in the main script, 1 in a function called from it etc.
+}
+
+// What dontbug.c does for every PHP statement, in order. See handleStepOverOrOut()
+const (
+	fakeLocLevel = iota
+	fakeLocBreak
+	fakeLocMaster
+	fakeLocsPerStatement
+)
+
+const (
+	fakeMasterBp = "1"
+	fakeOpcodeBp = "2"
+
+	fakeBreakLinesStartAt = 100 // The dontbug_break.c line of the first file's break location
+	fakeLevelLinesStartAt = 10  // The dontbug_break.c line of the level 0 location
+)
+
+type fakeBreakpoint struct {
+	id        string
+	internal  bool   // The master or opcode breakpoint i.e. every statement
+	filename  string // A file's break location if not ""
+	level     int    // A level location if filename is "" and not internal. See matches()
+	condition int    // The PHP line the condition lineno == N is for. 0 means no condition
+	enabled   bool
+	temporary bool
+	ignore    int
+	hits      int
+}
+
+// A stand-in for gdb (and rr replaying a recording of program) so that handlers can be tested without a recording
+// It runs in both directions between the locations dontbug.c has for every statement and stops at enabled breakpoints
+// like gdb would. The replay starts at the master location of the first statement
+type fakeGdb struct {
+	sync.Mutex
+	t            *testing.T
+	es           *engineState
+	program      []fakeStatement
+	pos          int // index into the locations i.e. statement*fakeLocsPerStatement + location
+	exited       bool
+	breakpoints  map[string]*fakeBreakpoint
+	nextBp       int
+	sent         []string // Every command sent, for tests that check what was sent to gdb
+	originalSend func(*gdb.Gdb, string, ...string) (map[string]interface{}, error)
+
+	// Evaluates the expressions that aren't filename, lineno or level e.g. calls into dontbug.c for
+	// the diversion session. Returns the gdb/mi value and false for a gdb error
+	evaluate func(expression string) (string, bool)
+
+	// Answers console commands (interpreter-exec console) with their console output
+	console func(command string) (string, bool)
+
+	// Called with every exec-continue before it runs e.g. to check what a continuation is allowed to overlap with
+	onContinue func()
+}
+
+var (
+	gFakeBreakInsertConditionRegexp = regexp.MustCompile(`-c "lineno == (\d+)"`)
+	gFakeBreakInsertLineRegexp      = regexp.MustCompile(`--line (\d+)`)
+	gFakeBreakInsertIgnoreRegexp    = regexp.MustCompile(`-i (\d+)`)
+	gFakeBreakConditionRegexp       = regexp.MustCompile(`lineno == (\d+)`)
+)
+
+// Makes es a replay of program stopped at its first statement. Call close() on the fake gdb when done
+func newFakeReplay(t *testing.T, program ...fakeStatement) (*engineState, *fakeGdb) {
+	sourceMap := make(map[string]int)
+	maxLevel := 0
+	for _, statement := range program {
+		if _, ok := sourceMap[statement.filename]; !ok {
+			sourceMap[statement.filename] = fakeBreakLinesStartAt + len(sourceMap)
+		}
+		if statement.level > maxLevel {
+			maxLevel = statement.level
+		}
+	}
+
+	levelAr := make([]int, maxLevel+2)
+	for i := range levelAr {
+		levelAr[i] = fakeLevelLinesStartAt + i
+	}
+
+	es := &engineState{
+		breakStopNotify: make(chan string, 1),
+		otherStopNotify: make(chan struct{}, 1),
+		exitNotify:      make(chan programExit, 1),
+		featureMap:      initFeatureMap(),
+		entryFilePHP:    program[0].filename,
+		status:          statusBreak,
+		reason:          reasonOk,
+		sourceMap:       sourceMap,
+		levelAr:         levelAr,
+		maxStackDepth:   len(levelAr),
+		funcLocMap:      make(map[engineBreakpointType]int),
+		breakpoints:     make(map[string]*engineBreakPoint),
+		opcodeBp:        fakeOpcodeBp,
+		evalResults:     make(map[string]string),
+		endSession:      make(chan string, 1),
+		rrExited:        make(chan struct{}),
+		closing:         make(chan struct{}),
+	}
+
+	f := &fakeGdb{
+		t:           t,
+		es:          es,
+		program:     program,
+		pos:         fakeLocMaster,
+		breakpoints: make(map[string]*fakeBreakpoint),
+		nextBp:      1,
+	}
+
+	for _, id := range []string{fakeMasterBp, fakeOpcodeBp} {
+		f.insert(&fakeBreakpoint{internal: true})
+		es.breakpoints[id] = &engineBreakPoint{
+			id:       id,
+			filename: "dontbug.c",
+			state:    breakpointStateDisabled,
+			bpType:   breakpointTypeInternal,
+		}
+	}
+
+	f.originalSend = gSendToGdb
+	gSendToGdb = f.send
+	return es, f
+}
+
+func (f *fakeGdb) close() {
+	gSendToGdb = f.originalSend
+}
+
+func (f *fakeGdb) insert(bp *fakeBreakpoint) string {
+	bp.id = strconv.Itoa(f.nextBp)
+	f.nextBp++
+	f.breakpoints[bp.id] = bp
+	return bp.id
+}
+
+func (f *fakeGdb) statement() fakeStatement {
+	return f.program[f.pos/fakeLocsPerStatement]
+}
+
+// The current PHP location e.g. file:///a.php:3
+func (f *fakeGdb) location() string {
+	f.Lock()
+	defer f.Unlock()
+	return fmt.Sprintf("%v:%v", f.statement().filename, f.statement().lineno)
+}
+
+func (f *fakeGdb) commands(prefix string) []string {
+	f.Lock()
+	defer f.Unlock()
+	var commands []string
+	for _, command := range f.sent {
+		if strings.HasPrefix(command, prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func fakeDone(payload map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"class": "done", "payload": payload}
+}
+
+func fakeError(message string) map[string]interface{} {
+	return map[string]interface{}{"class": "error", "payload": map[string]interface{}{"msg": message}}
+}
+
+func (f *fakeGdb) send(_ *gdb.Gdb, command string, arguments ...string) (map[string]interface{}, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	full := strings.TrimSpace(command + " " + strings.Join(arguments, " "))
+	f.sent = append(f.sent, full)
+	fields := strings.Fields(full)
+
+	switch fields[0] {
+	case "break-insert":
+		return f.breakInsert(full), nil
+	case "break-delete":
+		for _, id := range fields[1:] {
+			delete(f.breakpoints, id)
+		}
+	case "break-enable", "break-disable":
+		enabled := fields[0] == "break-enable"
+		if len(fields) == 1 {
+			for _, bp := range f.breakpoints {
+				bp.enabled = enabled
+			}
+		}
+		for _, id := range fields[1:] {
+			if bp, ok := f.breakpoints[id]; ok {
+				bp.enabled = enabled
+			}
+		}
+	case "break-condition":
+		bp, ok := f.breakpoints[fields[1]]
+		matches := gFakeBreakConditionRegexp.FindStringSubmatch(full)
+		if !ok || matches == nil {
+			return fakeError("No breakpoint number " + fields[1]), nil
+		}
+		bp.condition, _ = strconv.Atoi(matches[1])
+	case "break-info":
+		bp, ok := f.breakpoints[fields[1]]
+		if !ok {
+			return fakeError("No breakpoint number " + fields[1]), nil
+		}
+		return fakeDone(map[string]interface{}{"BreakpointTable": map[string]interface{}{
+			"body": []interface{}{map[string]interface{}{"bkpt": map[string]interface{}{"number": bp.id, "times": strconv.Itoa(bp.hits)}}},
+		}}), nil
+	case "exec-continue":
+		if f.onContinue != nil {
+			f.Unlock()
+			f.onContinue()
+			f.Lock()
+		}
+		f.continueExecution(len(fields) > 1 && fields[1] == "--reverse")
+		return map[string]interface{}{"class": "running"}, nil
+	case "data-evaluate-expression":
+		return f.evaluateExpression(strings.Join(fields[1:], " ")), nil
+	case "interpreter-exec":
+		consoleCommand, err := strconv.Unquote(strings.Join(fields[2:], " "))
+		if err != nil || f.console == nil {
+			return fakeError("Undefined command: " + full), nil
+		}
+		output, ok := f.console(consoleCommand)
+		if !ok {
+			return fakeError(output), nil
+		}
+		captureGdbConsoleOutput(map[string]interface{}{"type": "console", "payload": output})
+	}
+
+	return fakeDone(nil), nil
+}
+
+func (f *fakeGdb) breakInsert(full string) map[string]interface{} {
+	lineMatches := gFakeBreakInsertLineRegexp.FindStringSubmatch(full)
+	if lineMatches == nil {
+		return fakeError("No --line in " + full)
+	}
+	line, _ := strconv.Atoi(lineMatches[1])
+
+	bp := &fakeBreakpoint{
+		enabled:   !strings.Contains(full, " -d "),
+		temporary: strings.Contains(full, " -t "),
+		level:     -1,
+	}
+	if matches := gFakeBreakInsertIgnoreRegexp.FindStringSubmatch(full); matches != nil {
+		bp.ignore, _ = strconv.Atoi(matches[1])
+	}
+	if matches := gFakeBreakInsertConditionRegexp.FindStringSubmatch(full); matches != nil {
+		bp.condition, _ = strconv.Atoi(matches[1])
+	}
+
+	for filename, breakLine := range f.es.sourceMap {
+		if breakLine == line {
+			bp.filename = filename
+		}
+	}
+	for level, levelLine := range f.es.levelAr {
+		if levelLine == line {
+			bp.level = level
+		}
+	}
+	if bp.filename == "" && bp.level == -1 {
+		return fakeError(fmt.Sprintf("No line %v in dontbug_break.c", line))
+	}
+
+	id := f.insert(bp)
+	return fakeDone(map[string]interface{}{"bkpt": map[string]interface{}{"number": id}})
+}
+
+func (f *fakeGdb) matches(bp *fakeBreakpoint, pos int) bool {
+	statement := f.program[pos/fakeLocsPerStatement]
+	switch pos % fakeLocsPerStatement {
+	case fakeLocMaster:
+		return bp.internal
+	case fakeLocBreak:
+		return bp.filename == statement.filename && (bp.condition == 0 || bp.condition == statement.lineno)
+	default:
+		// dontbug_level_location() passes the location of every level at or above the statement's level
+		return !bp.internal && bp.filename == "" && statement.level <= bp.level
+	}
+}
+
+// Like gdb, reports the lowest numbered breakpoint when several are at the same location
+func (f *fakeGdb) continueExecution(reverse bool) {
+	step := 1
+	if reverse {
+		step = -1
+	}
+
+	if f.exited {
+		if !reverse {
+			f.t.Fatal("fake gdb: exec-continue at the end of the execution")
+		}
+		f.exited = false
+		f.pos = len(f.program) * fakeLocsPerStatement
+	}
+
+	for f.pos += step; f.pos >= 0 && f.pos < len(f.program)*fakeLocsPerStatement; f.pos += step {
+		var hit *fakeBreakpoint
+		for _, bp := range f.breakpoints {
+			if !bp.enabled || !f.matches(bp, f.pos) {
+				continue
+			}
+			if hit == nil || len(bp.id) < len(hit.id) || (len(bp.id) == len(hit.id) && bp.id < hit.id) {
+				hit = bp
+			}
+		}
+
+		if hit == nil {
+			continue
+		}
+
+		hit.hits++
+		if hit.ignore > 0 {
+			hit.ignore--
+			continue
+		}
+		if hit.temporary {
+			delete(f.breakpoints, hit.id)
+		}
+
+		f.es.breakStopNotify <- hit.id
+		return
+	}
+
+	if reverse {
+		f.t.Fatal("fake gdb: ran backwards past the start of the execution")
+	}
+
+	f.exited = true
+	f.pos = len(f.program)*fakeLocsPerStatement - 1
+	f.es.exitNotify <- programExit{}
+	f.es.breakStopNotify <- programExitedID
+}
+
+func (f *fakeGdb) evaluateExpression(expression string) map[string]interface{} {
+	statement := f.statement()
+	switch expression {
+	case "filename":
+		return fakeDone(map[string]interface{}{"value": fmt.Sprintf("0x1 %q", statement.filename)})
+	case "lineno":
+		return fakeDone(map[string]interface{}{"value": strconv.Itoa(statement.lineno)})
+	case "level":
+		return fakeDone(map[string]interface{}{"value": strconv.Itoa(statement.level)})
+	}
+
+	if f.evaluate != nil {
+		f.Unlock()
+		value, ok := f.evaluate(expression)
+		f.Lock()
+		if ok {
+			return fakeDone(map[string]interface{}{"value": value})
+		}
+		return fakeError(value)
+	}
+
+	return fakeError("No symbol in current context: " + expression)
+}
+
+// A gdb/mi value of a char * as gdb prints it
+func fakeGdbString(s string) string {
+	return "0x1 " + strconv.Quote(s)
+}
+
+// The PHP locations the program passes through from the start e.g. file:///a.php:1
+func fakeProgram(filename string, linesAndLevels ...int) []fakeStatement {
+	var program []fakeStatement
+	for i := 0; i+1 < len(linesAndLevels); i += 2 {
+		program = append(program, fakeStatement{filename, linesAndLevels[i], linesAndLevels[i+1]})
+	}
+	return program
+}
+
+var gFakeResponseIDRegexp = regexp.MustCompile(` id="(\d+)"`)
+
+// Runs an IDE command through its handler (as dispatched) and fails the test if the handler returns an error
+func mustHandle(t *testing.T, es *engineState, command string) string {
+	dCmd := parseCommand(command, false)
+	response, err := gDbgpCmdHandlers[dCmd.command](es, dCmd)
+	if err != nil {
+		t.Fatalf("%v failed: %v", command, err)
+	}
+	return response
+}
+
+// Sets an enabled line breakpoint like an IDE would and returns its id
+func mustSetBreakpoint(t *testing.T, es *engineState, filename string, lineno int) string {
+	response := mustHandle(t, es, fmt.Sprintf("breakpoint_set -i 1 -t line -f %v -n %v", filename, lineno))
+	matches := gFakeResponseIDRegexp.FindStringSubmatch(response)
+	if matches == nil {
+		t.Fatalf("No breakpoint id in: %v", response)
+	}
+	return matches[1]
+}
@@ -16,7 +16,10 @@ package engine
 
 import (
 	"fmt"
+	"html"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type engineFeatureBool struct {
@@ -93,53 +96,106 @@ func initFeatureMap() map[string]engineFeatureValue {
 		"protocol_version":           &engineFeatureInt{1, true},
 		"supports_async":             &engineFeatureBool{false, true},
 		"supports_reverse_debugging": &engineFeatureBool{true, true},
-		// @TODO implement full list eventually
-		// "breakpoint_types" : &FeatureString{"line call return exception conditional watch", true},
-		"breakpoint_types":    &engineFeatureString{"line", true},
-		"multiple_sessions":   &engineFeatureBool{false, false},
-		"max_children":        &engineFeatureInt{64, false},
-		"max_data":            &engineFeatureInt{2048, false},
-		"max_depth":           &engineFeatureInt{1, false},
-		"extended_properties": &engineFeatureBool{false, false},
-		"show_hidden":         &engineFeatureBool{false, false},
+		"breakpoint_types":           &engineFeatureString{supportedBreakpointTypes(), true},
+		"supported_commands":         &engineFeatureString{supportedCommands(), true},
+		"multiple_sessions":          &engineFeatureBool{false, false},
+		"max_children":               &engineFeatureInt{64, false},
+		"max_data":                   &engineFeatureInt{2048, false},
+		"max_depth":                  &engineFeatureInt{1, false},
+		"extended_properties":        &engineFeatureBool{false, false},
+		"show_hidden":                &engineFeatureBool{false, false},
+		"notify_ok":                  &engineFeatureBool{false, false}, // See notifyIde()
+		// dontbug specific: "statement" (default) or "opcode"
+		"dontbug_step_granularity": &engineFeatureString{stepGranularityStatement, false},
+		// dontbug specific: in milliseconds. 0 means no timeout
+		"dontbug_diversion_timeout": &engineFeatureInt{int(DiversionTimeout / time.Millisecond), false},
+		// dontbug specific: refuse evals with exit, die, eval, include etc. See checkEvalSafe()
+		"dontbug_eval_safe": &engineFeatureBool{true, false},
+		// dontbug specific: add <dontbug:position> (the rr event and ticks) to status responses. See positionXML()
+		"dontbug_status_position": &engineFeatureBool{false, false},
 	}
 
 	return featureMap
 }
 
-func handleFeatureSet(es *engineState, dCmd dbgpCmd) string {
+func handleFeatureSet(es *engineState, dCmd dbgpCmd) (string, error) {
 	n, ok := dCmd.options["n"]
 	if !ok {
-		panicWith("Please provide -n option in feature_set")
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide -n option in feature_set")
 	}
 
 	v, ok := dCmd.options["v"]
 	if !ok {
-		panicWith("Not provided -v option in feature_set")
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Not provided -v option in feature_set")
+	}
+
+	// Watch expressions are not simple values so are not in the feature map
+	if n == featureWatch {
+		err := addWatch(es, v)
+		if err != nil {
+			return "", newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+		}
+		return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, 1), nil
+	}
+
+	if n == featureWatchRemove {
+		success := 0
+		if removeWatch(es, v) {
+			success = 1
+		}
+		return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, success), nil
 	}
 
 	var featureVal engineFeatureValue
 	featureVal, ok = es.featureMap[n]
 	if !ok {
-		panicWith("Unknown option: " + n)
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Unknown option: %v", n)
+	}
+
+	if n == "dontbug_step_granularity" && v != stepGranularityStatement && v != stepGranularityOpcode {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Unknown step granularity %v. Should be %v or %v", v, stepGranularityStatement, stepGranularityOpcode)
+	}
+
+	if n == "dontbug_step_granularity" && v == stepGranularityOpcode && !isOpcodeSteppingRecorded(es) {
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "This recording does not support opcode stepping. Please record again with 'dontbug record --opcode-stepping'")
 	}
 
 	featureVal.set(v)
-	return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, 1)
+	return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, 1), nil
 }
 
-func handleFeatureGet(es *engineState, dCmd dbgpCmd) string {
+// dontbug.so only calls the opcode location with 'dontbug record --opcode-stepping'. Older builds of dontbug.so always
+// did and don't have dontbug_opcode_stepping. If gdb can't tell us (e.g. we're running) we assume the best
+func isOpcodeSteppingRecorded(es *engineState) bool {
+	result, err := trySendGdbCommand(es.gdbSession, "data-evaluate-expression", "dontbug_opcode_stepping")
+	if err != nil || result["class"] != "done" {
+		return true
+	}
+
+	payload, _ := result["payload"].(map[string]interface{})
+	return payload["value"] != "0"
+}
+
+func handleFeatureGet(es *engineState, dCmd dbgpCmd) (string, error) {
 	n, ok := dCmd.options["n"]
 	if !ok {
-		panicWith("Please provide -n option in feature_get")
+		return "", newDbgpError(dbgpErrorCodeInvalidOptions, "Please provide -n option in feature_get")
 	}
 
-	var featureVal engineFeatureValue
-	featureVal, ok = es.featureMap[n]
-	supported := 1
-	if !ok {
-		supported = 0
+	featureVal, ok := es.featureMap[n]
+	if ok {
+		return fmt.Sprintf(gFeatureGetXMLResponseFormat, dCmd.seqNum, n, 1, featureVal), nil
+	}
+
+	if n == featureWatch {
+		return fmt.Sprintf(gFeatureGetXMLResponseFormat, dCmd.seqNum, n, 1, html.EscapeString(strings.Join(getWatches(es), "\n"))), nil
+	}
+
+	// As per the dbgp spec, feature_get can also be used to ask whether a command is supported
+	_, ok = gDbgpCmdHandlers[n]
+	if ok {
+		return fmt.Sprintf(gFeatureGetXMLResponseFormat, dCmd.seqNum, n, 1, ""), nil
 	}
 
-	return fmt.Sprintf(gFeatureGetXMLResponseFormat, dCmd.seqNum, n, supported, featureVal)
+	return fmt.Sprintf(gFeatureGetXMLResponseFormat, dCmd.seqNum, n, 0, ""), nil
 }
@@ -0,0 +1,173 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fakeHiddenMembersResponse = `<response command="property_get"><property name="$obj" type="object">` +
+	`<property name="secret" facet="private"></property><property name="count" facet="protected"></property></property></response>`
+
+// Every path into the diversion session passes show_hidden on to xdebug
+func TestShowHiddenIsPassedToXdebug(t *testing.T) {
+	es, f := newFakeReplay(t, fakeStatement{"file:///a.php", 2, 1}, fakeStatement{"file:///b.php", 10, 2})
+	defer f.close()
+	fakeGoto(t, es, f, "file:///b.php:10")
+
+	var evaluated []string
+	f.evaluate = func(expression string) (string, bool) {
+		evaluated = append(evaluated, expression)
+		return fakeGdbString(fakeHiddenMembersResponse), true
+	}
+
+	mustHandle(t, es, "feature_set -i 1 -n show_hidden -v 1")
+	mustHandle(t, es, "property_get -i 2 -n $obj")
+	mustHandle(t, es, "property_get -i 3 -d 1 -n $obj")
+	err := evalInAllFrames(es, "$obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`dontbug_xdebug_cmd_with_options("", "property_get -i 2 -n $obj", 1, `,
+		`dontbug_xdebug_cmd_in_frame_with_options("property_get -i 3 -n $obj", 1, 1, `,
+		`dontbug_xdebug_cmd_in_frame_with_options("eval -i `,
+		`dontbug_xdebug_cmd_in_frame_with_options("eval -i `,
+	}
+	if len(evaluated) != len(expected) {
+		t.Fatalf("Expected %v evaluations. Got: %v", len(expected), evaluated)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(evaluated[i], prefix) {
+			t.Errorf("Expected an evaluation starting with %v. Got: %v", prefix, evaluated[i])
+		}
+	}
+	if !strings.Contains(evaluated[2], `, 0, 1, `) || !strings.Contains(evaluated[3], `, 1, 1, `) {
+		t.Errorf("evalall should go through frames 0 and 1 with show_hidden. Got: %v", evaluated[2:])
+	}
+
+	// Back to the default
+	evaluated = nil
+	mustHandle(t, es, "feature_set -i 4 -n show_hidden -v 0")
+	mustHandle(t, es, "property_get -i 5 -n $obj")
+	if len(evaluated) != 1 || evaluated[0] != `dontbug_xdebug_cmd("property_get -i 5 -n $obj")` {
+		t.Errorf("Without show_hidden the plain dontbug_xdebug_cmd() should be used. Got: %v", evaluated)
+	}
+}
+
+var gFeatureGetValueRegexp = regexp.MustCompile(`(?s)supported="1">\s*(.*?)\s*</response>`)
+
+// The value in a feature_get response of a supported feature
+func featureGetValue(t *testing.T, response string) string {
+	matches := gFeatureGetValueRegexp.FindStringSubmatch(response)
+	if matches == nil {
+		t.Fatalf("Not a feature_get response of a supported feature: %v", response)
+	}
+	return matches[1]
+}
+
+func TestFeatureNegotiation(t *testing.T) {
+	for _, name := range []string{"notify_ok", "extended_properties"} {
+		es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+
+		if value := featureGetValue(t, mustHandle(t, es, "feature_get -i 1 -n "+name)); value != "0" {
+			t.Errorf("%v should be off by default. Got: %v", name, value)
+		}
+
+		response := mustHandle(t, es, "feature_set -i 2 -n "+name+" -v 1")
+		if !strings.Contains(response, `success="1"`) {
+			t.Errorf("feature_set of %v failed: %v", name, response)
+		}
+
+		if value := featureGetValue(t, mustHandle(t, es, "feature_get -i 3 -n "+name)); value != "1" {
+			t.Errorf("%v should be on after feature_set. Got: %v", name, value)
+		}
+
+		if name == "extended_properties" {
+			var evaluated string
+			f.evaluate = func(expression string) (string, bool) {
+				evaluated = expression
+				return fakeGdbString(fakeHiddenMembersResponse), true
+			}
+			mustHandle(t, es, "property_get -i 4 -n $obj")
+			if !strings.HasPrefix(evaluated, "dontbug_xdebug_cmd_with_options(") || !strings.HasSuffix(evaluated, ", 1)") {
+				t.Errorf("extended_properties should be passed on to xdebug. Evaluated: %v", evaluated)
+			}
+		}
+
+		f.close()
+	}
+}
+
+// Reads what notifyIde() sends to the IDE within a short time
+func fakeIdeNotification(es *engineState) string {
+	ide, conn := net.Pipe()
+	defer ide.Close()
+	es.ideConnection = conn
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		notifyIde(es, "dontbug_test", "hello")
+		close(done)
+	}()
+	ide.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	data, _ := ioutil.ReadAll(ide)
+	<-done
+	return string(data)
+}
+
+func TestNotificationsNeedNotifyOk(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	if notification := fakeIdeNotification(es); notification != "" {
+		t.Errorf("Got a notification without notify_ok: %v", notification)
+	}
+
+	mustHandle(t, es, "feature_set -i 1 -n notify_ok -v 1")
+	if notification := fakeIdeNotification(es); !strings.Contains(notification, `<notify`) || !strings.Contains(notification, "hello") {
+		t.Errorf("Expected a notification with notify_ok. Got: %v", notification)
+	}
+}
+
+// The IDE and the (dontbug) prompt add and remove watches at the same time. Run with -race
+func TestWatchesFromIdeAndPrompt(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			addWatch(es, "$y")
+			removeWatchAt(es, 0)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		mustHandle(t, es, fmt.Sprintf("feature_set -i %v -n dontbug_watch -v $x", i))
+		getWatches(es)
+		removeWatch(es, "$x")
+	}
+	<-done
+}
@@ -48,7 +48,7 @@ var gBreakCskeletonHeader = `
 
 /**
  * This file was autogenerated by dontbug on ` + time.Now().String() + `
- * IMPORTANT -- DO NOT remove/edit/move comments with ### or $$$ or &&&
+ * IMPORTANT -- DO NOT remove/edit/move comments with ### or $$$ or %%% or &&&
  */
 #include "php.h"
 #include "php_dontbug.h"
@@ -56,6 +56,8 @@ var gBreakCskeletonHeader = `
 void dontbug_break_location(zend_string* zfilename, zend_execute_data *execute_data, int lineno, unsigned long level) {
     zend_ulong hash = zfilename->h;
     char *filename = ZSTR_VAL(zfilename);
+
+    dontbug_function_location(execute_data);
 `
 
 var gBreakCskeletonFooter = `
@@ -71,6 +73,25 @@ var gLevelLocationFooter = `
 }
 `
 
+// The hashes are compared in the conditions of the gdb breakpoints for call and return PHP breakpoints
+var gFunctionLocation = `
+void dontbug_function_location(zend_execute_data *execute_data) {
+    zend_string *function_name = execute_data->func->common.function_name;
+    zend_class_entry *scope = execute_data->func->common.scope;
+    zend_ulong function_hash = function_name ? zend_string_hash_val(function_name) : 0;
+    zend_ulong class_hash = scope ? zend_string_hash_val(scope->name) : 0;
+    int count = 0;
+
+    if (function_name && dontbug_is_function_entry(execute_data)) {
+        count++; ` + functionSentinel + ` ` + string(breakpointTypeCall) + `
+    }
+
+    if (function_name && dontbug_is_function_return(execute_data)) {
+        count++; ` + functionSentinel + ` ` + string(breakpointTypeReturn) + `
+    }
+}
+`
+
 type myUintArray []uint64
 type myMap map[uint64][]string
 
@@ -118,7 +139,7 @@ func makeDontbugExtension(extDir string, phpPath string) {
 			log.Fatal(err)
 		} else {
 			Verboseln(string(makeDistClean))
-			color.Green("dontbug: Successfully ran 'make distclean' in dontbug zend extension directory")
+			logInfof(color.FgGreen, "dontbug: Successfully ran 'make distclean' in dontbug zend extension directory")
 		}
 	}
 
@@ -128,10 +149,10 @@ func makeDontbugExtension(extDir string, phpPath string) {
 		log.Fatal(err)
 	} else {
 		Verboseln(string(phpizeOut))
-		color.Green("dontbug: Successfully ran phpize in dontbug zend extension directory")
+		logInfof(color.FgGreen, "dontbug: Successfully ran phpize in dontbug zend extension directory")
 	}
 
-	color.Green("dontbug: Running configure in dontbug zend extension directory")
+	logInfof(color.FgGreen, "dontbug: Running configure in dontbug zend extension directory")
 	configureScript := path.Clean(extDirAbsPath + "/configure")
 	configureOut, err := exec.Command(configureScript, fmt.Sprintf("--with-php-config=%v", phpConfigPath)).CombinedOutput()
 	if err != nil {
@@ -139,7 +160,7 @@ func makeDontbugExtension(extDir string, phpPath string) {
 		log.Fatal(err)
 	} else {
 		Verboseln(string(configureOut))
-		color.Green("dontbug: Successfully ran configure in dontbug zend extension directory")
+		logInfof(color.FgGreen, "dontbug: Successfully ran configure in dontbug zend extension directory")
 	}
 
 	makeOutput, err := exec.Command("make", "CFLAGS=-g -O0").CombinedOutput()
@@ -148,7 +169,7 @@ func makeDontbugExtension(extDir string, phpPath string) {
 		log.Fatal(err)
 	} else {
 		Verboseln(string(makeOutput))
-		color.Green("dontbug: Successfully compiled the dontbug zend extension")
+		logInfof(color.FgGreen, "dontbug: Successfully compiled the dontbug zend extension")
 	}
 
 	// Restore the old working directory
@@ -167,19 +188,21 @@ func generateBreakFile(rootDirAbsNoSymPath, extDirAbsNoSymPath, skelHeader, skel
 	fatalIf(err)
 	defer f.Close()
 
-	color.Green("dontbug: Generating %v for all PHP code in: %v", breakFileName, rootDirAbsNoSymPath)
+	logInfof(color.FgGreen, "dontbug: Generating %v for all PHP code in: %v", breakFileName, rootDirAbsNoSymPath)
 	// All is good, now go ahead and do some real work
 	ar, m := makeMap(rootDirAbsNoSymPath)
 	fmt.Fprintf(f, "%v%v\n", numFilesSentinel, len(ar))
 	fmt.Fprintf(f, "%v%v\n", maxStackDepthSentinel, maxStackDepth)
+	fmt.Fprintf(f, "%v%v\n", formatVersionSentinel, dontbugBreakFormatVersion)
 	fmt.Fprintln(f, skelHeader)
 	fmt.Fprintln(f, generateFileBreakBody(ar, m))
 	fmt.Fprintln(f, skelFooter)
 	fmt.Fprintln(f, skelLocHeader)
 	fmt.Fprintln(f, generateLocBody(maxStackDepth))
 	fmt.Fprintln(f, skelLocFooter)
+	fmt.Fprintln(f, gFunctionLocation)
 
-	color.Green("dontbug: Code generation complete. Compiling dontbug zend extension...")
+	logInfof(color.FgGreen, "dontbug: Code generation complete. Compiling dontbug zend extension...")
 }
 
 func generateLocBody(maxStackDepth int) string {
@@ -336,7 +359,7 @@ func lt(rhs uint64) string {
 // @TODO deal with hash collisions
 func foundHash(hash uint64, matchingFiles []string, indent int) string {
 	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("%v// hash == %v\n", s(indent), hash))
+	buf.WriteString(fmt.Sprintf("%v%v %v\n", s(indent), hashCommentMarker, hash))
 	buf.WriteString(fmt.Sprintf("%vreturn; %v %v\n", s(indent), phpFilenameSentinel, matchingFiles[0]))
 	return buf.String()
 }
@@ -389,25 +412,24 @@ func djbx33a32(byteStr string) uint32 {
 	return hash | (1 << 31)
 }
 
-func makeMap(rootAbsNoLinkPath string) (myUintArray, myMap) {
-	longIs64bits := false
+// The hash PHP would compute for this string on this platform
+func phpStringHash(str string) uint64 {
 	if unsafe.Sizeof(uint(0)) == 8 {
-		longIs64bits = true
+		return djbx33a64(str)
 	}
 
+	// This is OK cause we're just interested in how the numeric literals print out
+	return uint64(djbx33a32(str))
+}
+
+func makeMap(rootAbsNoLinkPath string) (myUintArray, myMap) {
 	filesMap := allFiles(rootAbsNoLinkPath)
-	color.Green("dontbug: %v PHP files found", len(filesMap))
+	logInfof(color.FgGreen, "dontbug: %v PHP files found", len(filesMap))
 
 	m := make(myMap)
 	hashAr := make(myUintArray, 0, 100)
-	var hash uint64
 	for fileName := range filesMap {
-		if longIs64bits {
-			hash = djbx33a64(fileName)
-		} else {
-			// This is OK cause we're just interested in how the numeric literals print out during code generation
-			hash = uint64(djbx33a32(fileName))
-		}
+		hash := phpStringHash(fileName)
 
 		_, ok := m[hash]
 		if ok {
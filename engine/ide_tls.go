@@ -0,0 +1,63 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+)
+
+// IdeTLS makes the connection to the IDE use TLS e.g. for an IDE on another host or behind a TLS terminating
+// proxy. The IDE's certificate is always verified: against IdeCAFile if given, else against the system roots
+var (
+	IdeTLS      bool
+	IdeCAFile   string
+	IdeCertFile string // A client certificate for IDEs (or proxies) that require one
+	IdeKeyFile  string // The client certificate's key. Can be IdeCertFile too if it has both
+)
+
+// serverName is what the IDE's certificate should be for
+func ideTLSConfig(serverName string) *tls.Config {
+	config := &tls.Config{ServerName: serverName}
+
+	if IdeCAFile != "" {
+		pem, err := ioutil.ReadFile(IdeCAFile)
+		if err != nil {
+			log.Fatalf("Could not read --ide-ca: %v", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No PEM encoded certificates found in --ide-ca %v", IdeCAFile)
+		}
+	}
+
+	if IdeCertFile != "" {
+		keyFile := IdeKeyFile
+		if keyFile == "" {
+			keyFile = IdeCertFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(IdeCertFile, keyFile)
+		if err != nil {
+			log.Fatalf("Could not load the client certificate in --ide-cert: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config
+}
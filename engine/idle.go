@@ -0,0 +1,81 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"time"
+)
+
+const (
+	IdleActionWarn = "warn" // Only warn that the replay is idle
+	IdleActionStop = "stop" // Warn and then end the replay so that rr and gdb go away
+)
+
+// Called whenever the IDE sends a command or something is typed at the (dontbug) prompt
+func noteActivity(es *engineState) {
+	es.activityMutex.Lock()
+	es.lastActivity = time.Now()
+	es.activityMutex.Unlock()
+}
+
+func idleFor(es *engineState) time.Duration {
+	es.activityMutex.Lock()
+	defer es.activityMutex.Unlock()
+	return time.Since(es.lastActivity)
+}
+
+// A replay holds on to rr (and all the memory of the replayed process) until it is quit. Warns (once per
+// idle period) when neither the IDE nor the (dontbug) prompt has been used for IdleTimeout
+func watchIdle(es *engineState) {
+	ticker := time.NewTicker(IdleTimeout / 10)
+	defer ticker.Stop()
+
+	warned := false
+	for {
+		select {
+		case <-es.closing:
+			return
+		case <-ticker.C:
+		}
+
+		idle := idleFor(es)
+		if idle < IdleTimeout {
+			warned = false
+			continue
+		}
+
+		// A long run/step is not idleness
+		if status, _ := getStatus(es); status == statusRunning || warned {
+			continue
+		}
+
+		warned = true
+		idle = idle / time.Second * time.Second
+		if IdleAction == IdleActionStop {
+			logWarnf(color.FgRed, "dontbug: No IDE or prompt activity for %v. Ending the replay (--idle-action=stop)", idle)
+			select {
+			case es.endSession <- fmt.Sprintf("dontbug: Idle for %v. Exiting.", idle):
+			default:
+			}
+			return
+		}
+
+		notifyIde(es, "dontbug_idle", fmt.Sprintf("No activity for %v. The replay is still holding on to memory", idle))
+		logWarnf(color.FgRed, "dontbug: No IDE or prompt activity for %v. The replay (and rr) is still holding on to memory. q (quit) at the prompt if you are done", idle)
+		fmt.Print("(dontbug) ")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"github.com/fatih/color"
+)
+
+// If rr dies (e.g. it crashed) gdb never reports another stop and anything waiting for one would hang forever.
+// Instead:
+// - a run/step in progress panics and the IDE connection is shut down as for any other failed command
+// - an idle IDE connection is closed so that the IDE sees the session end
+// - the (dontbug) prompt stays but only allows quitting
+func monitorRR(es *engineState) {
+	waitForRRExit(es.rrCmd)
+	close(es.rrExited)
+
+	select {
+	case <-es.closing:
+		// Expected. See ReplaySession.Close()
+		return
+	default:
+	}
+
+	logErrorf(color.FgRed, "dontbug: rr exited unexpectedly. The replay cannot continue. Please q (quit) and replay again")
+	setStatus(es, statusStopped, reasonError)
+
+	notifyIde(es, "dontbug_rr_exited", "rr exited unexpectedly. The replay cannot continue")
+	conn := es.ideConnection
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func rrHasExited(es *engineState) bool {
+	select {
+	case <-es.rrExited:
+		return true
+	default:
+		return false
+	}
+}
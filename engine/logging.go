@@ -0,0 +1,93 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"strings"
+)
+
+// LogLevel is the importance of a diagnostic message
+//
+// - debug: internal protocol noise (dontbug <-> gdb, dontbug <-> IDE) and other details
+// - info: the usual user facing "dontbug: ..." messages
+// - warn: something is not quite right but dontbug can carry on
+// - error: something failed
+//
+// Note that fatal errors (see fatalIf()) are always shown
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// MinLogLevel is the least important level that is shown
+// Debug messages are shown whenever VerboseFlag is true (which is what --log-level debug does)
+// so that verbose mode can still be toggled from the (dontbug) prompt
+var MinLogLevel = LogLevelInfo
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+// ParseLogLevel converts a level name like "warn" into a LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.ToLower(name) == levelName {
+			return LogLevel(i), nil
+		}
+	}
+
+	return LogLevelInfo, fmt.Errorf("Unknown log level %q. Should be one of: %v", name, strings.Join(logLevelNames, ", "))
+}
+
+func logEnabled(level LogLevel) bool {
+	if level == LogLevelDebug {
+		return VerboseFlag
+	}
+
+	return level >= MinLogLevel
+}
+
+// Colors are kept per message (rather than per level) so output looks the same as it always has
+func logf(level LogLevel, attr color.Attribute, format string, a ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+
+	color.New(attr).Println(fmt.Sprintf(format, a...))
+}
+
+func logDebugf(attr color.Attribute, format string, a ...interface{}) {
+	logf(LogLevelDebug, attr, format, a...)
+}
+
+func logInfof(attr color.Attribute, format string, a ...interface{}) {
+	logf(LogLevelInfo, attr, format, a...)
+}
+
+func logWarnf(attr color.Attribute, format string, a ...interface{}) {
+	logf(LogLevelWarn, attr, format, a...)
+}
+
+func logErrorf(attr color.Attribute, format string, a ...interface{}) {
+	logf(LogLevelError, attr, format, a...)
+}
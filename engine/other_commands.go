@@ -15,31 +15,214 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
+	"github.com/fatih/color"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // rr replay sessions are read-only so property_set will always fail
-func handlePropertySet(es *engineState, dCmd dbgpCmd) string {
-	return fmt.Sprintf(gPropertySetXMLResponseFormat, dCmd.seqNum)
+func handlePropertySet(es *engineState, dCmd dbgpCmd) (string, error) {
+	return fmt.Sprintf(gPropertySetXMLResponseFormat, dCmd.seqNum), nil
 }
 
 // @TODO The stdout/stdin/stderr commands always returns attribute success = "0" until this is implemented
-func handleStdFd(es *engineState, dCmd dbgpCmd, fdName string) string {
-	return fmt.Sprintf(gStdFdXMLResponseFormat, dCmd.seqNum, fdName)
+func handleStdFd(es *engineState, dCmd dbgpCmd, fdName string) (string, error) {
+	return fmt.Sprintf(gStdFdXMLResponseFormat, dCmd.seqNum, fdName), nil
 }
 
-func handleStop(es *engineState, dCmd dbgpCmd) string {
-	es.status = statusStopped
-	return fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, es.status, es.reason)
+func handleStop(es *engineState, dCmd dbgpCmd) (string, error) {
+	_, reason := getStatus(es)
+	setStatus(es, statusStopped, reason)
+	return fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, statusStopped, reason, ""), nil
 }
 
-func handleInDiversionSessionStandard(es *engineState, dCmd dbgpCmd) string {
-	return diversionSessionCmd(es, dCmd.fullCommand)
+func handleInDiversionSessionStandard(es *engineState, dCmd dbgpCmd) (string, error) {
+	result, err := diversionSessionCmd(es, dCmd.fullCommand)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+	}
+
+	return result, nil
 }
 
-func diversionSessionCmd(es *engineState, command string) string {
-	result := xSlashSgdb(es.gdbSession, fmt.Sprintf("dontbug_xdebug_cmd(\"%v\")", command))
-	return result
+// The diversion session is a fork of the replay so nothing done in it (including being interrupted)
+// affects the main replay timeline. Returns an error if the command timed out or failed
+func diversionSessionCmd(es *engineState, command string) (string, error) {
+	return diversionSessionCmdWithSetup(es, "", command)
+}
+
+// setupCommand (if not "") is run in the same diversion session just before command. Its response is discarded
+func diversionSessionCmdWithSetup(es *engineState, setupCommand, command string) (string, error) {
+	return runInDiversionSession(es, diversionSessionExpression(es, setupCommand, command), command)
+}
+
+// Runs command in the PHP frame at depth instead of the innermost one. Returns "" if there is no such frame
+func diversionSessionCmdInFrame(es *engineState, depth int, command string) (string, error) {
+	return runInDiversionSession(es, diversionSessionExpressionInFrame(es, depth, command), command)
+}
+
+// expression is the call to the function in dontbug.c that runs command
+func runInDiversionSession(es *engineState, expression, command string) (string, error) {
+	resultChan := make(chan string, 1)
+	panicChan := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			r := recover()
+			if r != nil {
+				panicChan <- r
+			}
+		}()
+
+		resultChan <- xSlashSgdb(es.gdbSession, expression)
+	}()
+
+	// A timeout of 0 means wait forever (a nil channel never delivers)
+	var timeoutChan <-chan time.Time
+	timeout := time.Duration(es.featureMap["dontbug_diversion_timeout"].(*engineFeatureInt).value) * time.Millisecond
+	if timeout > 0 {
+		timeoutChan = time.After(timeout)
+	}
+
+	select {
+	case result := <-resultChan:
+		if GdbPrintElements > 0 && result != "" && !strings.HasSuffix(strings.TrimSpace(result), ">") {
+			return "", fmt.Errorf("The response was cut short at --gdb-print-elements %v characters. "+
+				"Raise --gdb-print-elements or lower max_data/max_children/max_depth in the IDE", GdbPrintElements)
+		}
+		return result, nil
+	case r := <-panicChan:
+		// e.g. the PHP interpreter crashed in the diversion session. Don't let it poison later commands
+		if !diversionSessionHealthy(es) && !recoverDiversionSession(es) {
+			return "", fmt.Errorf("Diversion session command failed: %v. The diversion session could not be recovered. Please restart the replay", r)
+		}
+		return "", fmt.Errorf("Diversion session command failed: %v", r)
+	case <-timeoutChan:
+		// As unwind-on-signal is on, gdb will pop the frame of the interrupted call
+		// i.e. we'll be back where we were before the command was run
+		logWarnf(color.FgYellow, "dontbug: Interrupting diversion session command as it did not complete in %v: %v", timeout, command)
+		fatalIf(es.gdbSession.Interrupt())
+
+		// The interrupted data-evaluate-expression will now complete with an error
+		select {
+		case <-resultChan:
+		case <-panicChan:
+		}
+
+		return "", fmt.Errorf("Evaluation did not complete in %v and was interrupted", timeout)
+	}
+}
+
+// We should always be able to read the PHP line number at the current replay point
+// gdb not answering in time counts as unhealthy too (instead of panicking like sendGdbCommand() would)
+func diversionSessionHealthy(es *engineState) bool {
+	_, ok := diversionSessionLineno(es)
+	return ok
+}
+
+func diversionSessionLineno(es *engineState) (string, bool) {
+	result, err := trySendGdbCommand(es.gdbSession, "data-evaluate-expression", "lineno")
+	if err != nil || result["class"] != "done" {
+		return "", false
+	}
+
+	payload, ok := result["payload"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+
+	lineno, ok := payload["value"].(string)
+	return lineno, ok
+}
+
+// The rr replay itself is unaffected by whatever happened in the diversion session. If gdb lost track of
+// it (e.g. it thinks the program exited) we simply connect to rr again which puts us back at the current replay point
+// Returns false if that did not work
+func recoverDiversionSession(es *engineState) bool {
+	logInfof(color.FgYellow, "dontbug: The diversion session is in a bad state. Reconnecting to rr at the current replay point")
+	result, err := trySendGdbCommand(es.gdbSession, "target-select", fmt.Sprintf("extended-remote :%v", es.gdbRemotePort))
+	if err != nil || result["class"] == "error" {
+		logErrorf(color.FgRed, "dontbug: Could not reconnect to rr (%v). Please restart the replay", gdbErrorMessage(result, err))
+		return false
+	}
+
+	// We should be back in the statement handler of dontbug.c where the replay stopped
+	lineno, ok := diversionSessionLineno(es)
+	if !ok {
+		logErrorf(color.FgRed, "dontbug: Reconnected to rr but the PHP line number can't be read. Please restart the replay")
+		return false
+	}
+
+	logInfof(color.FgGreen, "dontbug: Recovered the diversion session. Back at PHP line %v", lineno)
+	return true
+}
+
+func gdbErrorMessage(result map[string]interface{}, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	if payload, ok := result["payload"].(map[string]interface{}); ok {
+		if msg, ok := payload["msg"].(string); ok {
+			return msg
+		}
+	}
+
+	return fmt.Sprintf("%v", result)
+}
+
+// The features that are passed on to xdebug in the diversion session
+var gXdebugOptionFeatures = []string{"show_hidden", "max_children", "max_data", "max_depth", "extended_properties"}
+
+// Private, protected and internal members are only shown by xdebug if show_hidden is set. Similarly max_children,
+// max_data and max_depth limit how much of a value xdebug returns and extended_properties makes xdebug base64 encode
+// property names (and values) so that non-ASCII names survive
+// dontbug_xdebug_cmd_with_options() is only used when needed as older builds of dontbug.so (e.g. in snapshots) don't have it
+func diversionSessionExpression(es *engineState, setupCommand, command string) string {
+	if setupCommand == "" && !xdebugOptionFeaturesChanged(es) {
+		return fmt.Sprintf("dontbug_xdebug_cmd(\"%v\")", command)
+	}
+
+	return fmt.Sprintf("dontbug_xdebug_cmd_with_options(\"%v\", \"%v\", %v, %v, %v, %v, %v)",
+		setupCommand,
+		command,
+		es.featureMap["show_hidden"],
+		es.featureMap["max_children"],
+		es.featureMap["max_data"],
+		es.featureMap["max_depth"],
+		es.featureMap["extended_properties"])
+}
+
+// Like diversionSessionExpression() but for the PHP frame at depth
+func diversionSessionExpressionInFrame(es *engineState, depth int, command string) string {
+	if !xdebugOptionFeaturesChanged(es) {
+		return fmt.Sprintf("dontbug_xdebug_cmd_in_frame(\"%v\", %v)", command, depth)
+	}
+
+	return fmt.Sprintf("dontbug_xdebug_cmd_in_frame_with_options(\"%v\", %v, %v, %v, %v, %v, %v)",
+		command,
+		depth,
+		es.featureMap["show_hidden"],
+		es.featureMap["max_children"],
+		es.featureMap["max_data"],
+		es.featureMap["max_depth"],
+		es.featureMap["extended_properties"])
+}
+
+// Whether the IDE has changed any of the features that are passed on to xdebug
+func xdebugOptionFeaturesChanged(es *engineState) bool {
+	defaults := initFeatureMap()
+	for _, name := range gXdebugOptionFeatures {
+		if es.featureMap[name].String() != defaults[name].String() {
+			return true
+		}
+	}
+
+	return false
 }
 
 func recoverableDiversionSessionCmd(es *engineState, command string) string {
@@ -51,18 +234,108 @@ func recoverableDiversionSessionCmd(es *engineState, command string) string {
 		}
 	}()
 
-	return diversionSessionCmd(es, command)
+	result, err := diversionSessionCmd(es, command)
+	if err != nil {
+		return err.Error()
+	}
+
+	return result
 }
 
-func handleInDiversionSessionWithNoGdbBpts(es *engineState, dCmd dbgpCmd) string {
+func handleInDiversionSessionWithNoGdbBpts(es *engineState, dCmd dbgpCmd) (string, error) {
 	bpList := getEnabledPhpBreakpoints(es)
 	disableAllGdbBreakpoints(es)
-	result := diversionSessionCmd(es, dCmd.fullCommand)
-	enableGdbBreakpoints(es, bpList)
-	return result
+	defer enableGdbBreakpoints(es, bpList)
+
+	result, err := diversionSessionCmd(es, dCmd.fullCommand)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+	}
+
+	return result, nil
+}
+
+var gStackDepthOptionRegexp = regexp.MustCompile(`\s-d\s+\S+`)
+
+// For property_get and context_get
+// xdebug is not given the -d option (the stack depth of the frame). Instead the requested frame is made the innermost
+// one in the diversion session (see dontbug_xdebug_cmd_in_frame() in dontbug.c) so that locals, $this and properties
+// are read from that frame
+func handleInDiversionSessionAtStackDepth(es *engineState, dCmd dbgpCmd) (string, error) {
+	err := checkStackDepthOption(es, dCmd)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeStackDepthInvalid, "%v", err)
+	}
+
+	return handleInDiversionSessionInFrame(es, dCmd)
 }
 
-func handleRun(es *engineState, dCmd dbgpCmd) string {
+// The -d option of dCmd should have been checked with checkStackDepthOption()
+func handleInDiversionSessionInFrame(es *engineState, dCmd dbgpCmd) (string, error) {
+	depth, _ := strconv.Atoi(dCmd.options["d"])
+	if depth == 0 {
+		return handleInDiversionSessionWithNoGdbBpts(es, dCmd)
+	}
+
+	bpList := getEnabledPhpBreakpoints(es)
+	disableAllGdbBreakpoints(es)
+	defer enableGdbBreakpoints(es, bpList)
+
+	result, err := diversionSessionCmdInFrame(es, depth, gStackDepthOptionRegexp.ReplaceAllString(dCmd.fullCommand, ""))
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeEvalError, "%v", err)
+	}
+
+	if result == "" {
+		return "", newDbgpError(dbgpErrorCodeStackDepthInvalid, "There is no stack frame at depth %v", depth)
+	}
+
+	return result, nil
+}
+
+// A missing -d option means the innermost frame (depth 0) and is always fine
+func checkStackDepthOption(es *engineState, dCmd dbgpCmd) error {
+	d, ok := dCmd.options["d"]
+	if !ok {
+		return nil
+	}
+
+	depth, err := strconv.Atoi(d)
+	if err != nil || depth < 0 {
+		return fmt.Errorf("Invalid stack depth: %v", d)
+	}
+
+	if depth >= es.maxStackDepth {
+		return fmt.Errorf("Stack depth %v exceeds the max stack depth of %v", depth, es.maxStackDepth)
+	}
+
+	frames, err := currentStackFrames(es)
+	if err != nil {
+		return err
+	}
+
+	if depth >= frames {
+		return fmt.Errorf("Stack depth %v is invalid. There are only %v stack frame(s)", depth, frames)
+	}
+
+	return nil
+}
+
+// There are as many frames as the current PHP stack level (but always at least one)
+func currentStackFrames(es *engineState) (int, error) {
+	frames, err := tryXSlashDgdb(es.gdbSession, "level")
+	if err != nil {
+		return 0, err
+	}
+
+	if frames < 1 {
+		frames = 1
+	}
+
+	return frames, nil
+}
+
+func handleRun(es *engineState, dCmd dbgpCmd) (string, error) {
 	// Don't hit a breakpoint on your (own) line
 	if dCmd.reverse {
 		bpList := getEnabledPhpBreakpoints(es)
@@ -74,6 +347,9 @@ func handleRun(es *engineState, dCmd dbgpCmd) string {
 
 	// Resume execution, either forwards or backwards
 	_, userBreakPointHit := continueExecution(es, dCmd.reverse)
+	if es.programExit != nil {
+		return programExitResponse(es, dCmd), nil
+	}
 
 	if userBreakPointHit {
 		bpList := getEnabledPhpBreakpoints(es)
@@ -82,27 +358,179 @@ func handleRun(es *engineState, dCmd dbgpCmd) string {
 			gotoMasterBpLocation(es, false)
 		} else {
 			// After you hit the php breakpoint, step over backwards.
-			currentPhpStackLevel := xSlashDgdb(es.gdbSession, "level")
-			id := setPhpStackDepthLevelBreakpointInGdb(es, currentPhpStackLevel)
-			continueExecution(es, true)
-			removeGdbBreakpoint(es, id)
+			// If that is not possible we simply stay at the user breakpoint
+			currentPhpStackLevel, err := tryXSlashDgdb(es.gdbSession, "level")
+			if err != nil {
+				enableGdbBreakpoints(es, bpList)
+				return "", err
+			}
+
+			id, err := setPhpStackDepthLevelBreakpointInGdb(es, currentPhpStackLevel)
+			if err == nil {
+				continueExecution(es, true)
+				removeGdbBreakpoint(es, id)
+			}
 
 			// Note that we move in the forward direction even though we are in the reverse case
 			gotoMasterBpLocation(es, false)
 		}
 
-		filename := xSlashSgdb(es.gdbSession, "filename")
-		phpLineno := xSlashDgdb(es.gdbSession, "lineno")
-
 		enableGdbBreakpoints(es, bpList)
 
-		return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, "run", dCmd.seqNum, filename, phpLineno)
+		filename, err := tryXSlashSgdb(es.gdbSession, "filename")
+		if err != nil {
+			return "", err
+		}
+
+		phpLineno, err := tryXSlashDgdb(es.gdbSession, "lineno")
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, "run", dCmd.seqNum, filename, phpLineno, watchesXML(es)), nil
 	}
 
-	panicWith("Unimplemented program end handling")
-	return ""
+	return "", errors.New("Unimplemented program end handling")
 }
 
-func handleStatus(es *engineState, dCmd dbgpCmd) string {
-	return fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, es.status, es.reason)
+// The response to a run/step command that ended up at the end of the execution
+func programExitResponse(es *engineState, dCmd dbgpCmd) string {
+	exit := es.programExit
+	return fmt.Sprintf(gProgramExitXMLResponseFormat, dCmd.command, dCmd.seqNum, exit.reason(), exit.code, exit.signal, html.EscapeString(exit.String()))
+}
+
+func handleStatus(es *engineState, dCmd dbgpCmd) (string, error) {
+	// Watches can only be evaluated when we're not in the middle of a continuation
+	status, reason := getStatus(es)
+	extensions := ""
+	if status == statusBreak {
+		extensions = watchesXML(es)
+		if es.featureMap["dontbug_status_position"].String() == "1" {
+			extensions += positionXML(es)
+		}
+	}
+
+	return fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, status, reason, extensions), nil
+}
+
+// Wraps a continuation command (run, step_into etc.) so that it is refused with a dbgp error while
+// another continuation is still in progress instead of issuing a second exec-continue to gdb
+// This can happen when the IDE sends commands back to back or when dbgp commands are dispatched
+// from more than one goroutine (e.g. via ReplaySession)
+func guardContinuation(handler dbgpCmdHandler) dbgpCmdHandler {
+	return func(es *engineState, dCmd dbgpCmd) (response string, err error) {
+		if !startContinuation(es) {
+			return "", newDbgpError(dbgpErrorCodeCommandNotAvailable, "Last continuation not yet complete")
+		}
+		defer endContinuation(es, &err)
+
+		return handler(es, dCmd)
+	}
+}
+
+// These commands don't need gdb (or the diversion session) and are answered right away even while
+// a continuation is in progress
+var gCommandsAnsweredWhileRunning = map[string]bool{
+	"feature_get": true,
+	"feature_set": true,
+	"status":      true,
+	"stop":        true,
+	"detach":      true,
+}
+
+// How long an IDE command waits for a continuation (e.g. a g or c from the (dontbug) prompt) to complete
+const continuationWaitTimeout = 30 * time.Second
+
+// Waits (without polling) up to timeout for the continuation or IDE command that holds the engine to end
+// If hold, the engine is then held by the caller till releaseEngine() so that no continuation can start meanwhile
+// Returns false on a timeout
+func waitForEngine(es *engineState, timeout time.Duration, hold bool) bool {
+	deadline := time.After(timeout)
+	for {
+		es.statusMutex.Lock()
+		released := es.engineReleased
+		if released == nil && hold {
+			es.engineReleased = make(chan struct{})
+		}
+		es.statusMutex.Unlock()
+
+		if released == nil {
+			return true
+		}
+
+		select {
+		case <-released:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func releaseEngine(es *engineState) {
+	es.statusMutex.Lock()
+	close(es.engineReleased)
+	es.engineReleased = nil
+	es.statusMutex.Unlock()
+}
+
+// Returns false if another continuation (or an IDE command, see waitForEngine()) is still in progress
+// The status is running for the whole continuation, even though it may involve several stops internally
+func startContinuation(es *engineState) bool {
+	es.statusMutex.Lock()
+	if es.engineReleased != nil {
+		es.statusMutex.Unlock()
+		return false
+	}
+	es.engineReleased = make(chan struct{})
+	es.status = statusRunning
+	es.reason = reasonOk
+	es.statusMutex.Unlock()
+
+	emitStatusEvent(statusRunning, reasonOk)
+	forgetEvalResults(es)
+	return true
+}
+
+// To be deferred right after a successful startContinuation() with a pointer to the error result of the continuation
+// We're either at a break or at the end of the execution (from where we can still run in reverse). A continuation
+// that failed leaves us at a break with the error reason and one that panicked (e.g. rr exited) is stopping
+// The panic is passed on, except for a gdb timeout which becomes the error of the continuation (see recoverGdbTimeout())
+// If the status was changed during the continuation (e.g. by stop) it is left alone
+func endContinuation(es *engineState, errPtr *error) {
+	r := recover()
+	if timeoutErr, ok := r.(*gdbTimeoutError); ok {
+		*errPtr = timeoutErr
+		r = nil
+	}
+
+	status, reason := statusBreak, reasonOk
+	if r != nil {
+		status, reason = statusStopping, reasonError
+	} else if es.programExit != nil {
+		status, reason = statusStopping, es.programExit.reason()
+	} else if *errPtr != nil {
+		reason = reasonError
+	}
+
+	if r == nil {
+		emitStopEvent(es)
+	}
+
+	es.statusMutex.Lock()
+	running := es.status == statusRunning
+	if running {
+		es.status = status
+		es.reason = reason
+	}
+	close(es.engineReleased)
+	es.engineReleased = nil
+	es.statusMutex.Unlock()
+
+	if running {
+		emitStatusEvent(status, reason)
+	}
+
+	if r != nil {
+		panic(r)
+	}
 }
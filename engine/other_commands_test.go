@@ -0,0 +1,206 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackToBackRunCommands(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0, 3, 0, 4, 0)...)
+	defer f.close()
+
+	mustSetBreakpoint(t, es, "file:///a.php", 2)
+	mustSetBreakpoint(t, es, "file:///a.php", 4)
+
+	// The second run arrives while gdb is still running the first one
+	var secondErr error
+	f.onContinue = func() {
+		f.onContinue = nil
+		dCmd := parseCommand("run -i 6", false)
+		_, secondErr = gDbgpCmdHandlers["run"](es, dCmd)
+	}
+
+	mustHandle(t, es, "run -i 5")
+	dbgpErr, ok := secondErr.(*dbgpError)
+	if !ok || dbgpErr.code != dbgpErrorCodeCommandNotAvailable {
+		t.Fatalf("A run during another run should be refused with code %v. Got: %v", dbgpErrorCodeCommandNotAvailable, secondErr)
+	}
+	if location := f.location(); location != "file:///a.php:2" {
+		t.Fatalf("The first run stopped at %v instead of file:///a.php:2", location)
+	}
+	if status, _ := getStatus(es); status != statusBreak {
+		t.Fatalf("Status after the first run is %v instead of %v", status, statusBreak)
+	}
+
+	// Once the first run is over the next one goes through
+	mustHandle(t, es, "run -i 7")
+	if location := f.location(); location != "file:///a.php:4" {
+		t.Errorf("The run after the refused one stopped at %v instead of file:///a.php:4", location)
+	}
+}
+
+// main() in a.php calls f() in b.php so there are two PHP frames at b.php:10
+func TestPropertyGetAtStackDepth(t *testing.T) {
+	es, f := newFakeReplay(t, fakeStatement{"file:///a.php", 2, 1}, fakeStatement{"file:///b.php", 10, 2})
+	defer f.close()
+	fakeGoto(t, es, f, "file:///b.php:10")
+
+	var evaluated []string
+	f.evaluate = func(expression string) (string, bool) {
+		evaluated = append(evaluated, expression)
+		return fakeGdbString(`<response command="property_get"><property name="$x"></property></response>`), true
+	}
+
+	mustHandle(t, es, "property_get -i 5 -d 1 -n $x")
+	expected := `dontbug_xdebug_cmd_in_frame("property_get -i 5 -n $x", 1)`
+	if len(evaluated) != 1 || evaluated[0] != expected {
+		t.Errorf("property_get -d 1 should be run in the caller's frame with %v. Evaluated: %v", expected, evaluated)
+	}
+
+	evaluated = nil
+	mustHandle(t, es, "property_get -i 6 -d 0 -n $x")
+	if len(evaluated) != 1 || evaluated[0] != `dontbug_xdebug_cmd("property_get -i 6 -d 0 -n $x")` {
+		t.Errorf("property_get -d 0 should be run in the innermost frame. Evaluated: %v", evaluated)
+	}
+
+	evaluated = nil
+	dCmd := parseCommand("property_get -i 7 -d 2 -n $x", false)
+	_, err := handlePropertyGet(es, dCmd)
+	dbgpErr, ok := err.(*dbgpError)
+	if !ok || dbgpErr.code != dbgpErrorCodeStackDepthInvalid {
+		t.Errorf("property_get -d 2 with two frames should fail with code %v. Got: %v", dbgpErrorCodeStackDepthInvalid, err)
+	}
+	if len(evaluated) != 0 {
+		t.Errorf("Nothing should be run for an invalid stack depth. Evaluated: %v", evaluated)
+	}
+}
+
+func TestEndContinuationStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        dbgpCmdHandler
+		expectedStatus engineStatus
+		expectedReason engineReason
+	}{
+		{"break", func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return "", nil
+		}, statusBreak, reasonOk},
+		{"end of execution", func(es *engineState, dCmd dbgpCmd) (string, error) {
+			es.programExit = &programExit{signal: "SIGSEGV"}
+			return "", nil
+		}, statusStopping, reasonAborted},
+		{"error", func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return "", errors.New("Could not step")
+		}, statusBreak, reasonError},
+		{"panic", func(es *engineState, dCmd dbgpCmd) (string, error) {
+			panicWith("rr exited while running forward")
+			return "", nil
+		}, statusStopping, reasonError},
+		{"stopped meanwhile", func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return handleStop(es, dCmd)
+		}, statusStopped, reasonOk},
+	}
+
+	for _, test := range tests {
+		es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+		var recovered interface{}
+		func() {
+			defer func() {
+				recovered = recover()
+			}()
+			guardContinuation(test.handler)(es, parseCommand("run -i 1", false))
+		}()
+		f.close()
+
+		if (recovered != nil) != (test.name == "panic") {
+			t.Errorf("%v: the panic of the continuation should be passed on (and only then). Recovered: %v", test.name, recovered)
+		}
+
+		status, reason := getStatus(es)
+		if status != test.expectedStatus || reason != test.expectedReason {
+			t.Errorf("%v: status %v (%v) instead of %v (%v)", test.name, status, reason, test.expectedStatus, test.expectedReason)
+		}
+	}
+}
+
+func TestBreakpointSetWaitsForContinuation(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0, 2, 0)...)
+	defer f.close()
+
+	// Right after connecting
+	response := dispatchMappedIdeRequest(es, "breakpoint_set -i 1 -t line -f file:///a.php -n 2", false)
+	if !gFakeResponseIDRegexp.MatchString(response) {
+		t.Fatalf("breakpoint_set right after connecting failed: %v", response)
+	}
+
+	// As if a c was typed at the (dontbug) prompt
+	if !startContinuation(es) {
+		t.Fatal("Could not start a continuation")
+	}
+	done := make(chan string)
+	go func() {
+		done <- dispatchMappedIdeRequest(es, "breakpoint_set -i 2 -t line -f file:///a.php -n 1", false)
+	}()
+
+	select {
+	case response = <-done:
+		t.Fatalf("breakpoint_set did not wait for the continuation to end: %v", response)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var err error
+	endContinuation(es, &err)
+	select {
+	case response = <-done:
+		if !gFakeResponseIDRegexp.MatchString(response) || strings.Contains(response, "<error") {
+			t.Errorf("breakpoint_set after the continuation failed: %v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("breakpoint_set still waiting after the continuation ended")
+	}
+
+	if !startContinuation(es) {
+		t.Error("The engine was not released after breakpoint_set")
+	}
+}
+
+func TestStatusPositionOnlyWhenOptedIn(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	var consoleCommands []string
+	f.console = func(command string) (string, bool) {
+		consoleCommands = append(consoleCommands, command)
+		if command == "when" {
+			return "Current event: 42\n", true
+		}
+		return "Current tick: 1234\n", true
+	}
+
+	response := mustHandle(t, es, "status -i 1")
+	if strings.Contains(response, "dontbug:position") || len(consoleCommands) != 0 {
+		t.Errorf("No position without dontbug_status_position. Got: %v (console commands: %v)", response, consoleCommands)
+	}
+
+	mustHandle(t, es, "feature_set -i 2 -n dontbug_status_position -v 1")
+	response = mustHandle(t, es, "status -i 3")
+	if !strings.Contains(response, `<dontbug:position xmlns:dontbug="https://github.com/sidkshatriya/dontbug" event="42" ticks="1234"/>`) {
+		t.Errorf("Expected the position with dontbug_status_position. Got: %v", response)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathMapping maps a directory as the IDE sees it to the same directory as it was recorded
+// e.g. the PHP sources are at /home/user/site on the host but were recorded at /var/www/site in a container
+type PathMapping struct {
+	IdePath      string
+	RecordedPath string
+}
+
+// PathMappings is like xdebug's pathMappings. The longest matching prefix wins
+var PathMappings []PathMapping
+
+// Only file paths in these commands are mapped. Paths in other commands (e.g. in an eval) are left alone
+var gPathMappedCommands = map[string]bool{
+	"breakpoint_set": true,
+	"source":         true,
+}
+
+var (
+	gFileOptionRegexp    = regexp.MustCompile(`(\s-f\s+)(\S+)`)
+	gFileAttributeRegexp = regexp.MustCompile(`\b(filename|fileuri)="(file://[^"]*)"`)
+)
+
+// ParsePathMapping parses a mapping of the form <ide-path>=<recorded-path>
+func ParsePathMapping(mapping string) (PathMapping, error) {
+	parts := strings.SplitN(mapping, "=", 2)
+	if len(parts) != 2 || !path.IsAbs(parts[0]) || !path.IsAbs(parts[1]) {
+		return PathMapping{}, fmt.Errorf("Path mapping should be of the form /ide/path=/recorded/path. Got: %v", mapping)
+	}
+
+	return PathMapping{path.Clean(parts[0]), path.Clean(parts[1])}, nil
+}
+
+// Maps the -f option of the IDE commands that carry a file path
+func mapIdeCommand(fullCommand string) string {
+	if len(PathMappings) == 0 || !gPathMappedCommands[strings.SplitN(fullCommand, " ", 2)[0]] {
+		return fullCommand
+	}
+
+	return gFileOptionRegexp.ReplaceAllStringFunc(fullCommand, func(option string) string {
+		matches := gFileOptionRegexp.FindStringSubmatch(option)
+		return matches[1] + mapIdeToRecorded(matches[2])
+	})
+}
+
+// Maps the filename="file://..." and fileuri="file://..." attributes in a response to the IDE back to IDE paths
+func mapRecordedResponse(payload string) string {
+	if len(PathMappings) == 0 {
+		return payload
+	}
+
+	return gFileAttributeRegexp.ReplaceAllStringFunc(payload, func(attribute string) string {
+		matches := gFileAttributeRegexp.FindStringSubmatch(attribute)
+		return fmt.Sprintf(`%v="%v"`, matches[1], mapRecordedToIde(matches[2]))
+	})
+}
+
+func mapIdeToRecorded(filename string) string {
+	return mapPath(normalizeIdeFilename(filename), func(m PathMapping) (string, string) {
+		return m.IdePath, m.RecordedPath
+	})
+}
+
+func mapRecordedToIde(filename string) string {
+	return mapPath(filename, func(m PathMapping) (string, string) {
+		return m.RecordedPath, m.IdePath
+	})
+}
+
+// filename can be a file:// URI or a plain path. Prefixes only match whole path components
+func mapPath(filename string, direction func(PathMapping) (string, string)) string {
+	scheme := ""
+	if strings.HasPrefix(filename, "file://") {
+		scheme = "file://"
+	}
+	filePath := filename[len(scheme):]
+
+	bestFrom, bestTo := "", ""
+	for _, mapping := range PathMappings {
+		from, to := direction(mapping)
+		if len(from) <= len(bestFrom) {
+			continue
+		}
+
+		if filePath == from || strings.HasPrefix(filePath, strings.TrimSuffix(from, "/")+"/") {
+			bestFrom, bestTo = from, to
+		}
+	}
+
+	if bestFrom == "" {
+		return filename
+	}
+
+	return scheme + path.Join(bestTo, filePath[len(bestFrom):])
+}
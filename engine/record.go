@@ -18,6 +18,9 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/kr/pty"
@@ -31,8 +34,12 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -52,11 +59,48 @@ It seems you are using the plain vanilla version of Xdebug. Consult documentatio
 `
 )
 
-func getOrCreateDontbugSharePath() string {
+// RecordOpcodeStepping makes the recording support opcode granularity stepping (the dontbug_step_granularity feature)
+// This installs an opcode handler in PHP which slows down the recording so it is off by default
+var RecordOpcodeStepping bool
+
+var gHomeDirWarning sync.Once
+
+// user.Current() can fail e.g. in a minimal container without a passwd entry for the user or in a static
+// binary built without cgo. Fall back to $HOME and, as a last resort, the temp dir instead of giving up
+func getHomeDir() string {
 	currentUser, err := user.Current()
-	fatalIf(err)
+	if err == nil && currentUser.HomeDir != "" {
+		return currentUser.HomeDir
+	}
+
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+
+	tempDir := os.TempDir()
+	gHomeDirWarning.Do(func() {
+		logWarnf(color.FgYellow, "dontbug: Could not determine your home directory (%v). Using %v instead", err, tempDir)
+	})
+
+	return tempDir
+}
+
+// Where dontbug keeps its own state e.g. source snapshots, copies of dontbug.so and the prompt history
+// $DONTBUG_HOME if set, else $XDG_DATA_HOME/dontbug and finally ~/.local/share/dontbug. Always ends in /
+func getDontbugHome() string {
+	if dontbugHome := os.Getenv("DONTBUG_HOME"); dontbugHome != "" {
+		return path.Clean(dontbugHome) + "/"
+	}
 
-	dontbugShareDir := currentUser.HomeDir + "/.local/share/dontbug/"
+	if xdgDataHome := os.Getenv("XDG_DATA_HOME"); xdgDataHome != "" {
+		return path.Clean(xdgDataHome) + "/dontbug/"
+	}
+
+	return path.Clean(getHomeDir()) + "/.local/share/dontbug/"
+}
+
+func getOrCreateDontbugSharePath() string {
+	dontbugShareDir := getDontbugHome()
 	mkDirAll(dontbugShareDir)
 
 	return dontbugShareDir
@@ -84,12 +128,16 @@ func doRecordSession(
 	isCli bool,
 	arguments,
 	serverListen string,
-	serverPort,
+	serverPort int,
+	recordHost string,
 	recordPort,
 	maxStackDepth int,
 	takeSnapshot bool,
+	snapshotName,
 	snapShotDir string,
 	originalDocrootOrScriptFullPath string,
+	openBrowser bool,
+	stdinFile string,
 ) {
 	newSharedObjectPath := sharedObjectPath
 	if takeSnapshot {
@@ -97,51 +145,61 @@ func doRecordSession(
 		newSharedObjectPath = copyAndMakeUniqueDontbugSo(sharedObjectPath, dontbugShareDir)
 	}
 
-	// Many of these options are not really necessary to be specified.
-	// However, we still do that to override any settings that
-	// might be present in user php.ini files and change them
-	// to sensible defaults for 'dontbug record'
-	rrCmd := []string{
-		"record",
+	rrCmd := recordCommandArgs(
+		docrootOrScriptAbsNoSymPath,
+		newSharedObjectPath,
 		phpPath,
-		"-d", "zend_extension=" + newSharedObjectPath,
-		"-d", fmt.Sprintf("xdebug.remote_port=%v", recordPort),
-		"-d", "xdebug.remote_autostart=1",
-		"-d", "xdebug.remote_host=\"127.0.0.1\"",
-		"-d", "xdebug.remote_connect_back=0",
-		"-d", "xdebug.remote_enable=1",
-		"-d", "xdebug.remote_mode=req",
-		"-d", "xdebug.auto_trace=0",
-		"-d", "xdebug.trace_enable_trigger=\"\"",
-		"-d", "xdebug.coverage_enable=0",
-		"-d", "xdebug.extended_info=1",
-		"-d", fmt.Sprintf("xdebug.max_nesting_level=%v", maxStackDepth),
-		"-d", "xdebug.profiler_enable=0",
-		"-d", "xdebug.profiler_enable_trigger=0",
+		isCli,
+		arguments,
+		serverListen,
+		serverPort,
+		recordHost,
+		recordPort,
+		maxStackDepth,
+	)
+
+	if !isCli {
+		printServerURLs(serverListen, serverPort)
+		if openBrowser {
+			go openBrowserWhenListening(serverListen, serverPort)
+		}
 	}
 
-	if isCli {
-		arguments = strings.TrimSpace(arguments)
-		rrCmd = append(rrCmd, docrootOrScriptAbsNoSymPath)
-		if arguments != "" {
-			argumentsAr := strings.Split(arguments, " ")
-			rrCmd = append(rrCmd, argumentsAr...)
+	rrTraceDir := runRRRecording(rrPath, rrCmd, stdinFile)
+	if rrTraceDir == "" {
+		// Older versions of rr don't say where the trace is saved
+		rrTraceDir, _ = filepath.EvalSymlinks(getRRTraceHome() + "/latest-trace")
+	}
+	if rrTraceDir != "" {
+		logInfof(color.FgGreen, "\ndontbug: rr trace saved to: %v", rrTraceDir)
+		saveBreakFileWithTrace(path.Dir(path.Dir(sharedObjectPath)), rrTraceDir)
+	}
+	reportRecordUntil()
+
+	if takeSnapshot {
+		if rrTraceDir == "" {
+			log.Fatal("Could not detect rr trace dir location")
+		}
+		createSnapshotMetadata(rrTraceDir, snapshotName, snapShotDir, originalDocrootOrScriptFullPath, append([]string{rrPath}, rrCmd...), phpPath)
+		if snapshotName != "" {
+			logInfof(color.FgGreen, "dontbug: Saved snapshot %v. Replay it with: dontbug replay --snapshot %v", snapshotName, snapshotName)
 		}
-	} else {
-		rrCmd = append(
-			rrCmd,
-			"-S", fmt.Sprintf("%v:%v", serverListen, serverPort),
-			"-t", docrootOrScriptAbsNoSymPath)
 	}
+	logInfof(color.FgGreen, "\ndontbug: Closed cleanly. Replay should work properly")
+}
 
+// Runs rr record with rrCmd and waits for the recording to end
+// If stdinFile is not "" its contents are the stdin of the recorded process (e.g. answers to the prompts of a PHP script)
+// Returns the rr trace directory or "" if it could not be detected
+func runRRRecording(rrPath string, rrCmd []string, stdinFile string) string {
 	Verboseln("dontbug: Issuing command: rr", strings.Join(rrCmd, " "))
 	recordSession := exec.Command(rrPath, rrCmd...)
 
-	f, err := pty.Start(recordSession)
+	f, err := startRecordSession(recordSession, stdinFile)
 	fatalIf(err)
 
-	color.Yellow("dontbug: -- Recording. Ctrl-C to terminate recording if running on the PHP built-in webserver")
-	color.Yellow("dontbug: -- Recording. Ctrl-C if running a script or simply wait for it to end")
+	logInfof(color.FgYellow, "dontbug: -- Recording. Ctrl-C to terminate recording if running on the PHP built-in webserver")
+	logInfof(color.FgYellow, "dontbug: -- Recording. Ctrl-C if running a script or simply wait for it to end")
 
 	rrTraceDir := ""
 	go func() {
@@ -197,9 +255,18 @@ func doRecordSession(
 
 	signal.Notify(c, os.Interrupt) // Ctrl+C
 	go func() {
-		<-c
-		color.Yellow("dontbug: Sending a Ctrl + C to recording")
-		f.Write([]byte{3}) // Ctrl+C is ASCII code 3
+		// --record-until stops the recording just like a Ctrl+C would
+		select {
+		case <-c:
+		case <-gRecordUntil.reached:
+		}
+		logInfof(color.FgYellow, "dontbug: Sending a Ctrl + C to recording")
+		if stdinFile != "" {
+			// There is no controlling terminal to turn a Ctrl+C into a SIGINT
+			recordSession.Process.Signal(os.Interrupt)
+		} else {
+			f.Write([]byte{3}) // Ctrl+C is ASCII code 3
+		}
 	}()
 
 	err = recordSession.Wait()
@@ -207,68 +274,384 @@ func doRecordSession(
 		fmt.Println(err)
 	}
 
-	if takeSnapshot {
-		if rrTraceDir == "" {
-			log.Fatal("Could not detect rr trace dir location")
+	return rrTraceDir
+}
+
+// The output of the recording always goes to a pty so that PHP and rr behave like they would in a terminal
+// When stdinFile is given, the recorded process reads it instead of the pty. A script that reads stdin sees
+// EOF once the file is exhausted, just as it would with 'php script.php < file'
+func startRecordSession(recordSession *exec.Cmd, stdinFile string) (*os.File, error) {
+	if stdinFile == "" {
+		return pty.Start(recordSession)
+	}
+
+	in, err := os.Open(stdinFile)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	recordSession.Stdin = in
+	recordSession.Stdout = tty
+	recordSession.Stderr = tty
+	recordSession.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = recordSession.Start()
+	if err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+
+	return ptmx, nil
+}
+
+// The arguments to rr for recording PHP
+func recordCommandArgs(
+	docrootOrScriptAbsNoSymPath,
+	sharedObjectPath,
+	phpPath string,
+	isCli bool,
+	arguments,
+	serverListen string,
+	serverPort int,
+	recordHost string,
+	recordPort,
+	maxStackDepth int,
+) []string {
+	rrCmd := append([]string{"record", phpPath}, phpIniOverrideArgs(sharedObjectPath, recordHost, recordPort, maxStackDepth)...)
+
+	if isCli {
+		arguments = strings.TrimSpace(arguments)
+		rrCmd = append(rrCmd, docrootOrScriptAbsNoSymPath)
+		if arguments != "" {
+			argumentsAr := strings.Split(arguments, " ")
+			rrCmd = append(rrCmd, argumentsAr...)
 		}
-		createSnapshotMetadata(rrTraceDir, snapShotDir, originalDocrootOrScriptFullPath)
+	} else {
+		rrCmd = append(
+			rrCmd,
+			"-S", fmt.Sprintf("%v:%v", serverListen, serverPort),
+			"-t", docrootOrScriptAbsNoSymPath)
 	}
-	color.Green("\ndontbug: Closed cleanly. Replay should work properly")
+
+	return rrCmd
 }
 
-func createSnapshotMetadata(rrTraceDir, snapShotDir string, originalDocrootOrScriptFullPath string) {
-	fileData := []byte(snapShotDir + ":" + originalDocrootOrScriptFullPath)
+// The PHP ini settings needed for recording. These work for php-fpm too
+func phpIniOverrideArgs(sharedObjectPath string, recordHost string, recordPort, maxStackDepth int) []string {
+	opcodeStepping := 0
+	if RecordOpcodeStepping {
+		opcodeStepping = 1
+	}
+
+	// Many of these options are not really necessary to be specified.
+	// However, we still do that to override any settings that
+	// might be present in user php.ini files and change them
+	// to sensible defaults for 'dontbug record'
+	return []string{
+		"-d", "zend_extension=" + sharedObjectPath,
+		"-d", fmt.Sprintf("xdebug.remote_port=%v", recordPort),
+		"-d", "xdebug.remote_autostart=1",
+		"-d", fmt.Sprintf("xdebug.remote_host=\"%v\"", recordHost),
+		"-d", "xdebug.remote_connect_back=0",
+		"-d", "xdebug.remote_enable=1",
+		"-d", "xdebug.remote_mode=req",
+		"-d", "xdebug.auto_trace=0",
+		"-d", "xdebug.trace_enable_trigger=\"\"",
+		"-d", "xdebug.coverage_enable=0",
+		"-d", "xdebug.extended_info=1",
+		"-d", fmt.Sprintf("xdebug.max_nesting_level=%v", maxStackDepth),
+		"-d", "xdebug.profiler_enable=0",
+		"-d", "xdebug.profiler_enable_trigger=0",
+		"-d", fmt.Sprintf("dontbug.opcode_stepping=%v", opcodeStepping),
+	}
+}
+
+// Stored as JSON in the dontbug-snapshot-metadata file of the rr trace directory
+// Older versions of dontbug simply stored "rootDir:origDocrootOrScript" in that file
+type snapshotMetadata struct {
+	Name                string    `json:"name,omitempty"` // Only for snapshots recorded with --snapshot-name
+	RootDir             string    `json:"root_dir"`
+	OrigDocrootOrScript string    `json:"orig_docroot_or_script"`
+	RRCommand           []string  `json:"rr_command,omitempty"`
+	PhpVersion          string    `json:"php_version,omitempty"`
+	Timestamp           time.Time `json:"timestamp"`
+	// Only for imported snapshots: where the PHP sources were when recorded (as the rr trace refers to those paths)
+	OriginalRootDir string `json:"original_root_dir,omitempty"`
+}
+
+func createSnapshotMetadata(rrTraceDir, snapshotName, snapShotDir string, originalDocrootOrScriptFullPath string, rrCommand []string, phpPath string) {
+	// Not fatal, the snapshot is still usable without this
+	phpVersion, err := getVersionLine(phpPath)
+	if err != nil {
+		Verbosef("dontbug: Could not determine PHP version for snapshot metadata: %v\n", err)
+	}
+
+	metaData := snapshotMetadata{
+		Name:                snapshotName,
+		RootDir:             snapShotDir,
+		OrigDocrootOrScript: originalDocrootOrScriptFullPath,
+		RRCommand:           rrCommand,
+		PhpVersion:          phpVersion,
+		Timestamp:           time.Now(),
+	}
+
+	fileData, err := json.MarshalIndent(metaData, "", "  ")
+	fatalIf(err)
+
 	metaDataFilename := rrTraceDir + "/dontbug-snapshot-metadata"
-	err := ioutil.WriteFile(metaDataFilename, fileData, 0700)
+	err = ioutil.WriteFile(metaDataFilename, fileData, 0700)
 	if err != nil {
 		log.Fatalf("Could not write to %v\n", metaDataFilename)
 	}
 }
 
+func parseSnapshotMetadata(data []byte) (snapshotMetadata, error) {
+	var metaData snapshotMetadata
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		err := json.Unmarshal(data, &metaData)
+		return metaData, err
+	}
+
+	// The old two field format
+	fields := strings.SplitN(trimmed, ":", 2)
+	if len(fields) != 2 {
+		return metaData, fmt.Errorf("Unknown snapshot metadata format: %v", trimmed)
+	}
+
+	metaData.RootDir = fields[0]
+	metaData.OrigDocrootOrScript = fields[1]
+	return metaData, nil
+}
+
 // Here we're basically serving the role of an PHP debugger in an IDE
-func startBasicDebuggerClient(recordPort int) {
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", recordPort))
+// Xdebug connects once per PHP request (e.g. the built-in server can serve several requests during a recording)
+// Each connection is one recorded request and is simply run to completion
+func startBasicDebuggerClient(listenHost, clientHost string, recordPort int) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(recordPort)))
 	fatalIf(err)
 
-	Verbosef("Started debug client for recording at 127.0.0.1:%v\n", recordPort)
+	Verbosef("Started debug client for recording at %v\n", net.JoinHostPort(listenHost, strconv.Itoa(recordPort)))
+	checkDbgpListenerReachable(listener, clientHost, recordPort)
+	listActiveRequestsOnSignal()
 	go func() {
+		requestNum := 0
 		for {
 			conn, err := listener.Accept()
 			fatalIf(err)
 
-			go func(conn net.Conn) {
-				buf := make([]byte, 2048)
-				seq := 0
-				for {
-					bytesRead, _ := conn.Read(buf)
-					if bytesRead <= 0 {
-						return
-					}
-
-					nullAt := bytes.IndexByte(buf, byte(0))
-					if nullAt == -1 {
-						log.Fatal("Could not find length in debugger engine response")
-					}
-
-					dataLen, err := strconv.Atoi(string(buf[0:nullAt]))
-					fatalIf(err)
-
-					bytesLeft := dataLen - (bytesRead - nullAt - 2)
-					if bytesLeft != 0 {
-						log.Fatal("There are still some bytes left to receive -- strange")
-					}
-
-					seq++
-
-					// Keep running until we are able to record the execution
-					runCommand := fmt.Sprintf("run -i %d\x00", seq)
-					conn.Write([]byte(runCommand))
-				}
-			}(conn)
+			requestNum++
+			go runRecordedRequestSerially(conn, requestNum)
 		}
 	}()
 }
 
+// Connect to the listener the way PHP will (at clientHost) so that a listener PHP can't reach is found
+// out now rather than by a recording in which nothing happens
+func checkDbgpListenerReachable(listener net.Listener, clientHost string, recordPort int) {
+	address := net.JoinHostPort(clientHost, strconv.Itoa(recordPort))
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		log.Fatalf("PHP would not be able to reach the dbgp listener at %v: %v. Please check --dbgp-listen", address, err)
+	}
+	conn.Close()
+
+	// So that this connection is not taken to be a PHP request
+	accepted, err := listener.Accept()
+	fatalIf(err)
+	accepted.Close()
+}
+
+const dbgpTranscriptMaxLen = 300
+
+var gFileURIRegexp = regexp.MustCompile(`fileuri="([^"]*)"`)
+
+// Only one recorded request is run at a time. Any other connection waits for its turn
+var gRecordingTurn = make(chan bool, 1)
+
+// Concurrent requests (e.g. parallel connections from a browser) are not supported during record. They are queued
+func runRecordedRequestSerially(conn net.Conn, requestNum int) {
+	select {
+	case gRecordingTurn <- true:
+	default:
+		logWarnf(color.FgYellow, "dontbug: Request #%v is queued till the request being recorded finishes. "+
+			"Concurrent requests are not supported during record", requestNum)
+		gRecordingTurn <- true
+	}
+	defer func() {
+		<-gRecordingTurn
+	}()
+
+	runRecordedRequest(conn, requestNum)
+}
+
+// Keeps sending run to Xdebug until the PHP request completes i.e. Xdebug closes the connection
+func runRecordedRequest(conn net.Conn, requestNum int) {
+	defer conn.Close()
+
+	buf := bufio.NewReader(conn)
+	fileURI := ""
+	seq := 0
+	stopping := false
+	for {
+		packet, err := readDbgpPacket(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logWarnf(color.FgYellow, "dontbug: Request #%v: %v", requestNum, err)
+			break
+		}
+		logDbgpTranscript(color.FgCyan, fmt.Sprintf("xdebug -> dontbug (request #%v)", requestNum), packet)
+
+		// The first packet is the init packet which tells us which PHP file is being run
+		if seq == 0 {
+			matches := gFileURIRegexp.FindStringSubmatch(packet)
+			if matches != nil {
+				fileURI = matches[1]
+			}
+			// So that it is easy to tell which recorded request corresponds to which user action
+			logInfof(color.FgCyan, "dontbug: ======== Request #%v started: %v ========", requestNum, fileURI)
+			addActiveRequest(requestNum, fileURI)
+			defer removeActiveRequest(requestNum)
+		}
+
+		if stopping {
+			continue
+		}
+
+		if strings.Contains(packet, `command="breakpoint_set"`) && strings.Contains(packet, "<error") {
+			logWarnf(color.FgYellow, "dontbug: Request #%v: Could not set the --record-until breakpoint", requestNum)
+		}
+
+		seq++
+
+		// Keep running until we are able to record the execution
+		command := fmt.Sprintf("run -i %d", seq)
+		if seq == 1 && gRecordUntil.line != 0 {
+			command = recordUntilBreakpointCommand(seq)
+		} else if isRecordUntilHit(packet) || recordUntilReached() {
+			// Other queued requests are of no interest once the line has been reached
+			markRecordUntilReached(requestNum)
+			command = fmt.Sprintf("stop -i %d", seq)
+			stopping = true
+		}
+		logDbgpTranscript(color.FgGreen, fmt.Sprintf("dontbug -> xdebug (request #%v)", requestNum), command)
+		_, err = conn.Write([]byte(command + "\x00"))
+		if err != nil {
+			break
+		}
+	}
+
+	logInfof(color.FgCyan, "dontbug: ======== Request #%v finished: %v ========", requestNum, fileURI)
+}
+
+// Like the dontbug <-> IDE transcript during replay, long packets are cut short
+// The XML is indented so that it does not wrap illegibly
+func logDbgpTranscript(attr color.Attribute, direction, payload string) {
+	if !logEnabled(LogLevelDebug) {
+		return
+	}
+
+	payload = indentXML(payload)
+	continued := ""
+	if len(payload) > dbgpTranscriptMaxLen {
+		continued = "..."
+	}
+	logDebugf(attr, "%v:\n%.*v%v", direction, dbgpTranscriptMaxLen, payload, continued)
+}
+
+// Returns input as is if it is not well formed XML
+func indentXML(input string) string {
+	if !strings.HasPrefix(strings.TrimSpace(input), "<") {
+		return input
+	}
+
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(strings.NewReader(input))
+	// Xdebug declares iso-8859-1. This is just for display so the bytes are taken as they are
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	encoder := xml.NewEncoder(&out)
+	encoder.Indent("", "  ")
+	for {
+		// Raw tokens so that namespace prefixes like xdebug:message are kept as they are
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return input
+		}
+
+		switch t := token.(type) {
+		case xml.CharData:
+			// Whitespace between elements would otherwise be kept in addition to the indentation
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+		case xml.StartElement:
+			t.Name = unprefixedXMLName(t.Name)
+			for i := range t.Attr {
+				t.Attr[i].Name = unprefixedXMLName(t.Attr[i].Name)
+			}
+			token = t
+		case xml.EndElement:
+			t.Name = unprefixedXMLName(t.Name)
+			token = t
+		}
+
+		if encoder.EncodeToken(token) != nil {
+			return input
+		}
+	}
+
+	if encoder.Flush() != nil {
+		return input
+	}
+
+	return out.String()
+}
+
+// The encoder would treat a prefix as a namespace URI and add xmlns attributes for it
+func unprefixedXMLName(name xml.Name) xml.Name {
+	if name.Space == "" {
+		return name
+	}
+
+	return xml.Name{Local: name.Space + ":" + name.Local}
+}
+
+// Reads a packet of the form <length>\x00<xml>\x00 sent by Xdebug and returns the xml
+func readDbgpPacket(buf *bufio.Reader) (string, error) {
+	lengthString, err := buf.ReadString(byte(0))
+	if err != nil {
+		return "", err
+	}
+
+	dataLen, err := strconv.Atoi(strings.TrimRight(lengthString, "\x00"))
+	if err != nil {
+		return "", fmt.Errorf("Could not understand the length in debugger engine response: %q", lengthString)
+	}
+
+	// The xml is followed by a NUL byte
+	data := make([]byte, dataLen+1)
+	_, err = io.ReadFull(buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data[:dataLen]), nil
+}
+
 func checkDontbugWasCompiled(extDirAbsPath string) string {
 	dlPath := path.Clean(extDirAbsPath + "/modules/dontbug.so")
 
@@ -283,24 +666,149 @@ func checkDontbugWasCompiled(extDirAbsPath string) string {
 
 func getAbsNoSymExtDirAndCheckInstallLocation(installLocation string) string {
 	if strings.TrimSpace(installLocation) == "" {
-		color.Yellow("dontbug: No --install-location specified. Defaulting to $GOPATH/src/github.com/sidkshatriya/dontbug")
+		logInfof(color.FgYellow, "dontbug: No --install-location specified. Defaulting to $GOPATH/src/github.com/sidkshatriya/dontbug")
+	}
+
+	extAbsDir, err := getAbsNoSymExtDir(installLocation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logInfof(color.FgGreen, "dontbug: Using --install-location \"%v\"", strings.TrimSuffix(extAbsDir, "/ext/dontbug"))
+	checkDontbugExtVersion(extAbsDir)
+	return extAbsDir
+}
+
+// Like getAbsNoSymExtDirAndCheckInstallLocation() but returns an error instead of exiting
+func getAbsNoSymExtDir(installLocation string) (string, error) {
+	if strings.TrimSpace(installLocation) == "" {
 		gopath := os.Getenv("GOPATH")
 		if gopath == "" {
-			log.Fatal("Unable to find environment variable GOPATH. Is go installed properly?")
+			return "", errors.New("Unable to find environment variable GOPATH. Is go installed properly?")
 		}
-		installLocation = getAbsNoSymlinkPath(path.Clean(gopath + "/src/github.com/sidkshatriya/dontbug"))
-	} else {
-		installLocation = getAbsNoSymlinkPath(installLocation)
+		installLocation = path.Clean(gopath + "/src/github.com/sidkshatriya/dontbug")
 	}
 
-	color.Green("dontbug: Using --install-location \"%v\"", installLocation)
-	extAbsDir := path.Clean(installLocation + "/ext/dontbug")
-	_, err := os.Stat(extAbsDir)
+	absInstallLocation, err := filepath.Abs(installLocation)
+	if err == nil {
+		absInstallLocation, err = filepath.EvalSymlinks(absInstallLocation)
+	}
 	if err != nil {
-		log.Fatalf("'%v' does not seem to be a valid install location of dontbug. Error: %v\n", installLocation, err)
+		return "", fmt.Errorf("'%v' does not seem to be a valid install location of dontbug. Error: %v", installLocation, err)
 	}
 
-	return extAbsDir
+	extAbsDir := path.Clean(absInstallLocation + "/ext/dontbug")
+	_, err = os.Stat(extAbsDir)
+	if err != nil {
+		return "", fmt.Errorf("'%v' does not seem to be a valid install location of dontbug. Error: %v", absInstallLocation, err)
+	}
+
+	return extAbsDir, nil
+}
+
+// dontbug_break.c is generated again on every 'dontbug record' so a copy is kept with the rr trace
+// The replay and 'dontbug snapshot export' prefer that copy (see getTraceBreakFileDir())
+func saveBreakFileWithTrace(extAbsNoSymDir, rrTraceDir string) {
+	contents, err := ioutil.ReadFile(extAbsNoSymDir + "/dontbug_break.c")
+	if err == nil {
+		err = ioutil.WriteFile(rrTraceDir+"/dontbug_break.c", contents, 0600)
+	}
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not save dontbug_break.c with the rr trace: %v", err)
+	}
+}
+
+// Returns rrTraceDir if it has its own copy of dontbug_break.c and "" otherwise
+// An empty rrTraceDir means the latest trace
+func getTraceBreakFileDir(rrTraceDir string) string {
+	if rrTraceDir == "" {
+		rrTraceDir, _ = filepath.EvalSymlinks(getRRTraceHome() + "/latest-trace")
+		if rrTraceDir == "" {
+			return ""
+		}
+	}
+
+	_, err := os.Stat(rrTraceDir + "/dontbug_break.c")
+	if err != nil {
+		return ""
+	}
+
+	return rrTraceDir
+}
+
+// Without its own copy (see saveBreakFileWithTrace()) a trace is replayed with the dontbug_break.c of the install
+// location. That is only right if no later 'dontbug record' generated it again. An empty rrTraceDir means the latest trace
+func checkBreakFileAgainstTrace(extAbsNoSymDir, rrTraceDir string) {
+	if rrTraceDir == "" {
+		rrTraceDir, _ = filepath.EvalSymlinks(getRRTraceHome() + "/latest-trace")
+	}
+
+	breakFileInfo, err := os.Stat(extAbsNoSymDir + "/dontbug_break.c")
+	if err != nil {
+		return
+	}
+	traceInfo, err := os.Stat(rrTraceDir)
+	if err != nil {
+		return
+	}
+
+	logWarnf(color.FgYellow, "dontbug: The rr trace has no dontbug_break.c of its own. Using %v/dontbug_break.c", extAbsNoSymDir)
+	if breakFileInfo.ModTime().After(traceInfo.ModTime()) {
+		logWarnf(color.FgRed, "dontbug: Warning: %v/dontbug_break.c was generated after the rr trace %v was recorded. "+
+			"Breakpoints may be set at the wrong places. Please 'dontbug record' again", extAbsNoSymDir, rrTraceDir)
+	}
+}
+
+// Like getAbsNoSymExtDirAndCheckInstallLocation() but (if needBreakFile) also makes sure the extension dir has a
+// dontbug_break.c (which is generated by 'dontbug record'). If no --install-location was given, a few likely
+// locations are tried
+func getAbsNoSymExtDirForReplay(installLocation string, needBreakFile bool) string {
+	var candidates []string
+	if strings.TrimSpace(installLocation) != "" {
+		candidates = []string{installLocation}
+	} else {
+		for _, gopath := range filepath.SplitList(os.Getenv("GOPATH")) {
+			candidates = append(candidates, path.Clean(gopath+"/src/github.com/sidkshatriya/dontbug"))
+		}
+
+		// The default GOPATH when it is not set
+		candidates = append(candidates, path.Clean(getHomeDir()+"/go/src/github.com/sidkshatriya/dontbug"))
+
+		// Running from a checkout of dontbug
+		cwd, err := os.Getwd()
+		if err == nil {
+			candidates = append(candidates, cwd)
+		}
+	}
+
+	var searched []string
+	for _, candidate := range candidates {
+		extAbsDir, err := getAbsNoSymExtDir(candidate)
+		if err != nil {
+			searched = append(searched, fmt.Sprintf("    %v/ext/dontbug (%v)", candidate, err))
+			continue
+		}
+
+		_, err = os.Stat(extAbsDir + "/dontbug_break.c")
+		if needBreakFile && err != nil {
+			searched = append(searched, fmt.Sprintf("    %v (no dontbug_break.c)", extAbsDir))
+			continue
+		}
+
+		if strings.TrimSpace(installLocation) == "" {
+			logInfof(color.FgYellow, "dontbug: No --install-location specified. Picked \"%v\" (tried: %v)",
+				strings.TrimSuffix(extAbsDir, "/ext/dontbug"), strings.Join(candidates, ", "))
+		} else {
+			logInfof(color.FgGreen, "dontbug: Using --install-location \"%v\"", strings.TrimSuffix(extAbsDir, "/ext/dontbug"))
+		}
+		checkDontbugExtVersion(extAbsDir)
+		return extAbsDir
+	}
+
+	log.Fatalf("Could not find the dontbug zend extension with a generated dontbug_break.c. Searched:\n%v\n"+
+		"dontbug_break.c is generated by 'dontbug record'. Please make sure you recorded with the same --install-location "+
+		"(or $GOPATH) that you are replaying with", strings.Join(searched, "\n"))
+	return ""
 }
 
 func DoChecksAndRecord(
@@ -315,17 +823,60 @@ func DoChecksAndRecord(
 	recordPort int,
 	serverListen string,
 	serverPort int,
+	dbgpListen string,
 	takeSnapshot bool,
+	snapshotName string,
+	dryRun bool,
+	openBrowser bool,
+	stdinFile string,
 ) {
+	if snapshotName != "" {
+		if !takeSnapshot {
+			log.Fatal("--snapshot-name requires --take-snapshot")
+		}
+		fatalIf(checkSnapshotName(snapshotName))
+	}
+
 	rootAbsNoSymDir := getAbsNoSymlinkPath(rootDir)
 	extAbsNoSymDir := getAbsNoSymExtDirAndCheckInstallLocation(installLocation)
+	if RecordUntil != "" {
+		setRecordUntil(rootAbsNoSymDir)
+	}
 
 	docrootOrScriptFullPath := path.Clean(fmt.Sprintf("%v/%v", rootAbsNoSymDir, docrootOrScriptRelPath))
 
+	// PHP will connect to our basic debugger client at dbgpClientHost
+	warnIfServerBeyondLoopback(serverListen, isCli)
+	dbgpListenHost, dbgpClientHost := getDbgpHosts(dbgpListen)
+
+	if dryRun {
+		phpPath := checkPhpExecutable(phpExecutable)
+		rrPath := CheckRRExecutable(rrExecutable)
+		printRecordDryRun(
+			rrPath,
+			recordCommandArgs(
+				getAbsNoSymlinkPath(docrootOrScriptFullPath),
+				path.Clean(extAbsNoSymDir+"/modules/dontbug.so"),
+				phpPath,
+				isCli,
+				arguments,
+				serverListen,
+				serverPort,
+				dbgpClientHost,
+				recordPort,
+				maxStackDepth,
+			),
+			takeSnapshot,
+			stdinFile,
+		)
+		return
+	}
+
 	snapShotDir := ""
 	originalDocrootOrScriptFullPath := ""
 	if takeSnapshot {
-		snapShotDir = doSnapshot(rootAbsNoSymDir)
+		snapShotDir = doSnapshot(rootAbsNoSymDir, snapshotName)
+		rebaseRecordUntil(rootAbsNoSymDir, snapShotDir)
 		originalDocrootOrScriptFullPath = docrootOrScriptFullPath
 		docrootOrScriptFullPath = path.Clean(fmt.Sprintf("%v/%v", snapShotDir, docrootOrScriptRelPath))
 	}
@@ -337,7 +888,7 @@ func DoChecksAndRecord(
 
 	doGeneration(rootAbsNoSymDir, extAbsNoSymDir, maxStackDepth, phpPath)
 	dontbugSharedObjectPath := checkDontbugWasCompiled(extAbsNoSymDir)
-	startBasicDebuggerClient(recordPort)
+	startBasicDebuggerClient(dbgpListenHost, dbgpClientHost, recordPort)
 	doRecordSession(
 		docrootOrScriptAbsNoSymPath,
 		dontbugSharedObjectPath,
@@ -347,15 +898,243 @@ func DoChecksAndRecord(
 		arguments,
 		serverListen,
 		serverPort,
+		dbgpClientHost,
 		recordPort,
 		maxStackDepth,
 		takeSnapshot,
+		snapshotName,
 		snapShotDir,
 		originalDocrootOrScriptFullPath,
+		openBrowser,
+		stdinFile,
 	)
 }
 
-func doSnapshot(rootAbsNoSymDir string) string {
+// Nothing is generated, compiled, snapshotted or run in a dry run
+func printRecordDryRun(rrPath string, rrCmd []string, takeSnapshot bool, stdinFile string) {
+	fmt.Println("dontbug: Dry run. The following command would be run to record:")
+	command := shellQuoteCommand(append([]string{rrPath}, rrCmd...))
+	if stdinFile != "" {
+		command += " < " + shellQuoteCommand([]string{stdinFile})
+	}
+	fmt.Println(command)
+	if takeSnapshot {
+		fmt.Println("dontbug: With --take-snapshot, the PHP sources and dontbug.so would be used from a fresh snapshot instead")
+	}
+}
+
+// DoChecksAndRecordAttach records PHP running under php-fpm (behind nginx, say) instead of the PHP built-in webserver
+// dontbug only runs the dbgp listener that drives the recording. If fpmCommand is "" the user needs to start
+// php-fpm under rr themselves with the command that is printed; otherwise dontbug runs it under rr
+func DoChecksAndRecordAttach(
+	phpExecutable,
+	rrExecutable,
+	rootDir,
+	installLocation string,
+	maxStackDepth int,
+	recordPort int,
+	dbgpListen,
+	fpmCommand string,
+) {
+	rootAbsNoSymDir := getAbsNoSymlinkPath(rootDir)
+	extAbsNoSymDir := getAbsNoSymExtDirAndCheckInstallLocation(installLocation)
+
+	// The PHP executable is only needed to build the dontbug zend extension. It should be the same PHP version as php-fpm
+	phpPath := checkPhpExecutable(phpExecutable)
+	rrPath := CheckRRExecutable(rrExecutable)
+
+	// php-fpm is assumed to run on this machine
+	dbgpListenHost, recordHost := getDbgpHosts(dbgpListen)
+
+	doGeneration(rootAbsNoSymDir, extAbsNoSymDir, maxStackDepth, phpPath)
+	dontbugSharedObjectPath := checkDontbugWasCompiled(extAbsNoSymDir)
+	startBasicDebuggerClient(dbgpListenHost, recordHost, recordPort)
+
+	fpmAr := strings.Fields(fpmCommand)
+	spawn := len(fpmAr) > 0
+	if !spawn {
+		fpmAr = []string{"php-fpm"}
+	}
+
+	// -F keeps php-fpm in the foreground so that rr can record it till the end
+	rrCmd := append([]string{"record"}, fpmAr...)
+	rrCmd = append(rrCmd, "-F")
+	rrCmd = append(rrCmd, phpIniOverrideArgs(dontbugSharedObjectPath, recordHost, recordPort, maxStackDepth)...)
+
+	if spawn {
+		rrTraceDir := runRRRecording(rrPath, rrCmd, "")
+		if rrTraceDir != "" {
+			saveBreakFileWithTrace(extAbsNoSymDir, rrTraceDir)
+		}
+		logInfof(color.FgGreen, "\ndontbug: Closed cleanly. Replay should work properly")
+		return
+	}
+
+	logInfof(color.FgGreen, "dontbug: Stop your usual php-fpm and run this instead (use the php-fpm executable of your system):")
+	fmt.Println(shellQuoteCommand(append([]string{rrPath}, rrCmd...)))
+	logInfof(color.FgYellow, "dontbug: -- Waiting for PHP requests. Stop php-fpm with Ctrl-C when done and then Ctrl-C here")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	logInfof(color.FgGreen, "\ndontbug: Stopped listening for PHP requests")
+}
+
+// Usually the PHP built-in webserver listens on loopback and so does our basic debugger client.
+// When recording in a container, say, the webserver needs to listen on a non-loopback address
+// to be reachable from outside. In that case our debugger client listens on the same address
+// (unless it is a wildcard address, in which case loopback is sufficient for PHP to reach us)
+func warnIfServerBeyondLoopback(serverListen string, isCli bool) {
+	ip := net.ParseIP(serverListen)
+	if isCli || serverListen == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return
+	}
+
+	logWarnf(color.FgRed, "dontbug: Warning: The PHP built-in webserver will listen on %v. This is beyond loopback so anybody who can reach this address can access your PHP application", serverListen)
+}
+
+// PHP connects to the dbgp listener that drives the recording (see startBasicDebuggerClient()) at the
+// returned client host i.e. xdebug.remote_host. PHP runs on this machine so the client host has to be an
+// address of this machine. When listening on all interfaces (0.0.0.0 or ::) PHP connects over loopback
+// The listener is independent of the PHP built-in webserver's --server-listen
+func getDbgpHosts(dbgpListen string) (string, string) {
+	listenHost := strings.Trim(dbgpListen, "[]")
+	ip := net.ParseIP(listenHost)
+	if ip == nil {
+		ips, err := net.LookupIP(listenHost)
+		if err != nil || len(ips) == 0 {
+			log.Fatalf("Could not resolve --dbgp-listen %v: %v", dbgpListen, err)
+		}
+		ip = ips[0]
+	}
+
+	if ip.IsUnspecified() {
+		logWarnf(color.FgRed, "dontbug: Warning: The dbgp listener for recording will listen on all interfaces (%v). Anybody who can reach this machine can connect to it", dbgpListen)
+		if ip.To4() == nil {
+			return listenHost, "::1"
+		}
+		return listenHost, "127.0.0.1"
+	}
+
+	if !ip.IsLoopback() {
+		if !isLocalAddress(ip) {
+			log.Fatalf("--dbgp-listen %v is not an address of this machine. PHP would not be able to reach the dbgp listener there", dbgpListen)
+		}
+		logWarnf(color.FgRed, "dontbug: Warning: The dbgp listener for recording will listen on %v. This is beyond loopback so anybody who can reach this address can connect to it", dbgpListen)
+	}
+
+	return listenHost, ip.String()
+}
+
+func isLocalAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Prints the URLs at which the PHP built-in webserver should be reachable
+func printServerURLs(serverListen string, serverPort int) {
+	ip := net.ParseIP(serverListen)
+	if ip == nil || !ip.IsUnspecified() {
+		logInfof(color.FgGreen, "dontbug: PHP built-in webserver URL: http://%v", net.JoinHostPort(serverListen, strconv.Itoa(serverPort)))
+		return
+	}
+
+	// Listening on all interfaces
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not list network interfaces to find the PHP built-in webserver URLs: %v", err)
+		return
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && !ipNet.IP.IsLinkLocalUnicast() {
+			logInfof(color.FgGreen, "dontbug: PHP built-in webserver URL: http://%v", net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(serverPort)))
+		}
+	}
+}
+
+// Waits for the PHP built-in webserver to accept connections (it runs under rr so this can take a while)
+// and then opens its URL in the default browser. If there is no browser launcher the URL printed earlier will have to do
+func openBrowserWhenListening(serverListen string, serverPort int) {
+	host := serverListen
+	ip := net.ParseIP(serverListen)
+	if ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(serverPort))
+
+	listening := false
+	for i := 0; i < 120; i++ {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err == nil {
+			conn.Close()
+			listening = true
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if !listening {
+		logWarnf(color.FgYellow, "dontbug: The PHP built-in webserver does not seem to be listening at %v. Not opening a browser", address)
+		return
+	}
+
+	url := "http://" + address
+	var launcher []string
+	switch runtime.GOOS {
+	case "darwin":
+		launcher = []string{"open", url}
+	case "windows":
+		launcher = []string{"cmd", "/c", "start", url}
+	default:
+		launcher = []string{"xdg-open", url}
+	}
+
+	err := exec.Command(launcher[0], launcher[1:]...).Start()
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not open a browser (%v). Please open %v yourself", err, url)
+		return
+	}
+
+	logInfof(color.FgGreen, "dontbug: Opened %v in your browser", url)
+}
+
+// Named snapshots (snap-<name>) don't sort by time so go by the modification time instead of the name
+// doSnapshot() sets that to when the snapshot was made (rsync -a copies over the modification time of the sources)
+func getMostRecentSnapshotDir(snapShotGroupDir string) string {
+	matches, err := filepath.Glob(snapShotGroupDir + "snap-*")
+	fatalIf(err)
+
+	mostRecent := ""
+	var mostRecentModTime time.Time
+	for _, v := range matches {
+		info, err := os.Stat(v)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		if mostRecent == "" || info.ModTime().After(mostRecentModTime) {
+			mostRecent = v
+			mostRecentModTime = info.ModTime()
+		}
+	}
+
+	return mostRecent
+}
+
+// If snapshotName is not "" the snapshot is stored in snap-<snapshotName> instead of snap-<timestamp>
+func doSnapshot(rootAbsNoSymDir, snapshotName string) string {
 	rootAbsNoSymDir = path.Clean(rootAbsNoSymDir) + "/"
 	hash := sha1.Sum([]byte(rootAbsNoSymDir))
 
@@ -365,12 +1144,15 @@ func doSnapshot(rootAbsNoSymDir string) string {
 	snapShotGroupDir := fmt.Sprintf("%v%v/", sharePath, hashx)
 	mkDirAll(snapShotGroupDir)
 
-	matches, err := filepath.Glob(snapShotGroupDir + "snap-*")
-	lastSnapExists := false
-	lastSnapName := ""
-	if len(matches) != 0 {
-		lastSnapExists = true
-		lastSnapName = matches[len(matches)-1]
+	snapShotDir := fmt.Sprintf("%vsnap-%v/", snapShotGroupDir, time.Now().UnixNano()/1000000)
+	if snapshotName != "" {
+		snapShotDir = fmt.Sprintf("%vsnap-%v/", snapShotGroupDir, snapshotName)
+		makeSnapshotNameAvailable(snapshotName, snapShotDir)
+	}
+
+	lastSnapName := getMostRecentSnapshotDir(snapShotGroupDir)
+	lastSnapExists := lastSnapName != ""
+	if lastSnapExists {
 		Verbosef("dontbug: Last snapshot was: %v\n", lastSnapName)
 	}
 
@@ -382,7 +1164,6 @@ func doSnapshot(rootAbsNoSymDir string) string {
 		"--exclude=.hg",
 	}
 
-	snapShotDir := fmt.Sprintf("%vsnap-%v/", snapShotGroupDir, time.Now().UnixNano()/1000000)
 	if !lastSnapExists {
 		command = []string{
 			"rsync",
@@ -403,8 +1184,8 @@ func doSnapshot(rootAbsNoSymDir string) string {
 	}
 
 	command = append(command, common...)
-	color.Green("dontbug: rsyncing sources and creating a snapshot at: %v", snapShotDir)
-	color.Green("dontbug: If this was your second or later snapshot, disk usage should only go up by what was changed from previous snapshot")
+	logInfof(color.FgGreen, "dontbug: rsyncing sources and creating a snapshot at: %v", snapShotDir)
+	logInfof(color.FgGreen, "dontbug: If this was your second or later snapshot, disk usage should only go up by what was changed from previous snapshot")
 	Verboseln("dontbug: Issuing command: ", strings.Join(command, " "))
 	outputBytes, err := exec.Command(command[0], command[1:]...).CombinedOutput()
 	if err != nil {
@@ -412,9 +1193,12 @@ func doSnapshot(rootAbsNoSymDir string) string {
 		log.Fatal(err)
 	}
 
-	if VerboseFlag {
-		fmt.Println(string(outputBytes))
-	}
+	Verboseln(string(outputBytes))
+
+	// So that getMostRecentSnapshotDir() picks this snapshot as the base of the next one
+	now := time.Now()
+	err = os.Chtimes(snapShotDir, now, now)
+	fatalIf(err)
 
 	return snapShotDir
 }
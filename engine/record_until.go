@@ -0,0 +1,121 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RecordUntil is a PHP file:line. If not "" the recording stops the first time that line is executed
+// The file is relative to the <php-source-root-dir> (or absolute)
+var RecordUntil string
+
+var gRecordUntil = struct {
+	fileURI     string
+	line        int
+	reached     chan struct{} // Closed when the line is reached
+	reachedOnce sync.Once
+}{reached: make(chan struct{})}
+
+// Returns the absolute path of the PHP file and the line in RecordUntil
+func parseRecordUntil(rootAbsNoSymDir string) (string, int) {
+	colon := strings.LastIndex(RecordUntil, ":")
+	if colon == -1 {
+		log.Fatalf("--record-until should be of the form file.php:line. Got: %v", RecordUntil)
+	}
+
+	line, err := strconv.Atoi(RecordUntil[colon+1:])
+	if err != nil || line <= 0 {
+		log.Fatalf("Invalid line number in --record-until: %v", RecordUntil)
+	}
+
+	filename := RecordUntil[:colon]
+	if !path.IsAbs(filename) {
+		filename = path.Join(rootAbsNoSymDir, filename)
+	}
+	filename = path.Clean(filename)
+
+	_, err = os.Stat(filename)
+	if err != nil {
+		log.Fatalf("Could not find the file in --record-until: %v", err)
+	}
+
+	return filename, line
+}
+
+func setRecordUntil(rootAbsNoSymDir string) {
+	filename, line := parseRecordUntil(rootAbsNoSymDir)
+	gRecordUntil.fileURI = "file://" + filename
+	gRecordUntil.line = line
+	logInfof(color.FgYellow, "dontbug: Recording until %v is executed", RecordUntil)
+}
+
+// PHP runs from the snapshot instead of rootAbsNoSymDir when a snapshot was taken
+func rebaseRecordUntil(rootAbsNoSymDir, snapShotDir string) {
+	root := path.Clean(rootAbsNoSymDir)
+	filename := strings.TrimPrefix(gRecordUntil.fileURI, "file://")
+	if strings.HasPrefix(filename, root+"/") {
+		gRecordUntil.fileURI = "file://" + path.Join(snapShotDir, filename[len(root):])
+	}
+}
+
+// The breakpoint is set in every recorded request as it does not survive the end of the request
+func recordUntilBreakpointCommand(seq int) string {
+	return fmt.Sprintf("breakpoint_set -i %d -t line -f %v -n %d", seq, gRecordUntil.fileURI, gRecordUntil.line)
+}
+
+// Xdebug only breaks because of our breakpoint as there are no others
+func isRecordUntilHit(packet string) bool {
+	return gRecordUntil.line != 0 &&
+		strings.Contains(packet, `command="run"`) &&
+		strings.Contains(packet, `status="break"`)
+}
+
+func markRecordUntilReached(requestNum int) {
+	gRecordUntil.reachedOnce.Do(func() {
+		logInfof(color.FgGreen, "dontbug: Request #%v reached %v:%v. Stopping the recording", requestNum,
+			strings.TrimPrefix(gRecordUntil.fileURI, "file://"), gRecordUntil.line)
+		close(gRecordUntil.reached)
+	})
+}
+
+func recordUntilReached() bool {
+	select {
+	case <-gRecordUntil.reached:
+		return true
+	default:
+		return false
+	}
+}
+
+func reportRecordUntil() {
+	if gRecordUntil.line == 0 {
+		return
+	}
+
+	target := fmt.Sprintf("%v:%v", strings.TrimPrefix(gRecordUntil.fileURI, "file://"), gRecordUntil.line)
+	if recordUntilReached() {
+		logInfof(color.FgGreen, "dontbug: The recording ends where %v was first executed", target)
+	} else {
+		logWarnf(color.FgYellow, "dontbug: %v was never executed. The whole execution was recorded", target)
+	}
+}
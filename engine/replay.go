@@ -16,32 +16,44 @@ package engine
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/chzyer/readline"
 	"github.com/cyrus-and/gdb"
 	"github.com/fatih/color"
 	"github.com/kr/pty"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
-	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	numFilesSentinel      = "//&&& Number of Files:"
 	maxStackDepthSentinel = "//&&& Max Stack Depth:"
+	formatVersionSentinel = "//&&& Format Version:"
 	phpFilenameSentinel   = "//###"
 	levelSentinel         = "//$$$"
+	functionSentinel      = "//%%%"
+
+	// In dontbug.c
+	stepSentinel      = "//@@@"
+	hashCommentMarker = "// hash =="
 
 	// @TODO improve this
 	gHelpText = `
@@ -52,6 +64,28 @@ f        debug in forward (normal) mode
 t        toggle between reverse and forward modes
 v        toggle between verbose and quiet modes
 n        toggle between showing and not showing gdb notifications
+s        show the current status of dontbug and the breakpoints set
+w        list watch expressions (these are sent to the IDE at every stop)
+w <expr> add a watch expression e.g. w $count + 1
+e        toggle explaining what each run/step command from the IDE does (useful to learn reverse mode)
+wd <n>   delete watch expression number n
+where    show the current rr event (and tick) i.e. the absolute position in the replay e.g. for --start-event
+g <file:line>
+         go to a PHP location in the current direction (ignoring breakpoints) e.g. g index.php:12
+files [--json] [text]
+         list the recorded PHP files that breakpoints can be set in (optionally only those whose path contains text)
+b        bounce i.e. repeat the last run/step command from the IDE in the opposite direction
+c <expr> continue in the current direction (ignoring breakpoints) until the PHP expression is true e.g. c $i > 10
+         this evaluates the expression at every PHP statement so it can be slow
+evalall <expr>
+         evaluate the PHP expression in every stack frame e.g. evalall $this->count
+mark <name>
+         bookmark the current position in the replay e.g. mark before-save
+goto <name>
+         go (forward or back) to a bookmarked position
+marks    list the bookmarks
+diff <expr>
+         evaluate the PHP expression, step once in the current direction, evaluate it again and go back e.g. diff $i
 <enter>  will tell you whether you are in forward or reverse mode
 
 Debugging in reverse mode can be confusing but here is a cheat sheet:
@@ -73,30 +107,34 @@ Expert Usage:
 * For commands to be sent to GDB-MI prefix command with "-" e.g. -thread-info
 * For dbgp commands to be sent to PHP, prefix command with "#" e.g. #stack_get -i 0
   Note: only a subset of dbgp commands may issued in this way.
+* Press <tab> to complete prompt commands and the command names after "#" and "-"
 `
 )
 
+// rr asks us to launch gdb with a line like:
+// gdb '-l' '10000' '-ex' 'target extended-remote :9999' /home/user/.local/share/rr/php-0/mmap_hardlink_3_php
+// The first submatch is the port and the second one is the hardlink file
+var gdbConnectionStringRegexp = regexp.MustCompile(`'?target extended-remote :(\d+)'?\s+(/.*\S)\s*$`)
+
 type snapInfo struct {
+	name                string // Only for snapshots recorded with --snapshot-name
 	snapRRTraceDir      string
 	snapRootDir         string
 	origDocrootOrScript string
+	modTime             time.Time
+	rrCommand           []string // Not available for snapshots made by older versions of dontbug
+	phpVersion          string   // Ditto
+	originalRootDir     string   // Only for imported snapshots
 }
 
-func getSnapInfoFromUser() (snapInfo, bool) {
-	currentUser, err := user.Current()
-	fatalIf(err)
-
-	rrHome := currentUser.HomeDir + "/.local/share/rr"
+// Finds all the snapshots in rr's trace home by looking for the snapshot metadata in each trace
+func getSnapInfos() []snapInfo {
+	rrHome := getRRTraceHome()
 	snapshotDirsGlob := fmt.Sprintf("%v/*/dontbug-snapshot*", rrHome)
 	matches, err := filepath.Glob(snapshotDirsGlob)
 	fatalIf(err)
 
 	traceDirAr := make([]snapInfo, 0, 20)
-	fmt.Println("Saved Snapshots (created with flag --take-snapshot in `dontbug record`)")
-	fmt.Println("-----------------------------------------------------------------------")
-	fmt.Println("A snapshot comprises PHP sources at a point in time along with an rr execution trace")
-
-	i := 0
 	for _, v := range matches {
 		if strings.Contains(v, "latest-trace") {
 			continue
@@ -110,21 +148,62 @@ func getSnapInfoFromUser() (snapInfo, bool) {
 
 		info, err := os.Stat(v)
 		fatalIf(err)
-		modTime := info.ModTime().Format("2006-01-02 15:04:05")
-
-		traceDir := path.Dir(v)
-		metaData := string(metaDataBytes)
-		rootDir := strings.Split(metaData, ":")[0]
-		origDocrootOrScript := strings.Split(metaData, ":")[1]
-		fmt.Printf("[%v] Snapshot for %v Date: %v rr trace: %v\nPHP sources stored at: %v\n", i, origDocrootOrScript, modTime, traceDir, rootDir)
-		i++
+
+		metaData, err := parseSnapshotMetadata(metaDataBytes)
+		if err != nil {
+			logWarnf(color.FgYellow, "dontbug: Skipping snapshot metadata %v: %v", v, err)
+			continue
+		}
+
+		// Older snapshots don't have a timestamp so use when the metadata was written instead
+		modTime := metaData.Timestamp
+		if modTime.IsZero() {
+			modTime = info.ModTime()
+		}
+
 		traceDirAr = append(traceDirAr, snapInfo{
-			snapRRTraceDir:      traceDir,
-			snapRootDir:         rootDir,
-			origDocrootOrScript: origDocrootOrScript,
+			name:                metaData.Name,
+			snapRRTraceDir:      path.Dir(v),
+			snapRootDir:         metaData.RootDir,
+			origDocrootOrScript: metaData.OrigDocrootOrScript,
+			modTime:             modTime,
+			rrCommand:           metaData.RRCommand,
+			phpVersion:          metaData.PhpVersion,
+			originalRootDir:     metaData.OriginalRootDir,
 		})
 	}
 
+	return traceDirAr
+}
+
+func printSnapInfos(traceDirAr []snapInfo) {
+	for i, info := range traceDirAr {
+		modTime := info.modTime.Format("2006-01-02 15:04:05")
+		if info.name != "" {
+			logInfof(color.FgCyan, "[%v] Snapshot %v", i, info.name)
+		}
+		fmt.Printf("[%v] Snapshot for %v Date: %v rr trace: %v\nPHP sources stored at: %v\n", i, info.origDocrootOrScript, modTime, info.snapRRTraceDir, info.snapRootDir)
+		if info.originalRootDir != "" {
+			fmt.Printf("Imported. PHP sources were recorded at: %v\n", info.originalRootDir)
+		}
+		if info.phpVersion != "" {
+			fmt.Printf("PHP version: %v\n", info.phpVersion)
+		}
+		if len(info.rrCommand) > 0 {
+			fmt.Printf("Recorded with: %v\n", strings.Join(info.rrCommand, " "))
+		}
+	}
+}
+
+func getSnapInfoFromUser() (snapInfo, bool) {
+	traceDirAr := getSnapInfos()
+	fmt.Println("Saved Snapshots (created with flag --take-snapshot in `dontbug record`)")
+	fmt.Println("-----------------------------------------------------------------------")
+	fmt.Println("A snapshot comprises PHP sources at a point in time along with an rr execution trace")
+
+	printSnapInfos(traceDirAr)
+	i := len(traceDirAr)
+
 	if i == 0 {
 		fmt.Println("\nNo saved snapshots")
 		os.Exit(0)
@@ -145,13 +224,119 @@ func getSnapInfoFromUser() (snapInfo, bool) {
 	}
 }
 
-func DoReplay(installLocation, replayArg, rrPath, gdbPath string, replayHost string, replayPort int, targetExtendedRemotePort int) {
-	extAbsNoSymDir := getAbsNoSymExtDirAndCheckInstallLocation(installLocation)
-	bpMap, levelAr, maxStackDepth := constructBreakpointLocMap(extAbsNoSymDir)
+// The directory in which rr saves its traces and the latest-trace symlink
+// This is resolved the way rr does it so that record, replay, snapshot and clean all agree with rr:
+// $_RR_TRACE_DIR, then the legacy ~/.rr (if it exists), then $XDG_DATA_HOME/rr and finally ~/.local/share/rr
+func getRRTraceHome() string {
+	traceHome := os.Getenv("_RR_TRACE_DIR")
+	if traceHome != "" {
+		return traceHome
+	}
+
+	homeDir := getHomeDir()
+	legacyHome := homeDir + "/.rr"
+	if info, err := os.Stat(legacyHome); err == nil && info.IsDir() {
+		return legacyHome
+	}
+
+	xdgDataHome := os.Getenv("XDG_DATA_HOME")
+	if xdgDataHome != "" {
+		return xdgDataHome + "/rr"
+	}
+
+	return homeDir + "/.local/share/rr"
+}
+
+// SetRRTraceDir makes rr (which inherits our environment) and dontbug use traceDir for rr traces
+func SetRRTraceDir(traceDir string) {
+	absTraceDir, err := filepath.Abs(traceDir)
+	fatalIf(err)
+	mkDirAll(absTraceDir)
+	fatalIf(os.Setenv("_RR_TRACE_DIR", absTraceDir))
+}
+
+// rr creates the version file at the start of a recording and the incomplete marker
+// is around till the recording has been saved properly
+func isCompleteRRTrace(traceDir string) bool {
+	_, err := os.Stat(traceDir + "/version")
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(traceDir + "/incomplete")
+	return os.IsNotExist(err)
+}
+
+// Returns the most recently modified complete trace in rrHome or "" if there is none
+func getMostRecentCompleteTraceDir(rrHome string) string {
+	matches, err := filepath.Glob(rrHome + "/*")
+	fatalIf(err)
+
+	mostRecent := ""
+	var mostRecentModTime time.Time
+	for _, v := range matches {
+		if path.Base(v) == "latest-trace" {
+			continue
+		}
+
+		info, err := os.Stat(v)
+		if err != nil || !info.IsDir() || !isCompleteRRTrace(v) {
+			continue
+		}
+
+		if mostRecent == "" || info.ModTime().After(mostRecentModTime) {
+			mostRecent = v
+			mostRecentModTime = info.ModTime()
+		}
+	}
+
+	return mostRecent
+}
 
-	rrTraceDir := "" // This corresponds to the latest trace
+// Resolves the latest-trace symlink to a concrete trace directory
+// If that trace is not complete, offers the most recent complete trace instead
+func getLatestTraceDirFromUser() string {
+	rrHome := getRRTraceHome()
+	latestTrace := rrHome + "/latest-trace"
+
+	traceDir, err := filepath.EvalSymlinks(latestTrace)
+	if err == nil && isCompleteRRTrace(traceDir) {
+		return traceDir
+	}
+
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not resolve %v: %v", latestTrace, err)
+	} else {
+		logWarnf(color.FgYellow, "dontbug: The latest rr trace %v is incomplete. Maybe the recording is still in progress or it crashed?", traceDir)
+	}
+
+	mostRecent := getMostRecentCompleteTraceDir(rrHome)
+	if mostRecent == "" {
+		log.Fatalf("Could not find any complete rr trace in %v. Did you do 'dontbug record'?", rrHome)
+	}
+
+	fmt.Printf("Replay the most recent complete trace %v instead? [y/N]> ", mostRecent)
+	var answer string
+	fmt.Scanln(&answer)
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		color.Yellow("Exiting.")
+		os.Exit(0)
+	}
+
+	return mostRecent
+}
+
+func DoReplay(installLocation, replayArg, snapshotName, rrPath, gdbPath string, replayHost string, replayPorts []int, targetExtendedRemotePort int, readyFile string, startEvent int, once bool, dryRun bool, noIde bool) {
+	rrTraceDir := ""
 	snapInfo := snapInfo{}
-	if replayArg == "snaps" {
+	if snapshotName != "" {
+		var ok bool
+		snapInfo, ok = findSnapInfoByName(snapshotName)
+		if !ok {
+			log.Fatalf("Could not find a snapshot named %v. See 'dontbug snapshot list'", snapshotName)
+		}
+		rrTraceDir = snapInfo.snapRRTraceDir
+	} else if replayArg == "snaps" {
 		var ok bool
 		snapInfo, ok = getSnapInfoFromUser()
 		if ok {
@@ -160,52 +345,181 @@ func DoReplay(installLocation, replayArg, rrPath, gdbPath string, replayHost str
 	}
 
 	if rrTraceDir != "" {
-		color.Yellow("dontbug: Using snapshot %v corresponding to rr trace: %v", snapInfo.snapRootDir, rrTraceDir)
+		logInfof(color.FgYellow, "dontbug: Using snapshot %v corresponding to rr trace: %v", snapInfo.snapRootDir, rrTraceDir)
+	} else if dryRun {
+		// Nothing is replayed so there is no need to insist on a complete trace (or any trace at all)
+		rrTraceDir = getRRTraceHome() + "/latest-trace"
+		if resolved, err := filepath.EvalSymlinks(rrTraceDir); err == nil {
+			rrTraceDir = resolved
+		}
+		logInfof(color.FgYellow, "dontbug: Using latest trace: %v", rrTraceDir)
 	} else {
-		color.Yellow("dontbug: Using latest trace")
+		rrTraceDir = getLatestTraceDirFromUser()
+		logInfof(color.FgYellow, "dontbug: Using latest trace: %v", rrTraceDir)
 	}
+	printTraceSummary(rrTraceDir)
 
-	engineState := startReplayInRR(
-		rrTraceDir,
-		rrPath,
-		gdbPath,
-		bpMap,
-		levelAr,
-		maxStackDepth,
-		targetExtendedRemotePort,
-	)
-	debuggerLoop(engineState, replayHost, replayPort)
+	if dryRun {
+		fmt.Println("dontbug: Dry run. The following commands would be run to replay:")
+		fmt.Println(shellQuoteCommand(replayCommandAr(rrTraceDir, rrPath, targetExtendedRemotePort, startEvent)))
+		fmt.Println(shellQuoteCommand(gdbCommandAr(gdbPath, "<hardlinked file given by rr>", targetExtendedRemotePort)))
+		return
+	}
+
+	session := NewReplaySession(installLocation, rrTraceDir, rrPath, gdbPath, targetExtendedRemotePort, startEvent)
+	signalReady(replayHost, replayPorts, readyFile)
+	if once {
+		replayOnce(session, replayHost, replayPorts)
+		return
+	}
+
+	defer session.Close()
+	debuggerLoop(session.es, replayHost, replayPorts, noIde)
 }
 
-func startReplayInRR(traceDir string, rrPath, gdbPath string, bpMap map[string]int, levelAr []int, maxStackDepth int, targetExtendedRemotePort int) *engineState {
+// Runs a single IDE session without the (dontbug) prompt and then tears down rr and gdb
+// Exits with a non-zero status if the IDE did not end the session with stop or detach (e.g. it crashed)
+func replayOnce(session *ReplaySession, replayHost string, replayPorts []int) {
+	reverse := StartInReverse
+	printDirection(reverse)
+	clean := debuggerIdeLoop(session.es, make(chan bool, 1), &sync.Mutex{}, &reverse, replayHost, replayPorts)
+	session.Close()
+
+	if !clean {
+		logErrorf(color.FgRed, "dontbug: The IDE connection closed without a stop or detach")
+		os.Exit(1)
+	}
 
-	rrCmdAr := []string{
-		rrPath,
-		"replay",
-		"-s", strconv.Itoa(targetExtendedRemotePort),
-		traceDir,
+	logInfof(color.FgGreen, "dontbug: The IDE ended the debugging session. Exiting")
+}
+
+// rr and gdb are fully initialized and we're about to connect to the IDE
+// Scripts can wait for the (uncolored) ready line or for readyFile to appear
+// With several candidate IDE ports, port is a comma separated list of them
+func signalReady(replayHost string, replayPorts []int, readyFile string) {
+	readyLine := fmt.Sprintf("dontbug: ready host=%v port=%v\n", replayHost, joinPorts(replayPorts))
+	fmt.Print(readyLine)
+
+	if readyFile != "" {
+		err := ioutil.WriteFile(readyFile, []byte(readyLine), 0600)
+		if err != nil {
+			log.Fatalf("Could not write the ready file %v: %v", readyFile, err)
+		}
+	}
+}
+
+// Line numbers in dontbug.c at which the engine sets its own breakpoints
+type dontbugCLocations struct {
+	start  int // Temporary breakpoint to get the replay started
+	master int // Stepping (statement granularity)
+	opcode int // Stepping (opcode granularity)
+
+	// Start of a PHP request. See seekToRequest()
+	// Optional as a dontbug.c from an older version of dontbug does not have it. 0 if not found
+	request int
+}
+
+// The lines are marked with stepSentinel comments e.g. "//@@@ master" so that changes to dontbug.c
+// don't silently break stepping
+func findDontbugCLocations(extensionDir string) dontbugCLocations {
+	dontbugCFilename := getAbsNoSymlinkPath(extensionDir) + "/dontbug.c"
+	file, err := os.Open(dontbugCFilename)
+	fatalIf(err)
+	defer file.Close()
+
+	found := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		index := strings.Index(line, stepSentinel)
+		if index == -1 {
+			continue
+		}
+
+		fields := strings.Fields(line[index+len(stepSentinel):])
+		if len(fields) == 0 {
+			log.Fatalf("%v:%v: %v marker without a name", dontbugCFilename, lineno, stepSentinel)
+		}
+
+		name := fields[0]
+		if previous, ok := found[name]; ok {
+			log.Fatalf("%v: %v %v marker found on both line %v and line %v", dontbugCFilename, stepSentinel, name, previous, lineno)
+		}
+		found[name] = lineno
+	}
+	fatalIf(scanner.Err())
+
+	for _, name := range []string{"start", "master", "opcode"} {
+		if _, ok := found[name]; !ok {
+			log.Fatalf("Could not find the %v %v marker in %v. Is the dontbug zend extension there up to date?", stepSentinel, name, dontbugCFilename)
+		}
+	}
+
+	Verbosef("dontbug: Breakpoint locations in %v: %v\n", dontbugCFilename, found)
+	return dontbugCLocations{
+		start:   found["start"],
+		master:  found["master"],
+		opcode:  found["opcode"],
+		request: found["request"],
+	}
+}
+
+// rr serves gdb on loopback. If the port is already in use (e.g. by another replay) a free port is chosen instead
+// A port of 0 means any free port
+func chooseGdbRemotePort(requestedPort int) int {
+	if requestedPort != 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(requestedPort)))
+		if err == nil {
+			listener.Close()
+			return requestedPort
+		}
+
+		logWarnf(color.FgYellow, "dontbug: Port %v for the rr gdb server is not available (%v). Choosing another port", requestedPort, err)
+	}
+
+	// Note that there is a small window in which somebody else could grab the port after it is released here
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Could not find a free port for the rr gdb server: %v", err)
 	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	logInfof(color.FgGreen, "dontbug: Using port %v for the rr gdb server", port)
+	return port
+}
+
+func startReplayInRR(traceDir string, rrPath, gdbPath string, bpMap map[string]int, levelAr []int, maxStackDepth int, funcLocMap map[engineBreakpointType]int, cLocs dontbugCLocations, targetExtendedRemotePort int, startEvent int) *engineState {
+
+	rrCmdAr := replayCommandAr(traceDir, rrPath, targetExtendedRemotePort, startEvent)
 
 	// Start an rr replay session
 	replayCmd := exec.Command(rrCmdAr[0], rrCmdAr[1:]...)
 
 	Verbosef("dontbug: Issuing command: %v\n", strings.Join(rrCmdAr, " "))
 
-	f, err := pty.Start(replayCmd)
+	f, rrStderr, err := startRRReplay(replayCmd)
 	fatalIf(err)
-	color.Green("dontbug: Successfully started replay session")
+	logInfof(color.FgGreen, "dontbug: Successfully started replay session")
 
 	// Abort if we are not able to get the gdb connection string within 5 sec
+	// Replaying up to the start event can take arbitrarily long so there is no time limit in that case
 	cancel := make(chan bool, 1)
-	go func() {
-		time.Sleep(5 * time.Second)
-		select {
-		case <-cancel:
-			return
-		default:
-			log.Fatal("Could not find gdb connection string that is given by rr")
-		}
-	}()
+	if startEvent > 0 {
+		logInfof(color.FgYellow, "dontbug: Replaying up to event %v. This may take a while", startEvent)
+	} else {
+		go func() {
+			time.Sleep(5 * time.Second)
+			select {
+			case <-cancel:
+				return
+			default:
+				log.Fatalf("Could not find gdb connection string that is given by rr%v", rrStderr.explain())
+			}
+		}()
+	}
 
 	// Get hardlink filename which will be needed for gdb debugging
 	buf := bufio.NewReader(f)
@@ -214,18 +528,30 @@ func startReplayInRR(traceDir string, rrPath, gdbPath string, bpMap map[string]i
 		if strings.Contains(line, "target extended-remote") {
 			cancel <- true
 			close(cancel)
-			fmt.Print(line)
+			if ShowRROutput || VerboseFlag {
+				fmt.Print(line)
+			}
 
-			go io.Copy(os.Stdout, f)
-			slashAt := strings.Index(line, "/")
+			matches := gdbConnectionStringRegexp.FindStringSubmatch(line)
+			if matches == nil {
+				log.Fatalf("Could not understand the gdb connection string given by rr. Please report this. The line was: %q", line)
+			}
 
-			hardlinkFile := strings.TrimSpace(line[slashAt:])
+			if matches[1] != strconv.Itoa(targetExtendedRemotePort) {
+				log.Fatalf("rr is serving gdb on port %v but port %v was expected. The line was: %q", matches[1], targetExtendedRemotePort, line)
+			}
+
+			go copyProgramOutput(f, &ShowRROutput)
+
+			hardlinkFile := matches[2]
 			return startGdbAndInitDebugEngineState(
 				gdbPath,
 				hardlinkFile,
 				bpMap,
 				levelAr,
 				maxStackDepth,
+				funcLocMap,
+				cLocs,
 				f,
 				replayCmd,
 				targetExtendedRemotePort,
@@ -233,30 +559,154 @@ func startReplayInRR(traceDir string, rrPath, gdbPath string, bpMap map[string]i
 		}
 
 		if err != nil {
-			log.Fatal("Could not find gdb connection string that is given by rr")
+			// rr has most likely exited. Whatever it said on stderr is the real reason
+			rrStderr.waitForEOF(time.Second)
+			if startEvent > 0 {
+				log.Fatalf("Could not find gdb connection string that is given by rr. Is event %v within the trace?%v", startEvent, rrStderr.explain())
+			}
+			log.Fatalf("Could not find gdb connection string that is given by rr%v", rrStderr.explain())
 		}
 
 		fmt.Print(line)
 	}
 }
 
-// Starts gdb and creates a new DebugEngineState object
-func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string, bpMap map[string]int, levelAr []int, maxStackDepth int, rrFile *os.File, rrCmd *exec.Cmd, targetExtendedRemotePort int) *engineState {
+// rr's stderr is kept apart from the pty so that if rr fails to start (e.g. the trace does not exist or
+// cannot be read) its error message can be shown instead of a generic one
+type rrStderrCapture struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+	eof   chan bool
+}
 
-	gdbArgs := []string{
+// Only the beginning of rr's stderr is kept. That is where the reason rr could not start would be
+const rrStderrCaptureLimit = 4096
+
+func startRRReplay(replayCmd *exec.Cmd) (*os.File, *rrStderrCapture, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tty.Close()
+
+	stderr, err := replayCmd.StderrPipe()
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	replayCmd.Stdin = tty
+	replayCmd.Stdout = tty
+	replayCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = replayCmd.Start()
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	capture := &rrStderrCapture{eof: make(chan bool)}
+	go capture.copy(stderr)
+	return ptmx, capture, nil
+}
+
+// Like the rest of rr's output, its stderr is only passed through to the terminal if asked for
+func (c *rrStderrCapture) copy(stderr io.Reader) {
+	defer close(c.eof)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := stderr.Read(buf)
+		if n > 0 {
+			c.mutex.Lock()
+			if c.buf.Len() < rrStderrCaptureLimit {
+				c.buf.Write(buf[:n])
+			}
+			c.mutex.Unlock()
+
+			if ShowRROutput || VerboseFlag {
+				os.Stderr.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *rrStderrCapture) waitForEOF(timeout time.Duration) {
+	select {
+	case <-c.eof:
+	case <-time.After(timeout):
+	}
+}
+
+// Returns rr's error output along with some remediation or "" if rr did not say anything
+func (c *rrStderrCapture) explain() string {
+	c.mutex.Lock()
+	stderr := strings.TrimSpace(c.buf.String())
+	c.mutex.Unlock()
+
+	if stderr == "" {
+		return ""
+	}
+
+	explanation := "\nrr said: " + stderr
+	lower := strings.ToLower(stderr)
+	if strings.Contains(lower, "permission denied") {
+		explanation += "\nPlease check that you are able to read the rr trace directory (was it recorded as another user e.g. with sudo?)"
+	} else if strings.Contains(lower, "no such file") || strings.Contains(lower, "doesn't exist") || strings.Contains(lower, "not found") {
+		explanation += "\nPlease check that the trace exists. rr traces are looked for in " + getRRTraceHome() +
+			" (see --trace-dir and $_RR_TRACE_DIR)"
+	}
+
+	return explanation
+}
+
+// The rr command line that replays traceDir and serves gdb at targetExtendedRemotePort
+func replayCommandAr(traceDir string, rrPath string, targetExtendedRemotePort int, startEvent int) []string {
+	rrCmdAr := []string{
+		rrPath,
+		"replay",
+		"-s", strconv.Itoa(targetExtendedRemotePort),
+	}
+
+	// rr only starts serving gdb once it has replayed up to this event
+	if startEvent > 0 {
+		rrCmdAr = append(rrCmdAr, "-g", strconv.Itoa(startEvent))
+	}
+
+	return append(rrCmdAr, traceDir)
+}
+
+// hardlinkFile is given by rr when it starts serving gdb
+func gdbCommandAr(gdbExecutable string, hardlinkFile string, targetExtendedRemotePort int) []string {
+	return []string{
 		gdbExecutable,
 		"-l", "-1",
 		"-ex", fmt.Sprintf("target extended-remote :%v", targetExtendedRemotePort),
 		"--interpreter", "mi",
 		hardlinkFile,
 	}
+}
+
+// Starts gdb and creates a new DebugEngineState object
+func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string, bpMap map[string]int, levelAr []int, maxStackDepth int, funcLocMap map[engineBreakpointType]int, cLocs dontbugCLocations, rrFile *os.File, rrCmd *exec.Cmd, targetExtendedRemotePort int) *engineState {
 
+	gdbArgs := gdbCommandAr(gdbExecutable, hardlinkFile, targetExtendedRemotePort)
 	Verboseln("dontbug: Issuing command: ", strings.Join(gdbArgs, " "))
 
 	var gdbSession *gdb.Gdb
 	var err error
 
 	stopEventChan := make(chan string)
+	programExitChan := make(chan programExit, 1)
+	firstStopChan := make(chan string, 1)
+	otherStopChan := make(chan struct{}, 1)
+	// The stop at the start of the request (see seekToRequest()) goes on its own channel and does not count as
+	// the first stop. seeking is set by this goroutine and read by the gdb notification goroutine
+	seekStopChan := make(chan string, 1)
+	var seeking int32
+	// Only used in the gdb notification goroutine
 	started := false
 
 	gdbSession, err = gdb.NewCmd(gdbArgs,
@@ -267,44 +717,93 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 				fmt.Println(string(jsonResult))
 			}
 
+			captureGdbConsoleOutput(notification)
+			noteGdbRunState(notification)
+
+			if atomic.LoadInt32(&seeking) == 1 {
+				if _, ok := programExitGetStatus(notification); ok {
+					seekStopChan <- programExitedID
+				} else if id, ok := breakpointStopGetID(notification); ok {
+					seekStopChan <- id
+				}
+				return
+			}
+
+			exit, ok := programExitGetStatus(notification)
+			if ok {
+				// The program can exit before it ever got to the start breakpoint e.g. an empty trace
+				if !started {
+					started = true
+					firstStopChan <- programExitedID
+					return
+				}
+
+				programExitChan <- exit
+				stopEventChan <- programExitedID
+				return
+			}
+
 			id, ok := breakpointStopGetID(notification)
 			if ok {
-				// Don't send the very first stopped notification
+				// The very first stopped notification is not sent on stopEventChan
 				if started {
 					stopEventChan <- id
+				} else {
+					firstStopChan <- id
 				}
 
 				started = true
+			} else if notification["class"] == "stopped" && started {
+				select {
+				case otherStopChan <- struct{}{}:
+				default:
+				}
 			}
 		})
 
 	fatalIf(err)
 
-	go io.Copy(os.Stdout, gdbSession)
+	go copyProgramOutput(gdbSession, &ShowGdbOutput)
 
 	// This is our usual steppping breakpoint. Initially disabled.
-	miArgs := fmt.Sprintf("-f -d --source dontbug.c --line %v", dontbugCstepLineNum)
+	miArgs := fmt.Sprintf("-f -d --source dontbug.c --line %v", cLocs.master)
 	result := sendGdbCommand(gdbSession, "break-insert", miArgs)
 
+	// Used instead of the above when stepping at opcode granularity. Initially disabled.
+	miArgs = fmt.Sprintf("-f -d --source dontbug.c --line %v", cLocs.opcode)
+	result = sendGdbCommand(gdbSession, "break-insert", miArgs)
+	opcodeBp := result["payload"].(map[string]interface{})["bkpt"].(map[string]interface{})["number"].(string)
+
+	if StartAtRequest > 1 {
+		atomic.StoreInt32(&seeking, 1)
+		seekToRequest(gdbSession, seekStopChan, rrCmd, cLocs.request)
+		atomic.StoreInt32(&seeking, 0)
+	}
+
 	// Note that this is a temporary breakpoint, just to get things started
-	miArgs = fmt.Sprintf("-t -f --source dontbug.c --line %v", dontbugCstepLineNumTemp)
+	miArgs = fmt.Sprintf("-t -f --source dontbug.c --line %v", cLocs.start)
 	sendGdbCommand(gdbSession, "break-insert", miArgs)
 
-	// Unlimited print length in gdb so that results from gdb are not "chopped" off
-	sendGdbCommand(gdbSession, "gdb-set", "print elements 0")
+	// By default unlimited print length in gdb so that results from gdb are not "chopped" off
+	sendGdbCommand(gdbSession, "gdb-set", fmt.Sprintf("print elements %v", GdbPrintElements))
+	if GdbPrintElements > 0 {
+		logWarnf(color.FgYellow, "dontbug: --gdb-print-elements %v: IDE responses longer than %v characters will fail with an error", GdbPrintElements, GdbPrintElements)
+	}
+
+	// If a diversion session command is interrupted (e.g. it timed out) go back to where we were
+	sendGdbCommand(gdbSession, "gdb-set", "unwind-on-signal on")
 
-	// Should break on line: dontbugCstepLineNumTemp of dontbug.c
+	// Should break on line: cLocs.start of dontbug.c
 	sendGdbCommand(gdbSession, "exec-continue")
+	waitForFirstStop(firstStopChan, rrCmd)
 
-	result = sendGdbCommand(gdbSession, "data-evaluate-expression", "filename")
-	payload := result["payload"].(map[string]interface{})
-	filename := payload["value"].(string)
-	properFilename, err := parseGdbStringResponse(filename)
-	fatalIf(err)
+	properFilename := getInitialFilename(gdbSession, rrCmd)
 
 	es := &engineState{
 		gdbSession:      gdbSession,
 		breakStopNotify: stopEventChan,
+		otherStopNotify: otherStopChan,
+		exitNotify:      programExitChan,
 		featureMap:      initFeatureMap(),
 		entryFilePHP:    properFilename,
 		status:          statusStarting,
@@ -312,17 +811,34 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 		sourceMap:       bpMap,
 		lastSequenceNum: 0,
 		levelAr:         levelAr,
+		funcLocMap:      funcLocMap,
 		rrCmd:           rrCmd,
 		maxStackDepth:   maxStackDepth,
 		breakpoints:     make(map[string]*engineBreakPoint, 10),
 		rrFile:          rrFile,
+		opcodeBp:        opcodeBp,
+		gdbRemotePort:   targetExtendedRemotePort,
+		endSession:      make(chan string, 1),
+		lastActivity:    time.Now(),
+		rrExited:        make(chan struct{}),
+		closing:         make(chan struct{}),
 	}
+	go monitorRR(es)
 
 	// "1" is always the first breakpoint number in gdb
 	// Its used for stepping
 	es.breakpoints["1"] = &engineBreakPoint{
 		id:        "1",
-		lineno:    dontbugCstepLineNum,
+		lineno:    cLocs.master,
+		filename:  "dontbug.c",
+		state:     breakpointStateDisabled,
+		temporary: false,
+		bpType:    breakpointTypeInternal,
+	}
+
+	es.breakpoints[opcodeBp] = &engineBreakPoint{
+		id:        opcodeBp,
+		lineno:    cLocs.opcode,
 		filename:  "dontbug.c",
 		state:     breakpointStateDisabled,
 		temporary: false,
@@ -332,55 +848,250 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 	return es
 }
 
-func debuggerLoop(es *engineState, replayHost string, replayPort int) {
-	defer func() {
-		es.rrFile.Close()
-		err := es.rrCmd.Wait()
-		fatalIf(err)
+// If the PHP script never executed a statement (e.g. the recording was cut very early) we would never
+// get to the start breakpoint and dontbug would simply hang. Exit with some guidance instead
+func waitForFirstStop(firstStopChan <-chan string, rrCmd *exec.Cmd) {
+	select {
+	case id := <-firstStopChan:
+		if id != programExitedID {
+			return
+		}
+
+		logErrorf(color.FgRed, "dontbug: The PHP program exited without executing any PHP statement")
+	case <-time.After(InitialStopTimeout):
+		logErrorf(color.FgRed, "dontbug: The PHP program did not execute any PHP statement within %v", InitialStopTimeout)
+	}
+
+	rrCmd.Process.Kill()
+	log.Fatal("The rr trace appears to contain no PHP execution. " +
+		"Please check that the PHP script (or web request) actually ran during 'dontbug record' and record again")
+}
+
+// For replay --request. Runs to the start of the StartAtRequest'th PHP request (i.e. the hits of the request marker in
+// dontbug.c are counted) so that the replay starts at the first PHP statement of that request instead
+func seekToRequest(gdbSession *gdb.Gdb, seekStopChan <-chan string, rrCmd *exec.Cmd, requestLine int) {
+	if requestLine == 0 {
+		rrCmd.Process.Kill()
+		log.Fatal("The dontbug zend extension is too old for --request. Please 'dontbug record' again")
+	}
+
+	// A temporary breakpoint that ignores the hits for the earlier requests
+	miArgs := fmt.Sprintf("-t -f -i %v --source dontbug.c --line %v", StartAtRequest-1, requestLine)
+	result := sendGdbCommand(gdbSession, "break-insert", miArgs)
+	bpNum := result["payload"].(map[string]interface{})["bkpt"].(map[string]interface{})["number"].(string)
+
+	logInfof(color.FgYellow, "dontbug: Going to PHP request %v. This can take a while for a long trace", StartAtRequest)
+	sendGdbCommand(gdbSession, "exec-continue")
+	if <-seekStopChan != programExitedID {
+		logInfof(color.FgGreen, "dontbug: At the start of PHP request %v (skipped %v earlier request(s))", StartAtRequest, StartAtRequest-1)
+		return
+	}
+
+	// The breakpoint was hit (and ignored) once for every request in the trace
+	result = sendGdbCommand(gdbSession, "break-info", bpNum)
+	rrCmd.Process.Kill()
+	times, ok := findGdbResultField(result["payload"], "times")
+	if !ok {
+		log.Fatalf("The rr trace contains fewer than %v PHP requests", StartAtRequest)
+	}
+	log.Fatalf("The rr trace contains only %v PHP request(s). Can't start at request %v", times, StartAtRequest)
+}
+
+// Looks for a field anywhere in a (nested) gdb/mi result. Useful for tables like the result of break-info
+func findGdbResultField(result interface{}, name string) (interface{}, bool) {
+	switch value := result.(type) {
+	case map[string]interface{}:
+		if field, ok := value[name]; ok {
+			return field, true
+		}
+		for _, v := range value {
+			if field, ok := findGdbResultField(v, name); ok {
+				return field, true
+			}
+		}
+	case []interface{}:
+		for _, v := range value {
+			if field, ok := findGdbResultField(v, name); ok {
+				return field, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// At the start breakpoint, the PHP filename is in the "filename" variable of dontbug.c
+// If it can't be evaluated the dontbug.c gdb sees (via the debug info) is most likely not the one that was compiled
+// into the dontbug.so used during recording. Exit with some guidance rather than panicing or hanging
+func getInitialFilename(gdbSession *gdb.Gdb, rrCmd *exec.Cmd) string {
+	resultChan := make(chan map[string]interface{}, 1)
+	go func() {
+		resultChan <- sendGdbCommand(gdbSession, "data-evaluate-expression", "filename")
 	}()
-	defer es.gdbSession.Exit()
 
-	reverse := false
+	var result map[string]interface{}
+	select {
+	case result = <-resultChan:
+	case <-time.After(InitialStopTimeout):
+		rrCmd.Process.Kill()
+		log.Fatalf("Timed out after %v evaluating the PHP filename at the start of the replay", InitialStopTimeout)
+	}
+
+	mismatchMsg := "Could not evaluate the PHP filename at the start of the replay. " +
+		"Does dontbug.c match the dontbug.so extension that was used while recording? " +
+		"Please record again if the dontbug zend extension was rebuilt or changed since. "
+
+	class, _ := result["class"].(string)
+	payload, ok := result["payload"].(map[string]interface{})
+	if class != "done" || !ok {
+		rrCmd.Process.Kill()
+		log.Fatalf("%vgdb said: %v", mismatchMsg, result)
+	}
+
+	value, ok := payload["value"].(string)
+	if !ok {
+		rrCmd.Process.Kill()
+		log.Fatalf("%vgdb said: %v", mismatchMsg, payload)
+	}
+
+	filename, err := parseGdbStringResponse(value)
+	if err != nil {
+		rrCmd.Process.Kill()
+		log.Fatalf("%v%v", mismatchMsg, err)
+	}
+
+	return filename
+}
+
+// The history file is (in order of preference) HistoryFile, $DONTBUG_HISTORY, the legacy ~/.dontbug.history (if it
+// exists) or history in the dontbug home (see getDontbugHome())
+// Returns "" (i.e. in-memory history only) if the history file cannot be written to e.g. a read-only home
+func getWritableHistoryFile() string {
+	historyFile := HistoryFile
+	if historyFile == "" {
+		historyFile = os.Getenv("DONTBUG_HISTORY")
+	}
+
+	if historyFile == "" {
+		var err error
+		historyFile, err = getDefaultHistoryFile()
+		if err != nil {
+			logWarnf(color.FgYellow, "dontbug: Could not find where to keep the prompt history (%v). History will not be saved", err)
+			return ""
+		}
+	}
+
+	f, err := os.OpenFile(historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not open the prompt history file (%v). History will not be saved", err)
+		return ""
+	}
+	f.Close()
+
+	return historyFile
+}
+
+func getDefaultHistoryFile() (string, error) {
+	legacyHistoryFile := getHomeDir() + "/.dontbug.history"
+	if _, err := os.Stat(legacyHistoryFile); err == nil {
+		return legacyHistoryFile, nil
+	}
+
+	dontbugHome := getDontbugHome()
+	err := os.MkdirAll(dontbugHome, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return dontbugHome + "history", nil
+}
+
+// With noIde there is only the (dontbug) prompt e.g. to poke around with # and - commands
+func debuggerLoop(es *engineState, replayHost string, replayPorts []int, noIde bool) {
+	reverse := StartInReverse
 	mutex := &sync.Mutex{}
 	closeConChan := make(chan bool, 1)
 	defer func() {
 		closeConChan <- true
 	}()
-	go debuggerIdeLoop(es, closeConChan, mutex, &reverse, replayHost, replayPort)
+	if noIde {
+		logInfof(color.FgYellow, "dontbug: Not connecting to a debugger IDE (--no-ide)")
+	} else {
+		go debuggerIdeLoop(es, closeConChan, mutex, &reverse, replayHost, replayPorts)
+	}
 
 	fmt.Print("(dontbug) ") // prompt
-	currentUser, err := user.Current()
-	fatalIf(err)
-
-	historyFile := currentUser.HomeDir + "/.dontbug.history"
 	rdline, err := readline.NewEx(
 		&readline.Config{
-			Prompt:      "(dontbug) ",
-			HistoryFile: historyFile,
+			Prompt:       "(dontbug) ",
+			HistoryFile:  getWritableHistoryFile(),
+			HistoryLimit: HistoryLimit,
+			AutoComplete: promptCompleter{},
 		})
 
 	fatalIf(err)
-	defer rdline.Close()
+	var closeOnce sync.Once
+	closeRdline := func() {
+		closeOnce.Do(func() { rdline.Close() })
+	}
+	defer closeRdline()
+
+	// A stop from the IDE (or --idle-action=stop) ends the whole session. Closing readline gets us out of
+	// Readline() below and DoReplay() then tears down rr and gdb
+	sessionEnded := false
+	go func() {
+		logInfof(color.FgYellow, "%v", <-es.endSession)
+		mutex.Lock()
+		sessionEnded = true
+		mutex.Unlock()
+		closeRdline()
+	}()
 
 	color.Yellow("h <enter> for help. If the prompt does not display press <enter>")
+	printDirection(reverse)
+	if VerboseFlag {
+		color.Red("Verbose mode")
+	}
+	if ShowGdbNotifications {
+		color.Red("Will show gdb notifications")
+	}
+	if IdleTimeout > 0 {
+		go watchIdle(es)
+	}
+	dumpStateOnSignal(es)
 	for {
 		userResponse, err := rdline.Readline()
-		if err == io.EOF || err == readline.ErrInterrupt {
+		noteActivity(es)
+		mutex.Lock()
+		isSessionEnded := sessionEnded
+		mutex.Unlock()
+		if isSessionEnded {
+			return
+		} else if err == io.EOF || err == readline.ErrInterrupt {
 			color.Yellow("Exiting.")
 			return
 		} else if err != nil {
 			log.Fatal(err)
 		}
 
+		if rrHasExited(es) && !strings.HasPrefix(userResponse, "q") && !strings.HasPrefix(userResponse, "h") {
+			color.Red("rr has exited so the replay cannot continue. Please q (quit) and replay again")
+			continue
+		}
+
 		if strings.HasPrefix(userResponse, "t") {
 			mutex.Lock()
 			reverse = !reverse
 			mutex.Unlock()
-			if reverse {
-				color.Red("In reverse mode")
-			} else {
-				color.Green("In forward mode")
+			printDirection(reverse)
+		} else if strings.HasPrefix(userResponse, "files") {
+			filter := strings.TrimSpace(userResponse[len("files"):])
+			asJSON := false
+			if strings.HasPrefix(filter, "--json") {
+				asJSON = true
+				filter = strings.TrimSpace(filter[len("--json"):])
 			}
+			printSourceMap(es.sourceMap, filter, asJSON)
 		} else if strings.HasPrefix(userResponse, "r") {
 			mutex.Lock()
 			reverse = true
@@ -393,7 +1104,11 @@ func debuggerLoop(es *engineState, replayHost string, replayPort int) {
 			color.Green("In forward mode")
 		} else if strings.HasPrefix(userResponse, "-") {
 			command := strings.TrimSpace(userResponse[1:])
-			result := sendGdbCommand(es.gdbSession, command)
+			result, err := trySendGdbCommand(es.gdbSession, command)
+			if err != nil {
+				color.Red("%v", err)
+				continue
+			}
 
 			jsonResult, err := json.MarshalIndent(result, "", "  ")
 			fatalIf(err)
@@ -413,8 +1128,99 @@ func debuggerLoop(es *engineState, replayHost string, replayPort int) {
 			} else {
 				color.Green("Wont show gdb notifications")
 			}
+		} else if strings.HasPrefix(userResponse, "s") {
+			mutex.Lock()
+			isReverse := reverse
+			mutex.Unlock()
+			printEngineStatus(es, isReverse)
+		} else if strings.HasPrefix(userResponse, "where") {
+			err := printRRPosition(es)
+			if err != nil {
+				color.Red("%v", err)
+			}
+		} else if strings.HasPrefix(userResponse, "wd") {
+			index, err := strconv.Atoi(strings.TrimSpace(userResponse[2:]))
+			if err != nil || !removeWatchAt(es, index) {
+				color.Red("Please provide a valid watch expression number. See w")
+			}
+		} else if strings.HasPrefix(userResponse, "w") {
+			expression := strings.TrimSpace(userResponse[1:])
+			if expression != "" {
+				err := addWatch(es, expression)
+				if err != nil {
+					color.Red("%v", err)
+				}
+			}
+			printWatches(es)
+		} else if strings.HasPrefix(userResponse, "evalall") {
+			err := evalInAllFrames(es, strings.TrimSpace(userResponse[len("evalall"):]))
+			if err != nil {
+				color.Red("%v", err)
+			}
+		} else if strings.HasPrefix(userResponse, "diff") {
+			mutex.Lock()
+			isReverse := reverse
+			mutex.Unlock()
+			err := diffAcrossStep(es, strings.TrimSpace(userResponse[len("diff"):]), isReverse)
+			if err != nil {
+				color.Red("%v", err)
+			}
+		} else if strings.HasPrefix(userResponse, "e") {
+			if toggleExplainMoves() {
+				color.Green("Will explain what the IDE's run/step commands do")
+			} else {
+				color.Green("Won't explain the IDE's run/step commands")
+			}
+		} else if strings.HasPrefix(userResponse, "marks") {
+			printBookmarks(es)
+		} else if strings.HasPrefix(userResponse, "mark") {
+			b, err := markBookmark(es, strings.TrimSpace(userResponse[len("mark"):]))
+			if err != nil {
+				color.Red("%v", err)
+			} else {
+				color.Green("Bookmarked %v", b)
+			}
+		} else if strings.HasPrefix(userResponse, "goto") {
+			b, err := gotoBookmark(es, strings.TrimSpace(userResponse[len("goto"):]))
+			if err != nil {
+				color.Red("%v", err)
+			} else {
+				color.Green("Back at %v. Step in your PHP IDE to see it there", b)
+			}
+		} else if strings.HasPrefix(userResponse, "g") {
+			mutex.Lock()
+			isReverse := reverse
+			mutex.Unlock()
+			location, err := gotoPhpLocation(es, strings.TrimSpace(userResponse[1:]), isReverse)
+			if err != nil {
+				color.Red("%v", err)
+			} else {
+				color.Green("At %v. Step in your PHP IDE to see it there", location)
+			}
+		} else if strings.HasPrefix(userResponse, "b") {
+			location, err := bounceLastMove(es)
+			if err != nil {
+				color.Red("%v", err)
+			} else {
+				color.Green("At %v. Step in your PHP IDE to see it there", location)
+			}
+		} else if strings.HasPrefix(userResponse, "c") {
+			mutex.Lock()
+			isReverse := reverse
+			mutex.Unlock()
+			location, err := continueUntilCondition(es, strings.TrimSpace(userResponse[1:]), isReverse)
+			if err != nil {
+				color.Red("%v", err)
+			} else {
+				color.Green("Condition is true at %v. Step in your PHP IDE to see it there", location)
+			}
 		} else if strings.HasPrefix(userResponse, "#") {
 			command := strings.TrimSpace(userResponse[1:])
+			err := checkEvalCommandSafe(es, command)
+			if err != nil {
+				color.Red("%v", err)
+				continue
+			}
 
 			// @TODO blacklist commands that are handled in gdb or dontbug instead
 			xmlResult := recoverableDiversionSessionCmd(es, command)
@@ -425,52 +1231,230 @@ func debuggerLoop(es *engineState, replayHost string, replayPort int) {
 		} else if strings.HasPrefix(userResponse, "h") {
 			fmt.Println(gHelpText)
 		} else {
-			if reverse {
-				color.Red("In reverse mode")
-			} else {
-				color.Green("In forward mode")
+			printDirection(reverse)
+		}
+	}
+}
+
+func printDirection(reverse bool) {
+	if reverse {
+		color.Red("In reverse mode")
+	} else {
+		color.Green("In forward mode")
+	}
+}
+
+func printEngineStatus(es *engineState, reverse bool) {
+	direction := "forward"
+	if reverse {
+		direction = "reverse"
+	}
+
+	status, reason := getStatus(es)
+	fmt.Printf("status:           %v (reason: %v)\n", status, reason)
+	fmt.Printf("direction:        %v\n", direction)
+	fmt.Printf("entry file:       %v\n", es.entryFilePHP)
+	fmt.Printf("last sequence no: %v\n", es.lastSequenceNum)
+	if es.programExit != nil {
+		fmt.Printf("PHP program:      %v\n", es.programExit)
+	}
+
+	es.breakpointsMutex.Lock()
+	defer es.breakpointsMutex.Unlock()
+
+	var ids []int
+	for id, bp := range es.breakpoints {
+		if bp.bpType == breakpointTypeInternal {
+			continue
+		}
+
+		idNum, err := strconv.Atoi(id)
+		fatalIf(err)
+		ids = append(ids, idNum)
+	}
+
+	if len(ids) == 0 {
+		fmt.Println("breakpoints:      none")
+		return
+	}
+
+	sort.Ints(ids)
+	fmt.Println("breakpoints:")
+	for _, idNum := range ids {
+		bp := es.breakpoints[strconv.Itoa(idNum)]
+
+		location := fmt.Sprintf("%v:%v", bp.filename, bp.lineno)
+		if bp.bpType == breakpointTypeCall || bp.bpType == breakpointTypeReturn {
+			location = bp.function
+			if bp.class != "" {
+				location = bp.class + "::" + bp.function
 			}
 		}
+
+		extra := ""
+		if bp.hitCondition != "" {
+			extra += fmt.Sprintf(" (hit %v %v)", bp.hitCondition, bp.hitValue)
+		}
+		if bp.temporary {
+			extra += " temporary"
+		}
+
+		fmt.Printf("  %-4v %-7v %-9v %v hits=%v%v\n", bp.id, bp.bpType, bp.state, location, bp.hitCount, extra)
 	}
 }
 
-func debuggerIdeLoop(es *engineState, closeConnChan chan bool, mutex *sync.Mutex, reverse *bool, replayHost string, replayPort int) {
-	color.Yellow("dontbug: Trying to connect to debugger IDE")
-	conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", replayHost, replayPort))
-	if err != nil {
-		log.Fatalf("%v: Is your IDE listening for debugging connections from PHP?", err)
+// We're shutting down so rr dying due to a signal or exiting with a non-zero status
+// (e.g. as the pty was closed or gdb detached midway through the trace) is expected
+// Only errors that don't come from rr itself are reported
+func waitForRRExit(rrCmd *exec.Cmd) {
+	err := rrCmd.Wait()
+	if err == nil {
+		return
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		logErrorf(color.FgRed, "dontbug: Error while waiting for rr to exit: %v", err)
+		return
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		Verbosef("dontbug: rr was terminated by signal: %v\n", status.Signal())
+	} else {
+		Verbosef("dontbug: rr exited with: %v\n", exitErr)
 	}
+}
+
+// IDE commands are NUL terminated (unlike our responses which are length prefixed, see constructDbgpPacket())
+// Reading up to each NUL means several commands that arrive together are handled one after the other, in order
+// Stray NULs and whitespace (e.g. a trailing newline) between commands are skipped. A last command that is
+// not NUL terminated is still returned if the IDE closes the connection right after it
+func readDbgpCommand(buf *bufio.Reader) (string, error) {
+	for {
+		command, err := buf.ReadString(byte(0))
+		command = strings.TrimSpace(strings.TrimRight(command, "\x00"))
+		if err != nil {
+			if err == io.EOF && command != "" {
+				return command, nil
+			}
+			return "", err
+		}
+
+		if command != "" {
+			return command, nil
+		}
+	}
+}
+
+// Tries the ports in order and returns the connection to the first one at which an IDE is listening
+func dialIde(replayHost string, replayPorts []int) net.Conn {
+	// Also accept an IPv6 address in brackets e.g. [::1] as in a URL. net.JoinHostPort() adds the brackets itself
+	replayHost = strings.TrimSuffix(strings.TrimPrefix(replayHost, "["), "]")
+	var tlsConfig *tls.Config
+	if IdeTLS {
+		tlsConfig = ideTLSConfig(replayHost)
+	} else if !isLoopbackHost(replayHost) {
+		logWarnf(color.FgYellow, "dontbug: Connecting to the IDE at %v which is not on this machine. "+
+			"The dbgp protocol is unauthenticated and unencrypted so only do this on a network you trust "+
+			"(or over an ssh tunnel or with --ide-tls)", replayHost)
+	}
+
+	var errs []string
+	for _, port := range replayPorts {
+		address := net.JoinHostPort(replayHost, strconv.Itoa(port))
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			// The handshake (and certificate verification) happens here so a bad certificate is reported now
+			conn, err = tls.Dial("tcp", address, tlsConfig)
+		} else {
+			conn, err = net.Dial("tcp", address)
+		}
+		if err == nil {
+			return conn
+		}
+		errs = append(errs, err.Error())
+	}
+
+	log.Fatalf("%v\nIs your IDE listening for debugging connections from PHP? Tried port(s) %v. "+
+		"Use --replay-port or --ide-ports if your IDE listens elsewhere", strings.Join(errs, "\n"), joinPorts(replayPorts))
+	return nil
+}
+
+// A hostname counts as loopback only if all its addresses are
+func isLoopbackHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func joinPorts(ports []int) string {
+	portStrings := make([]string, len(ports))
+	for i, port := range ports {
+		portStrings[i] = strconv.Itoa(port)
+	}
+
+	return strings.Join(portStrings, ",")
+}
+
+// Returns true if the IDE ended the session cleanly i.e. via stop or detach
+func debuggerIdeLoop(es *engineState, closeConnChan chan bool, mutex *sync.Mutex, reverse *bool, replayHost string, replayPorts []int) bool {
+	logInfof(color.FgYellow, "dontbug: Trying to connect to debugger IDE")
+	conn := dialIde(replayHost, replayPorts)
 	es.ideConnection = conn
+	es.sequenceNumSeen = false // Every IDE connection has its own sequence numbers
 	defer func() {
-		color.Yellow("dontbug: Closing connection to IDE")
+		logInfof(color.FgYellow, "dontbug: Closing connection to IDE")
 		conn.Close()
 		es.ideConnection = nil
 		fmt.Print("(dontbug) ")
 	}()
 
 	// send the init packet
-	payload := fmt.Sprintf(gInitXMLResponseFormat, es.entryFilePHP, os.Getpid())
+	payload := mapRecordedResponse(fmt.Sprintf(gInitXMLResponseFormat, es.entryFilePHP, os.Getpid()))
 	packet := constructDbgpPacket(payload)
-	_, err = conn.Write(packet)
+	_, err := conn.Write(packet)
 	fatalIf(err)
 
-	color.Green("dontbug: Connected to PHP IDE debugger")
+	logInfof(color.FgGreen, "dontbug: Connected to PHP IDE debugger at %v", conn.RemoteAddr())
 	buf := bufio.NewReader(conn)
 
+	// Only read after closeConnChan delivers
+	clean := false
 	go func(closeChan chan<- bool) {
 		defer func() {
 			r := recover()
 			if r != nil {
 				fmt.Println(r)
 				fmt.Println("Recovering from panic....")
-				color.Yellow("dontbug: Initiating shutdown of IDE connection. The dontbug prompt will be still operable")
+				logWarnf(color.FgYellow, "dontbug: Initiating shutdown of IDE connection. The dontbug prompt will be still operable")
+			} else {
+				status, _ := getStatus(es)
+				clean = status == statusStopped
 			}
 			closeChan <- true
 		}()
 
-		for es.status != statusStopped {
-			command, err := buf.ReadString(byte(0))
-			command = strings.TrimRight(command, "\x00")
+		for {
+			if status, _ := getStatus(es); status == statusStopped {
+				break
+			}
+
+			command, err := readDbgpCommand(buf)
 			if err == io.EOF {
 				Verboseln("dontbug: EOF Received on tcp connection to IDE")
 				break
@@ -479,9 +1463,8 @@ func debuggerIdeLoop(es *engineState, closeConnChan chan bool, mutex *sync.Mutex
 				break
 			}
 
-			if VerboseFlag {
-				color.Cyan("\nide -> dontbug: %v", command)
-			}
+			logDebugf(color.FgCyan, "\nide -> dontbug: %v", command)
+			noteActivity(es)
 
 			mutex.Lock()
 			reverseVal := *reverse
@@ -489,85 +1472,204 @@ func debuggerIdeLoop(es *engineState, closeConnChan chan bool, mutex *sync.Mutex
 
 			payload = dispatchIdeRequest(es, command, reverseVal)
 			conn.Write(constructDbgpPacket(payload))
+			noteActivity(es) // A long run/step only counts from when it ends
 
-			if VerboseFlag {
+			if logEnabled(LogLevelDebug) {
 				continued := ""
 				if len(payload) > 300 {
 					continued = "..."
 				}
-				color.Green("dontbug -> ide:\n%.300v%v", payload, continued)
+				logDebugf(color.FgGreen, "dontbug -> ide:\n%.300v%v", payload, continued)
 				fmt.Print("(dontbug) ")
 			}
 		}
 	}(closeConnChan)
 	<-closeConnChan
+
+	return clean
+}
+
+// Sends a <notify> packet to the IDE if it has asked for them (via feature_set -n notify_ok -v 1)
+// IDEs ignore notifications they don't know about so name can be dontbug specific
+func notifyIde(es *engineState, name, message string) {
+	conn := es.ideConnection
+	if conn == nil || es.featureMap["notify_ok"].String() != "1" {
+		return
+	}
+
+	conn.Write(constructDbgpPacket(fmt.Sprintf(gNotifyXMLFormat, name, html.EscapeString(message))))
+}
+
+// A handler returns the response payload or an error. See dbgpErrorResponse()
+type dbgpCmdHandler func(*engineState, dbgpCmd) (string, error)
+
+// Maps a dbgp command name to its handler.
+// This table is also the source of truth for what we advertise to the IDE in feature_get
+// Populated in init() as some handlers (e.g. feature_get) consult the table themselves
+var gDbgpCmdHandlers map[string]dbgpCmdHandler
+
+func init() {
+	gDbgpCmdHandlers = map[string]dbgpCmdHandler{
+		"feature_set":       handleFeatureSet,
+		"feature_get":       handleFeatureGet,
+		"status":            handleStatus,
+		"breakpoint_set":    handleBreakpointSet,
+		"breakpoint_get":    handleBreakpointGet,
+		"breakpoint_remove": handleBreakpointRemove,
+		"breakpoint_update": handleBreakpointUpdate,
+		"step_into":         guardContinuation(handleStepInto),
+		"step_over": guardContinuation(func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return handleStepOverOrOut(es, dCmd, false)
+		}),
+		"step_out": guardContinuation(func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return handleStepOverOrOut(es, dCmd, true)
+		}),
+		"eval": handleEval,
+		"stdout": func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return handleStdFd(es, dCmd, "stdout")
+		},
+		"stdin": func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return handleStdFd(es, dCmd, "stdin")
+		},
+		"stderr": func(es *engineState, dCmd dbgpCmd) (string, error) {
+			return handleStdFd(es, dCmd, "stderr")
+		},
+		"property_set":   handlePropertySet,
+		"property_get":   handlePropertyGet,
+		"property_value": handlePropertyValue,
+		"context_get":    handleInDiversionSessionAtStackDepth,
+		"run":            guardContinuation(handleRun),
+		"stop": func(es *engineState, dCmd dbgpCmd) (string, error) {
+			logInfof(color.FgYellow, "IDE sent 'stop' command")
+			select {
+			case es.endSession <- "dontbug: The IDE sent stop. Exiting.":
+			default:
+			}
+			return handleStop(es, dCmd)
+		},
+		// There is no PHP program to let run on its own in a replay so this is the same as stop except
+		// that the (dontbug) prompt is kept
+		"detach": func(es *engineState, dCmd dbgpCmd) (string, error) {
+			logInfof(color.FgYellow, "IDE sent 'detach' command")
+			return handleStop(es, dCmd)
+		},
+		// All these are dealt with in handleInDiversionSessionStandard()
+		"stack_get":     handleInDiversionSessionStandard,
+		"stack_depth":   handleInDiversionSessionStandard,
+		"context_names": handleInDiversionSessionStandard,
+		"typemap_get":   handleInDiversionSessionStandard,
+		"source":        handleInDiversionSessionStandard,
+	}
+}
+
+// Returns a sorted, space separated list of dbgp commands we're able to handle
+func supportedCommands() string {
+	commands := make([]string, 0, len(gDbgpCmdHandlers))
+	for command := range gDbgpCmdHandlers {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return strings.Join(commands, " ")
+}
+
+// Responses are always built with the sequence number of the command they answer (dbgpCmd.seqNum) so a
+// buggy IDE that reuses or reorders sequence numbers only gets a warning here
+func checkSequenceNum(es *engineState, dCmd dbgpCmd) {
+	if es.sequenceNumSeen {
+		if dCmd.seqNum == es.lastSequenceNum {
+			logWarnf(color.FgYellow, "dontbug: IDE reused sequence number %v in: %v", dCmd.seqNum, dCmd.fullCommand)
+		} else if dCmd.seqNum < es.lastSequenceNum {
+			logWarnf(color.FgYellow, "dontbug: IDE sent sequence number %v after %v in: %v", dCmd.seqNum, es.lastSequenceNum, dCmd.fullCommand)
+		}
+	}
+
+	es.lastSequenceNum = dCmd.seqNum
+	es.sequenceNumSeen = true
 }
 
 func dispatchIdeRequest(es *engineState, command string, reverseMode bool) string {
+	return mapRecordedResponse(dispatchMappedIdeRequest(es, mapIdeCommand(command), reverseMode))
+}
+
+// A gdb timeout anywhere in the handler is answered with an error response like any other failed command
+func callDbgpCmdHandler(handler dbgpCmdHandler, es *engineState, dCmd dbgpCmd) (_ string, err error) {
+	defer recoverGdbTimeout(&err)
+	return handler(es, dCmd)
+}
+
+// command has already been path mapped (see --path-map)
+func dispatchMappedIdeRequest(es *engineState, command string, reverseMode bool) string {
 	dbgpCmd := parseCommand(command, reverseMode)
-	es.lastSequenceNum = dbgpCmd.seqNum
-
-	switch dbgpCmd.command {
-	case "feature_set":
-		return handleFeatureSet(es, dbgpCmd)
-	case "feature_get":
-		return handleFeatureGet(es, dbgpCmd)
-	case "status":
-		return handleStatus(es, dbgpCmd)
-	case "breakpoint_set":
-		return handleBreakpointSet(es, dbgpCmd)
-	case "breakpoint_remove":
-		return handleBreakpointRemove(es, dbgpCmd)
-	case "breakpoint_update":
-		return handleBreakpointUpdate(es, dbgpCmd)
-	case "step_into":
-		return handleStepInto(es, dbgpCmd)
-	case "step_over":
-		return handleStepOverOrOut(es, dbgpCmd, false)
-	case "step_out":
-		return handleStepOverOrOut(es, dbgpCmd, true)
-	case "eval":
-		return handleInDiversionSessionWithNoGdbBpts(es, dbgpCmd)
-	case "stdout":
-		return handleStdFd(es, dbgpCmd, "stdout")
-	case "stdin":
-		return handleStdFd(es, dbgpCmd, "stdin")
-	case "stderr":
-		return handleStdFd(es, dbgpCmd, "stderr")
-	case "property_set":
-		return handlePropertySet(es, dbgpCmd)
-	case "property_get":
-		return handleInDiversionSessionWithNoGdbBpts(es, dbgpCmd)
-	case "context_get":
-		return handleInDiversionSessionWithNoGdbBpts(es, dbgpCmd)
-	case "run":
-		return handleRun(es, dbgpCmd)
-	case "stop":
-		color.Yellow("IDE sent 'stop' command")
-		return handleStop(es, dbgpCmd)
-	// All these are dealt with in handleInDiversionSessionStandard()
-	case "stack_get":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "stack_depth":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "context_names":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "typemap_get":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "source":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "property_value":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	default:
-		es.sourceMap = nil // Just to reduce size of map dump to stdout
-		fmt.Println(es)
-		panicIf(fmt.Errorf("Unimplemented command: %v", command))
-	}
-
-	return ""
-}
-
-func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int) {
+	checkSequenceNum(es, dbgpCmd)
+
+	handler, ok := gDbgpCmdHandlers[dbgpCmd.command]
+	if !ok {
+		logWarnf(color.FgYellow, "dontbug: Unimplemented command from the IDE: %v", command)
+		return dbgpErrorResponse(dbgpCmd, newDbgpError(dbgpErrorCodeUnimplemented, "Unimplemented command: %v", dbgpCmd.command))
+	}
+
+	// Ordering guarantees:
+	// - the engine is fully set up (rr and gdb are at the first PHP statement) before the init packet is sent so
+	//   IDE commands that follow it immediately (e.g. a burst of feature_set and breakpoint_set) are fine
+	// - IDE commands are handled one at a time, in the order they were received
+	// - if a continuation started at the (dontbug) prompt is in progress, commands that need gdb are held back
+	//   till it is done. If that takes too long, the IDE gets a spec compliant error response instead
+	// - while such a command is handled, no continuation can start at the prompt. Runs and steps hold the
+	//   engine themselves (see guardContinuation()) so they only wait here
+	if !gCommandsAnsweredWhileRunning[dbgpCmd.command] {
+		hold := !gMoveCommands[dbgpCmd.command]
+		if !waitForEngine(es, continuationWaitTimeout, hold) {
+			return dbgpErrorResponse(dbgpCmd, newDbgpError(dbgpErrorCodeCommandNotAvailable,
+				"dontbug is busy with a continuation started from the (dontbug) prompt"))
+		}
+		if hold {
+			defer releaseEngine(es)
+		}
+	}
+
+	if gMoveCommands[dbgpCmd.command] {
+		es.moveMutex.Lock()
+		lastMoveCmd := dbgpCmd
+		es.lastMoveCmd = &lastMoveCmd
+		es.moveMutex.Unlock()
+		explainMove(dbgpCmd)
+	}
+
+	payload, err := callDbgpCmdHandler(handler, es, dbgpCmd)
+	if err != nil {
+		Verbosef("dontbug: %v failed: %v\n", dbgpCmd.command, err)
+		return dbgpErrorResponse(dbgpCmd, err)
+	}
+
+	return payload
+}
+
+// A dontbug_break.c generated by a different version of dontbug can have a different layout and would lead to
+// breakpoints being set at the wrong places
+func checkBreakFileFormatVersion(dontbugBreakFilename, line string) {
+	indexVersion := strings.Index(line, formatVersionSentinel)
+	if indexVersion == -1 {
+		logWarnf(color.FgYellow, "dontbug: %v was generated by an older version of dontbug. If breakpoints misbehave, please 'dontbug record' again", dontbugBreakFilename)
+		return
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(line[indexVersion+len(formatVersionSentinel):]))
+	if err != nil {
+		log.Fatalf("Could not understand the format version in %v: %q", dontbugBreakFilename, line)
+	}
+
+	if version != dontbugBreakFormatVersion {
+		log.Fatalf("%v has format version %v but this dontbug expects format version %v. Please 'dontbug record' again",
+			dontbugBreakFilename, version, dontbugBreakFormatVersion)
+	}
+}
+
+// Returns
+// - a map of PHP filename => line number in dontbug_break.c for line breakpoints
+// - an array of PHP stack level => line number in dontbug_break.c for stack level breakpoints
+// - the max stack depth
+// - a map of PHP breakpoint type (call/return) => line number in dontbug_break.c for function breakpoints
+func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int, map[engineBreakpointType]int) {
 	absExtDir := getAbsNoSymlinkPath(extensionDir)
 	dontbugBreakFilename := absExtDir + "/dontbug_break.c"
 	Verboseln("dontbug: Looking for dontbug_break.c in", absExtDir)
@@ -605,38 +1707,156 @@ func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int)
 	maxStackDepth, err := strconv.Atoi(strings.TrimSpace(line[indexMaxStackDepth+len(maxStackDepthSentinel):]))
 	fatalIf(err)
 
+	// Older versions of dontbug_break.c don't have the format version line. In that case this is a blank line
+	line, err = buf.ReadString('\n')
+	lineno++
+	fatalIf(err)
+	checkBreakFileFormatVersion(dontbugBreakFilename, line)
+
 	levelLocAr := make([]int, maxStackDepth)
+	funcLocMap := make(map[engineBreakpointType]int, 2)
+
+	// For diagnostics in case dontbug_break.c turns out to be inconsistent
+	duplicates := make(map[string][]int)
+	var hashLines []int       // line numbers of hash comments that have no filename sentinel after them
+	var orphanFilenames []int // line numbers of filename sentinels that have no hash comment before them
 
 	for {
 		line, err := buf.ReadString('\n')
 		lineno++
-		if err == io.EOF {
-			break
-		} else if err != nil {
+		if err != nil && err != io.EOF {
 			log.Fatal(err)
 		}
 
+		// Without a newline at the end of the file the last line comes along with io.EOF. It must still be processed
+		if err == io.EOF && line == "" {
+			break
+		}
+
 		indexB := strings.Index(line, phpFilenameSentinel)
 		indexL := strings.Index(line, levelSentinel)
+		if strings.Contains(line, hashCommentMarker) {
+			hashLines = append(hashLines, lineno)
+		}
+
 		if indexB != -1 {
-			filename := strings.TrimSpace("file://" + line[indexB+dontbugCpathStartsAt:])
-			_, ok := bpLocMap[filename]
+			// Don't assume anything about the spacing between the sentinel and the filename
+			filename := "file://" + strings.TrimSpace(line[indexB+len(phpFilenameSentinel):])
+			firstLineno, ok := bpLocMap[filename]
 			if ok {
-				log.Fatal("dontbug: Sanity check failed. Duplicate entry for filename: ", filename)
+				if _, seen := duplicates[filename]; !seen {
+					duplicates[filename] = []int{firstLineno}
+				}
+				duplicates[filename] = append(duplicates[filename], lineno)
+			} else {
+				bpLocMap[filename] = lineno
+			}
+
+			// Every filename sentinel line immediately follows its hash comment line
+			if len(hashLines) == 0 || hashLines[len(hashLines)-1] != lineno-1 {
+				orphanFilenames = append(orphanFilenames, lineno)
+			} else {
+				hashLines = hashLines[:len(hashLines)-1]
 			}
-			bpLocMap[filename] = lineno
 		}
 
 		if indexL != -1 {
+			if level >= maxStackDepth {
+				log.Fatalf("dontbug: Sanity check failed. dontbug_break.c has more stack level locations than its max stack depth of %v", maxStackDepth)
+			}
 			levelLocAr[level] = lineno
 			level++
 		}
+
+		// Older versions of dontbug_break.c don't have these
+		indexF := strings.Index(line, functionSentinel)
+		if indexF != -1 {
+			bpType := engineBreakpointType(strings.TrimSpace(line[indexF+len(functionSentinel):]))
+			funcLocMap[bpType] = lineno
+		}
+
+		if err == io.EOF {
+			break
+		}
 	}
 
-	if len(bpLocMap) != numFiles {
-		log.Fatal("dontbug: Consistency check failed. dontbug_break.c file says ", numFiles, " files. However ", len(bpLocMap), " files were found")
+	if len(bpLocMap) != numFiles || len(duplicates) > 0 {
+		log.Fatal(breakFileConsistencyReport(dontbugBreakFilename, numFiles, bpLocMap, duplicates, hashLines, orphanFilenames))
 	}
 
 	Verboseln("dontbug: Completed building association of filename => linenumbers and levels => linenumbers for breakpoints")
-	return bpLocMap, levelLocAr, maxStackDepth
+	return bpLocMap, levelLocAr, maxStackDepth, funcLocMap
+}
+
+// Explains why dontbug_break.c failed the consistency check so that the user knows what is wrong
+func breakFileConsistencyReport(
+	dontbugBreakFilename string,
+	numFiles int,
+	bpLocMap map[string]int,
+	duplicates map[string][]int,
+	hashLines []int,
+	orphanFilenames []int,
+) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "dontbug: Consistency check failed for %v\n", dontbugBreakFilename)
+	fmt.Fprintf(&buf, "The file says it has %v files. However %v distinct files were found\n", numFiles, len(bpLocMap))
+
+	if len(duplicates) > 0 {
+		fmt.Fprintln(&buf, "Duplicate entries (filename: line numbers in dontbug_break.c):")
+		for _, filename := range sortedKeys(duplicates) {
+			fmt.Fprintf(&buf, "    %v: %v\n", filename, duplicates[filename])
+		}
+	}
+
+	if len(hashLines) > 0 {
+		fmt.Fprintln(&buf, "Hash entries without a filename (line numbers in dontbug_break.c):", hashLines)
+	}
+
+	if len(orphanFilenames) > 0 {
+		fmt.Fprintln(&buf, "Filenames without a hash entry (line numbers in dontbug_break.c):", orphanFilenames)
+	}
+
+	var missing []string
+	for filename := range bpLocMap {
+		_, err := os.Stat(strings.TrimPrefix(filename, "file://"))
+		if err != nil {
+			missing = append(missing, filename)
+		}
+	}
+	sort.Strings(missing)
+
+	if len(missing) > 0 {
+		fmt.Fprintln(&buf, "Files which don't exist anymore:")
+		for _, filename := range missing {
+			fmt.Fprintf(&buf, "    %v\n", filename)
+		}
+	}
+
+	fmt.Fprint(&buf, "dontbug_break.c was probably partially (re)generated or edited by hand. Please do a 'dontbug record' again")
+	return buf.String()
+}
+
+func sortedKeys(m map[string][]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rr and gdb chatter is kept out of the terminal unless asked for (or in verbose mode)
+// The output is always read so that rr/gdb never block on a full pty. show is checked every time as
+// verbose mode can be toggled from the (dontbug) prompt
+func copyProgramOutput(r io.Reader, show *bool) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 && (*show || VerboseFlag) {
+			os.Stdout.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
 }
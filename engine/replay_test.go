@@ -0,0 +1,161 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Writes a dontbug_break.c with body after the header lines into a new directory and returns the directory
+func writeTestBreakFile(t *testing.T, numFiles, maxStackDepth int, body string) string {
+	dir, err := ioutil.TempDir("", "dontbug-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := fmt.Sprintf("%v%v\n%v%v\n%v%v\n", numFilesSentinel, numFiles, maxStackDepthSentinel, maxStackDepth,
+		formatVersionSentinel, dontbugBreakFormatVersion)
+	err = ioutil.WriteFile(path.Join(dir, "dontbug_break.c"), []byte(header+body), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestConstructBreakpointLocMapFilenameSpacing(t *testing.T) {
+	dir := writeTestBreakFile(t, 2, 1, ""+
+		"        // hash == 1\n"+
+		"        return; //### /srv/a.php\n"+
+		"        // hash == 2\n"+
+		"        return;      //###      /srv/dir with spaces/b.php   \n"+
+		"        count++; //$$$ 0\n")
+	defer os.RemoveAll(dir)
+
+	bpLocMap, levelLocAr, maxStackDepth, _ := constructBreakpointLocMap(dir)
+	expected := map[string]int{"file:///srv/a.php": 5, "file:///srv/dir with spaces/b.php": 7}
+	for filename, lineno := range expected {
+		if bpLocMap[filename] != lineno {
+			t.Errorf("%v is at line %v of dontbug_break.c. Got %v (map: %v)", filename, lineno, bpLocMap[filename], bpLocMap)
+		}
+	}
+
+	if maxStackDepth != 1 || len(levelLocAr) != 1 || levelLocAr[0] != 8 {
+		t.Errorf("Expected the level 0 location at line 8. Got %v (max stack depth %v)", levelLocAr, maxStackDepth)
+	}
+}
+
+// The last file's entry is on the last line and there is no newline after it
+func TestConstructBreakpointLocMapNoTrailingNewline(t *testing.T) {
+	dir := writeTestBreakFile(t, 2, 1, ""+
+		"        count++; //$$$ 0\n"+
+		"        // hash == 1\n"+
+		"        return; //### /srv/a.php\n"+
+		"        // hash == 2\n"+
+		"        return; //### /srv/b.php")
+	defer os.RemoveAll(dir)
+
+	bpLocMap, _, _, _ := constructBreakpointLocMap(dir)
+	if len(bpLocMap) != 2 || bpLocMap["file:///srv/b.php"] != 8 {
+		t.Errorf("Expected file:///srv/b.php at line 8 of dontbug_break.c among 2 files. Got %v", bpLocMap)
+	}
+}
+
+// rr here is a process that would not exit by itself after gdb is gone
+func TestStopFromIdeKillsRR(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgram("file:///a.php", 1, 0)...)
+	defer f.close()
+
+	es.rrCmd = exec.Command("sleep", "60")
+	if err := es.rrCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	rrFile, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	es.rrFile = rrFile
+	go monitorRR(es)
+
+	mustHandle(t, es, "stop -i 1")
+	select {
+	case <-es.endSession:
+	default:
+		t.Fatal("stop from the IDE did not end the session")
+	}
+
+	defer func(timeout time.Duration) {
+		rrExitTimeout = timeout
+	}(rrExitTimeout)
+	rrExitTimeout = 100 * time.Millisecond
+
+	// What DoReplay() does once the (dontbug) prompt has exited
+	close(es.closing)
+	stopRR(es)
+
+	if !rrHasExited(es) {
+		t.Fatal("rr is still running after the session ended")
+	}
+	status, ok := es.rrCmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		t.Errorf("rr should have been killed. Got: %v", es.rrCmd.ProcessState)
+	}
+}
+
+// Hands out everything it has in a single Read like a TCP read of a burst of commands would
+type singleReadReader struct {
+	data  string
+	reads int
+}
+
+func (r *singleReadReader) Read(p []byte) (int, error) {
+	r.reads++
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadDbgpCommandSplitsASingleRead(t *testing.T) {
+	reader := &singleReadReader{data: "feature_set -i 1 -n show_hidden -v 1\x00breakpoint_set -i 2 -t line -f file:///a.php -n 3\x00"}
+	buf := bufio.NewReader(reader)
+
+	expected := []string{"feature_set -i 1 -n show_hidden -v 1", "breakpoint_set -i 2 -t line -f file:///a.php -n 3"}
+	for _, command := range expected {
+		got, err := readDbgpCommand(buf)
+		if err != nil || got != command {
+			t.Fatalf("Expected %q. Got %q (error: %v)", command, got, err)
+		}
+	}
+	if reader.reads != 1 {
+		t.Errorf("Both commands should have come from a single Read. There were %v", reader.reads)
+	}
+
+	if got, err := readDbgpCommand(buf); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last command. Got %q (error: %v)", got, err)
+	}
+}
@@ -31,11 +31,18 @@ var gFeatureGetXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" c
 
 var gStatusXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="status"
 		transaction_id="%v" status="%v" reason="%v">
+		%v
 	</response>`
 
 var gBreakpointSetLineXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_set" transaction_id="%v" status="%v" id="%v">
 	</response>`
 
+var gBreakpointGetXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_get" transaction_id="%v">
+		%v
+	</response>`
+
+var gBreakpointXMLElementFormat = `<breakpoint id="%v" type="%v" state="%v" filename="%v" lineno="%v" function="%v" class="%v" temporary="%v" hit_count="%v" hit_value="%v" hit_condition="%v"><expression>%v</expression></breakpoint>`
+
 var gErrorXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="%v" transaction_id="%v">
 	 	<error code="%v">
         		<message>%v</message>
@@ -48,13 +55,25 @@ var gBreakpointRemoveOrUpdateXMLResponseFormat = `<response xmlns="urn:debugger_
 var gStepIntoBreakXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="http://xdebug.org/dbgp/xdebug" command="step_into"
 		transaction_id="%v" status="break" reason="ok">
 		<xdebug:message filename="%v" lineno="%v"></xdebug:message>
+		%v
 	</response>`
 
 var gRunOrStepBreakXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="http://xdebug.org/dbgp/xdebug" command="%v"
 		transaction_id="%v" status="break" reason="ok">
 		<xdebug:message filename="%v" lineno="%v"></xdebug:message>
+		%v
 	</response>`
 
+var gProgramExitXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:dontbug="https://github.com/sidkshatriya/dontbug" command="%v"
+		transaction_id="%v" status="stopping" reason="%v">
+		<dontbug:exit code="%v" signal="%v">%v</dontbug:exit>
+	</response>`
+
+// An asynchronous message i.e. not a response to any command. The IDE only gets these if it sets notify_ok
+var gNotifyXMLFormat = `<notify xmlns="urn:debugger_protocol_v1" xmlns:dontbug="https://github.com/sidkshatriya/dontbug" name="%v">
+		<dontbug:message>%v</dontbug:message>
+	</notify>`
+
 // @TODO Always fail the stdout/stdout/stderr commands, until this is implemented
 var gStdFdXMLResponseFormat = `<response transaction_id="%v" command="%v" success="0"></response>`
 
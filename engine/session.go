@@ -0,0 +1,220 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"github.com/fatih/color"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var rrExitTimeout = 5 * time.Second
+
+// ReplaySession is a replay of a recorded PHP execution that dbgp commands can be dispatched to
+// directly, i.e. without the dontbug prompt or a connection to a PHP IDE.
+//
+// Like the rest of the engine, problems starting the replay are fatal. A dbgp command that is unknown
+// or fails (including a gdb timeout) does not panic but gets a dbgp error response, as an IDE would.
+type ReplaySession struct {
+	es *engineState
+}
+
+// NewReplaySession starts replaying rrTraceDir in rr and attaches gdb to it.
+// An empty rrTraceDir means the latest trace (as rr understands it).
+// rrPath and gdbPath are assumed to meet dontbug's requirements (see CheckRRExecutable() and CheckGdbExecutable())
+// If startEvent is > 0 the replay starts at the first PHP statement after that rr event instead of at the beginning
+func NewReplaySession(installLocation, rrTraceDir, rrPath, gdbPath string, targetExtendedRemotePort int, startEvent int) *ReplaySession {
+	if startEvent < 0 {
+		log.Fatalf("The rr event to start the replay at should be a positive number. Got: %v", startEvent)
+	}
+
+	if JSONEventsFile != "" {
+		openEventStream(JSONEventsFile)
+	}
+
+	// A trace recorded by this version of dontbug has the dontbug_break.c it was recorded with
+	breakFileDir := getTraceBreakFileDir(rrTraceDir)
+	extAbsNoSymDir := getAbsNoSymExtDirForReplay(installLocation, breakFileDir == "")
+	if breakFileDir == "" {
+		checkBreakFileAgainstTrace(extAbsNoSymDir, rrTraceDir)
+		breakFileDir = extAbsNoSymDir
+	} else {
+		logInfof(color.FgGreen, "dontbug: Using the dontbug_break.c saved with the rr trace in %v", breakFileDir)
+	}
+	bpMap, levelAr, maxStackDepth, funcLocMap := constructBreakpointLocMap(breakFileDir)
+	maxStackDepth = overrideMaxStackDepth(maxStackDepth)
+	cLocs := findDontbugCLocations(extAbsNoSymDir)
+	targetExtendedRemotePort = chooseGdbRemotePort(targetExtendedRemotePort)
+
+	es := startReplayInRR(
+		rrTraceDir,
+		rrPath,
+		gdbPath,
+		bpMap,
+		levelAr,
+		maxStackDepth,
+		funcLocMap,
+		cLocs,
+		targetExtendedRemotePort,
+		startEvent,
+	)
+
+	// We're stopped in the statement handler of dontbug.c just before the first PHP statement to be run
+	if startEvent > 0 {
+		lineno := xSlashDgdb(es.gdbSession, "execute_data->opline->lineno")
+		logInfof(color.FgGreen, "dontbug: Replay positioned after rr event %v at %v:%v", startEvent, es.entryFilePHP, lineno)
+	}
+
+	if GdbInitFile != "" {
+		runGdbInitFile(es, GdbInitFile)
+	}
+
+	if BreakpointsFile != "" {
+		setBreakpointsFromFile(es, BreakpointsFile)
+	}
+
+	return &ReplaySession{es}
+}
+
+// Each line of the file is a gdb command. Lines starting with "-" are gdb/mi commands e.g. -gdb-set pagination off
+// and any other line is a gdb console command e.g. set pagination off. Blank lines and lines starting with # are skipped
+// A command that fails is reported but does not end the session
+// Note: breakpoints set this way are not known to dontbug. Stopping at them will confuse the engine
+func runGdbInitFile(es *engineState, gdbInitFile string) {
+	contents, err := ioutil.ReadFile(gdbInitFile)
+	if err != nil {
+		log.Fatalf("Could not read the --gdb-init file: %v", err)
+	}
+
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var result map[string]interface{}
+		if strings.HasPrefix(line, "-") {
+			result = sendGdbCommand(es.gdbSession, line[1:])
+		} else {
+			result = sendGdbCommand(es.gdbSession, "interpreter-exec", "console", strconv.Quote(line))
+		}
+
+		if result["class"] != "done" {
+			logWarnf(color.FgYellow, "dontbug: %v:%v: %q failed: %v", gdbInitFile, i+1, line, result["payload"])
+		}
+	}
+
+	logInfof(color.FgGreen, "dontbug: Ran the gdb commands in %v", gdbInitFile)
+}
+
+// Each line of the file is a PHP line breakpoint of the form file.php:12. As for the g prompt command the file can be
+// given by its full path or by any unambiguous trailing part of it. Blank lines and lines starting with # are skipped
+// The breakpoints are set before the IDE connects so they are there in breakpoint_list. Entries that can't be set
+// are reported but don't end the session
+func setBreakpointsFromFile(es *engineState, breakpointsFile string) {
+	contents, err := ioutil.ReadFile(breakpointsFile)
+	if err != nil {
+		log.Fatalf("Could not read the --breakpoints-file: %v", err)
+	}
+
+	set := 0
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		colon := strings.LastIndex(line, ":")
+		phpLineno, err := strconv.Atoi(line[colon+1:])
+		if colon == -1 || err != nil {
+			logWarnf(color.FgYellow, "dontbug: %v:%v: %q should be of the form file.php:12", breakpointsFile, i+1, line)
+			continue
+		}
+
+		phpFilename, err := findSourceMapFilename(es, line[:colon])
+		if err != nil {
+			logWarnf(color.FgYellow, "dontbug: %v:%v: %v", breakpointsFile, i+1, err)
+			continue
+		}
+
+		_, breakErr := setPhpBreakpointInGdb(es, phpFilename, phpLineno, false, false)
+		if breakErr != nil {
+			logWarnf(color.FgYellow, "dontbug: %v:%v: %v", breakpointsFile, i+1, breakErr.message)
+			continue
+		}
+		set++
+	}
+
+	logInfof(color.FgGreen, "dontbug: Set %v breakpoint(s) from %v", set, breakpointsFile)
+}
+
+// Inspecting frames (e.g. context_get -d and evalall) uses the raised value. The stack level locations in
+// dontbug_break.c can't be raised though: they only go up to the recorded max stack depth (see es.levelAr)
+// so step over/out beyond it still won't work
+func overrideMaxStackDepth(recordedMaxStackDepth int) int {
+	if MaxStackDepthOverride <= 0 || MaxStackDepthOverride == recordedMaxStackDepth {
+		return recordedMaxStackDepth
+	}
+
+	if MaxStackDepthOverride < recordedMaxStackDepth {
+		logWarnf(color.FgYellow, "dontbug: --max-stack-depth %v is lower than the recorded max stack depth of %v. Using %v",
+			MaxStackDepthOverride, recordedMaxStackDepth, recordedMaxStackDepth)
+		return recordedMaxStackDepth
+	}
+
+	logWarnf(color.FgYellow, "dontbug: Using a max stack depth of %v instead of the recorded %v. Frames deeper than %v were not "+
+		"instrumented so information about them may be incomplete and stepping over/out of them will not work",
+		MaxStackDepthOverride, recordedMaxStackDepth, recordedMaxStackDepth)
+	return MaxStackDepthOverride
+}
+
+// EntryFile is the PHP file at which the replay starts, as given in the dbgp init packet
+// (with a start event this is the file being executed at that point)
+func (rs *ReplaySession) EntryFile() string {
+	return rs.es.entryFilePHP
+}
+
+// Dispatch runs a dbgp command e.g. "step_into -i 1" and returns the dbgp XML response (without packet framing).
+// The response is a dbgp <error> response if the command could not be run
+// If reverse is true, commands that can be run in reverse are run in reverse
+// (unless the command itself has the -z flag)
+func (rs *ReplaySession) Dispatch(command string, reverse bool) string {
+	return dispatchIdeRequest(rs.es, command, reverse)
+}
+
+// Close stops gdb and rr. The session may not be used after this
+func (rs *ReplaySession) Close() {
+	close(rs.es.closing)
+	rs.es.gdbSession.Exit()
+	stopRR(rs.es)
+	closeEventStream()
+}
+
+// rr normally exits once gdb is gone but it is killed if it lingers so that it never outlives dontbug
+func stopRR(es *engineState) {
+	es.rrFile.Close()
+
+	// monitorRR() is the one waiting for rr to exit
+	select {
+	case <-es.rrExited:
+	case <-time.After(rrExitTimeout):
+		logWarnf(color.FgYellow, "dontbug: rr did not exit within %v of gdb exiting. Killing it", rrExitTimeout)
+		es.rrCmd.Process.Kill()
+		<-es.rrExited
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layout of a snapshot archive:
+// - dontbug-snapshot.json: the snapshot metadata as it was on the exporting machine
+// - rr-trace/: the (packed) rr trace. Includes the dontbug_break.c the trace was recorded with
+// - sources/: the PHP sources snapshot
+const (
+	archiveMetadataName = "dontbug-snapshot.json"
+	archiveTracePrefix  = "rr-trace/"
+	archiveSourcePrefix = "sources/"
+)
+
+// DoSnapshotList lists the snapshots along with the index that export expects
+func DoSnapshotList() {
+	traceDirAr := getSnapInfos()
+	if len(traceDirAr) == 0 {
+		fmt.Println("No saved snapshots")
+		return
+	}
+
+	printSnapInfos(traceDirAr)
+}
+
+// DoSnapshotExport bundles the rr trace, the PHP sources and the metadata of a snapshot into outFile
+// outFile ending in .zst is compressed with the zstd executable, .gz/.tgz with gzip and anything else is a plain tar
+// installLocation is only used for snapshots that don't have their own copy of dontbug_break.c
+func DoSnapshotExport(installLocation, rrPath string, index int, outFile string) {
+	traceDirAr := getSnapInfos()
+	if index < 0 || index >= len(traceDirAr) {
+		log.Fatalf("No snapshot with index %v. See 'dontbug snapshot list'", index)
+	}
+	info := traceDirAr[index]
+
+	// rr traces can refer to files outside the trace directory (e.g. mmapped libraries that could not be hardlinked)
+	// rr pack copies them into the trace so that it can be replayed on another machine
+	logInfof(color.FgGreen, "dontbug: Packing rr trace: %v", info.snapRRTraceDir)
+	output, err := exec.Command(rrPath, "pack", info.snapRRTraceDir).CombinedOutput()
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: rr pack failed (%v): %s", err, output)
+		logWarnf(color.FgYellow, "dontbug: The exported trace may refer to files that only exist on this machine")
+	}
+
+	metaDataBytes, err := ioutil.ReadFile(info.snapRRTraceDir + "/dontbug-snapshot-metadata")
+	fatalIf(err)
+
+	breakFileBytes := snapshotBreakFileForExport(installLocation, info.snapRRTraceDir)
+
+	out, closeOut := createArchiveWriter(outFile)
+	tw := tar.NewWriter(out)
+
+	writeTarFile(tw, archiveMetadataName, metaDataBytes)
+	addDirToTar(tw, info.snapRRTraceDir, archiveTracePrefix)
+	if breakFileBytes != nil {
+		writeTarFile(tw, archiveTracePrefix+"dontbug_break.c", breakFileBytes)
+	}
+	addDirToTar(tw, info.snapRootDir, archiveSourcePrefix)
+
+	fatalIf(tw.Close())
+	closeOut()
+
+	logInfof(color.FgGreen, "dontbug: Exported snapshot of %v to %v", info.origDocrootOrScript, outFile)
+}
+
+// Without dontbug_break.c the imported snapshot would not be able to set any breakpoints
+// Returns nil if the trace already has its copy (and so it is part of the rr-trace/ entries)
+func snapshotBreakFileForExport(installLocation, rrTraceDir string) []byte {
+	if getTraceBreakFileDir(rrTraceDir) != "" {
+		return nil
+	}
+
+	// Snapshots recorded before the copy was kept with the trace
+	extAbsNoSymDir, err := getAbsNoSymExtDir(installLocation)
+	if err != nil {
+		log.Fatalf("The snapshot has no dontbug_break.c of its own and the dontbug install location could not be found: %v", err)
+	}
+
+	breakFileBytes, err := ioutil.ReadFile(extAbsNoSymDir + "/dontbug_break.c")
+	if err != nil {
+		log.Fatalf("The snapshot has no dontbug_break.c of its own and none could be read from the install location: %v", err)
+	}
+
+	logWarnf(color.FgYellow, "dontbug: The snapshot has no dontbug_break.c of its own. Exporting %v/dontbug_break.c instead", extAbsNoSymDir)
+	logWarnf(color.FgYellow, "dontbug: Breakpoints will only work in the imported snapshot if that is from the same 'dontbug record'")
+	return breakFileBytes
+}
+
+// DoSnapshotImport unpacks an archive made by DoSnapshotExport into the rr trace home and the dontbug share directory
+// so that it shows up in 'dontbug replay snaps'
+func DoSnapshotImport(archive string) {
+	in, closeIn := openArchiveReader(archive)
+	defer closeIn()
+
+	stamp := time.Now().UnixNano() / 1000000
+	traceDir := fmt.Sprintf("%v/dontbug-imported-%v", getRRTraceHome(), stamp)
+	rootDir := fmt.Sprintf("%vimported/snap-%v/", getOrCreateDontbugSharePath(), stamp)
+
+	var metaDataBytes []byte
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		fatalIf(err)
+
+		if hdr.Name == archiveMetadataName {
+			metaDataBytes, err = ioutil.ReadAll(tr)
+			fatalIf(err)
+		} else if strings.HasPrefix(hdr.Name, archiveTracePrefix) {
+			extractTarEntry(tr, hdr, traceDir, hdr.Name[len(archiveTracePrefix):])
+		} else if strings.HasPrefix(hdr.Name, archiveSourcePrefix) {
+			extractTarEntry(tr, hdr, rootDir, hdr.Name[len(archiveSourcePrefix):])
+		} else {
+			logWarnf(color.FgYellow, "dontbug: Ignoring unknown entry in snapshot archive: %v", hdr.Name)
+		}
+	}
+
+	if metaDataBytes == nil {
+		log.Fatalf("%v is not a dontbug snapshot archive. No %v found", archive, archiveMetadataName)
+	}
+
+	metaData, err := parseSnapshotMetadata(metaDataBytes)
+	fatalIf(err)
+
+	// The paths of the PHP files are baked into the rr trace and cannot be changed.
+	// We remember where they were originally so that this can be shown to the user e.g. for IDE path mappings
+	if metaData.OriginalRootDir == "" {
+		metaData.OriginalRootDir = metaData.RootDir
+	}
+	metaData.RootDir = rootDir
+
+	fileData, err := json.MarshalIndent(metaData, "", "  ")
+	fatalIf(err)
+	mkDirAll(traceDir)
+	err = ioutil.WriteFile(traceDir+"/dontbug-snapshot-metadata", fileData, 0700)
+	fatalIf(err)
+
+	logInfof(color.FgGreen, "dontbug: Imported rr trace to: %v", traceDir)
+	logInfof(color.FgGreen, "dontbug: Imported PHP sources to: %v", rootDir)
+	if path.Clean(metaData.OriginalRootDir) != path.Clean(rootDir) {
+		logInfof(color.FgYellow, "dontbug: The PHP sources were recorded at %v", metaData.OriginalRootDir)
+		logInfof(color.FgYellow, "dontbug: Your PHP IDE will need to map that path to %v", rootDir)
+	}
+	logInfof(color.FgGreen, "dontbug: Use 'dontbug replay snaps' to replay it")
+}
+
+func createArchiveWriter(outFile string) (io.Writer, func()) {
+	f, err := os.Create(outFile)
+	fatalIf(err)
+
+	if strings.HasSuffix(outFile, ".zst") {
+		zstdCmd := exec.Command("zstd", "-q", "-c")
+		zstdCmd.Stdout = f
+		zstdCmd.Stderr = os.Stderr
+		stdin, err := zstdCmd.StdinPipe()
+		fatalIf(err)
+		err = zstdCmd.Start()
+		if err != nil {
+			log.Fatalf("Could not run zstd to compress %v (is zstd installed?): %v", outFile, err)
+		}
+
+		return stdin, func() {
+			fatalIf(stdin.Close())
+			fatalIf(zstdCmd.Wait())
+			fatalIf(f.Close())
+		}
+	}
+
+	if strings.HasSuffix(outFile, ".gz") || strings.HasSuffix(outFile, ".tgz") {
+		gw := gzip.NewWriter(f)
+		return gw, func() {
+			fatalIf(gw.Close())
+			fatalIf(f.Close())
+		}
+	}
+
+	return f, func() {
+		fatalIf(f.Close())
+	}
+}
+
+func openArchiveReader(archive string) (io.Reader, func()) {
+	f, err := os.Open(archive)
+	fatalIf(err)
+
+	if strings.HasSuffix(archive, ".zst") {
+		zstdCmd := exec.Command("zstd", "-q", "-d", "-c")
+		zstdCmd.Stdin = f
+		zstdCmd.Stderr = os.Stderr
+		stdout, err := zstdCmd.StdoutPipe()
+		fatalIf(err)
+		err = zstdCmd.Start()
+		if err != nil {
+			log.Fatalf("Could not run zstd to decompress %v (is zstd installed?): %v", archive, err)
+		}
+
+		return stdout, func() {
+			fatalIf(zstdCmd.Wait())
+			f.Close()
+		}
+	}
+
+	if strings.HasSuffix(archive, ".gz") || strings.HasSuffix(archive, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		fatalIf(err)
+		return gr, func() {
+			gr.Close()
+			f.Close()
+		}
+	}
+
+	return f, func() {
+		f.Close()
+	}
+}
+
+func writeTarFile(tw *tar.Writer, name string, contents []byte) {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+
+	fatalIf(tw.WriteHeader(hdr))
+	_, err := tw.Write(contents)
+	fatalIf(err)
+}
+
+// rr traces can be large so files are streamed into the archive
+// Hardlinked files (rr hardlinks mmapped files into the trace) are stored as regular files
+func addDirToTar(tw *tar.Writer, dir, prefix string) {
+	Verbosef("dontbug: Adding %v to archive\n", dir)
+	err := filepath.Walk(dir, func(pathEntry string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, pathEntry)
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(pathEntry)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix
+		if rel != "." {
+			hdr.Name += filepath.ToSlash(rel)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(pathEntry)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	fatalIf(err)
+}
+
+func extractTarEntry(tr *tar.Reader, hdr *tar.Header, destDir, rel string) {
+	destDir = path.Clean(destDir)
+	target := path.Join(destDir, rel)
+
+	// Guard against entries like ../../.bashrc
+	if !isPathWithin(target, destDir) {
+		log.Fatalf("Snapshot archive entry points outside the destination: %v", hdr.Name)
+	}
+
+	// An earlier symlink entry could make a later entry land outside the destination e.g. link -> /etc and then link/passwd
+	checkNoSymlinkParents(target, destDir, hdr.Name)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mkDirAll(target)
+	case tar.TypeSymlink:
+		if path.IsAbs(hdr.Linkname) || !isPathWithin(path.Join(path.Dir(target), hdr.Linkname), destDir) {
+			log.Fatalf("Snapshot archive entry %v is a symlink that points outside the destination: %v", hdr.Name, hdr.Linkname)
+		}
+		mkDirAll(path.Dir(target))
+		fatalIf(os.Symlink(hdr.Linkname, target))
+	case tar.TypeReg, tar.TypeRegA:
+		mkDirAll(path.Dir(target))
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&os.ModePerm)
+		fatalIf(err)
+		_, err = io.Copy(f, tr)
+		fatalIf(err)
+		fatalIf(f.Close())
+	default:
+		logWarnf(color.FgYellow, "dontbug: Skipping unsupported entry in snapshot archive: %v", hdr.Name)
+	}
+}
+
+// Both paths are expected to be clean
+func isPathWithin(target, dir string) bool {
+	return target == dir || strings.HasPrefix(target, dir+"/")
+}
+
+// Fatal if any existing directory between destDir and target (target itself included) is a symlink
+func checkNoSymlinkParents(target, destDir, entryName string) {
+	rel := strings.TrimPrefix(target, destDir)
+	current := destDir
+	for _, component := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if component == "" {
+			continue
+		}
+
+		current += "/" + component
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return
+		}
+		fatalIf(err)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			log.Fatalf("Snapshot archive entry %v would be written through the symlink %v", entryName, current)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A snapshot name becomes part of a directory name (snap-<name>) so only allow characters that are safe everywhere
+var gSnapshotNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func checkSnapshotName(name string) error {
+	if !gSnapshotNameRegexp.MatchString(name) || len(name) > 100 {
+		return fmt.Errorf("Invalid snapshot name %q. Use up to 100 letters, digits, '.', '_' and '-' (starting with a letter or digit)", name)
+	}
+
+	return nil
+}
+
+// Finds a snapshot by the name given with --snapshot-name when recording
+func findSnapInfoByName(name string) (snapInfo, bool) {
+	for _, info := range getSnapInfos() {
+		if info.name == name {
+			return info, true
+		}
+	}
+
+	return snapInfo{}, false
+}
+
+// Exits unless name is free or the user agrees to overwrite the existing snapshot of that name
+// Overwriting deletes the existing snapshot's rr trace and PHP sources
+func makeSnapshotNameAvailable(name, snapShotDir string) {
+	info, found := findSnapInfoByName(name)
+	_, err := os.Stat(snapShotDir)
+	dirExists := err == nil
+	if !found && !dirExists {
+		return
+	}
+
+	if found {
+		logWarnf(color.FgYellow, "dontbug: There is already a snapshot named %v (rr trace: %v)", name, info.snapRRTraceDir)
+	} else {
+		logWarnf(color.FgYellow, "dontbug: The snapshot directory %v already exists", snapShotDir)
+	}
+
+	fmt.Printf("Overwrite snapshot %v? [y/N]> ", name)
+	var answer string
+	fmt.Scanln(&answer)
+	if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		color.Yellow("Exiting. Please choose another --snapshot-name")
+		os.Exit(1)
+	}
+
+	toDelete := []string{snapShotDir}
+	if found {
+		toDelete = append(toDelete, info.snapRRTraceDir, info.snapRootDir)
+	}
+
+	for _, dir := range toDelete {
+		Verboseln("dontbug: rm -rf", dir)
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Fatalf("Could not delete %v: %v", dir, err)
+		}
+	}
+}
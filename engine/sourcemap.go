@@ -0,0 +1,57 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DoDumpSourceMap prints the PHP files dontbug can set line breakpoints in (and the corresponding line in
+// dontbug_break.c) without starting a replay. Useful to diagnose breakpoints that won't bind
+// Only files whose path contains filter are printed
+func DoDumpSourceMap(installLocation, filter string, asJSON bool) {
+	extAbsNoSymDir := getAbsNoSymExtDirForReplay(installLocation, true)
+	sourceMap, _, _, _ := constructBreakpointLocMap(extAbsNoSymDir)
+	printSourceMap(sourceMap, filter, asJSON)
+}
+
+// The JSON output is an object of PHP file => line in dontbug_break.c
+func printSourceMap(sourceMap map[string]int, filter string, asJSON bool) {
+	filtered := make(map[string]int)
+	var filenames []string
+	for filename, line := range sourceMap {
+		if strings.Contains(filename, filter) {
+			filtered[filename] = line
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+
+	if asJSON {
+		// encoding/json sorts map keys
+		jsonResult, err := json.MarshalIndent(filtered, "", "  ")
+		fatalIf(err)
+		fmt.Println(string(jsonResult))
+		return
+	}
+
+	for _, filename := range filenames {
+		fmt.Printf("%v (dontbug_break.c:%v)\n", filename, filtered[filename])
+	}
+	fmt.Printf("%v of %v recorded PHP files\n", len(filenames), len(sourceMap))
+}
@@ -14,79 +14,346 @@
 
 package engine
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
-func handleStepInto(es *engineState, dCmd dbgpCmd) string {
-	gotoMasterBpLocation(es, dCmd.reverse)
+// Bounds for the c (conditional continue) prompt command so that a condition that never becomes true does not hang dontbug
+const (
+	conditionalContinueMaxStatements = 100000
+	conditionalContinueTimeout       = 5 * time.Minute
+)
 
-	filename := xSlashSgdb(es.gdbSession, "filename")
-	lineno := xSlashDgdb(es.gdbSession, "lineno")
-	return fmt.Sprintf(gStepIntoBreakXMLResponseFormat, dCmd.seqNum, filename, lineno)
+func handleStepInto(es *engineState, dCmd dbgpCmd) (string, error) {
+	stepOnce(es, dCmd.reverse)
+
+	if es.programExit != nil {
+		return programExitResponse(es, dCmd), nil
+	}
+
+	filename, err := tryXSlashSgdb(es.gdbSession, "filename")
+	if err != nil {
+		return "", err
+	}
+
+	lineno, err := tryXSlashDgdb(es.gdbSession, "lineno")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(gStepIntoBreakXMLResponseFormat, dCmd.seqNum, filename, lineno, watchesXML(es)), nil
 }
 
-func handleStepOverOrOut(es *engineState, dCmd dbgpCmd, stepOut bool) string {
+// A step_into in either direction at the dontbug_step_granularity
+func stepOnce(es *engineState, reverse bool) {
+	if es.featureMap["dontbug_step_granularity"].String() == stepGranularityOpcode {
+		gotoOpcodeBpLocation(es, reverse)
+	} else {
+		gotoMasterBpLocation(es, reverse)
+	}
+}
+
+// The statement handler in dontbug.c calls, in order: the level location, the break location
+// (where the PHP breakpoints are) and then arrives at the master breakpoint. We are always at the master
+// breakpoint when a step is requested
+func handleStepOverOrOut(es *engineState, dCmd dbgpCmd, stepOut bool) (string, error) {
 	command := "step_over"
 	if stepOut {
 		command = "step_out"
 	}
 
-	currentPhpStackLevel := xSlashDgdb(es.gdbSession, "level")
+	currentPhpStackLevel, err := tryXSlashDgdb(es.gdbSession, "level")
+	if err != nil {
+		return "", err
+	}
+
 	levelLimit := currentPhpStackLevel
 	if stepOut && currentPhpStackLevel > 0 {
 		levelLimit = currentPhpStackLevel - 1
 	}
 
+	if dCmd.reverse {
+		// Get behind the level location of the current statement without stopping on
+		// any PHP breakpoints on the current line
+		bpList := getEnabledPhpBreakpoints(es)
+		disableGdbBreakpoints(es, bpList)
+		id, err := setPhpStackDepthLevelBreakpointInGdb(es, currentPhpStackLevel)
+		if err != nil {
+			enableGdbBreakpoints(es, bpList)
+			return "", newDbgpError(dbgpErrorCodeStackDepthInvalid, "%v", err)
+		}
+		continueExecution(es, true)
+		removeGdbBreakpoint(es, id)
+		enableGdbBreakpoints(es, bpList)
+	}
+
 	// We're interested in maintaining or decreasing the stack level for step over
 	// We're interested in strictly decreasing the stack level for step out
-	id := setPhpStackDepthLevelBreakpointInGdb(es, levelLimit)
-	_, ok := continueExecution(es, dCmd.reverse)
+	// Any PHP breakpoint in the region traversed (e.g. in a function called by a statement
+	// we're stepping over) in either direction will stop us first
+	id, err := setPhpStackDepthLevelBreakpointInGdb(es, levelLimit)
+	if err != nil {
+		return "", newDbgpError(dbgpErrorCodeStackDepthInvalid, "%v", err)
+	}
+	continueExecution(es, dCmd.reverse)
+	removeGdbBreakpoint(es, id)
 
-	if !dCmd.reverse {
-		// Cleanup
-		removeGdbBreakpoint(es, id)
+	if es.programExit != nil {
+		return programExitResponse(es, dCmd), nil
+	}
 
-		gotoMasterBpLocation(es, false)
-	} else {
-		// A user (php) breakpoint was hit
-		if ok {
-			// Cleanup
-			removeGdbBreakpoint(es, id)
+	// We're either at a level location or a break location of some statement. Move forward to its
+	// master breakpoint location. Note that we run in forward direction, even if we're in reverse mode
+	// PHP breakpoints on this statement would otherwise stop us (again) before we get there
+	bpList := getEnabledPhpBreakpoints(es)
+	disableGdbBreakpoints(es, bpList)
+	gotoMasterBpLocation(es, false)
+	enableGdbBreakpoints(es, bpList)
 
-			// What stack level are we on currently?
-			levelLimit := xSlashDgdb(es.gdbSession, "level")
+	filename, err := tryXSlashSgdb(es.gdbSession, "filename")
+	if err != nil {
+		return "", err
+	}
 
-			// Disable all currently active breaks
-			bpList := getEnabledPhpBreakpoints(es)
-			disableGdbBreakpoints(es, bpList)
+	phpLineno, err := tryXSlashDgdb(es.gdbSession, "lineno")
+	if err != nil {
+		return "", err
+	}
 
-			// Step over/out in reverse to the previous statement with all other breaks disabled
-			id2 := setPhpStackDepthLevelBreakpointInGdb(es, levelLimit)
-			continueExecution(es, true)
+	return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, command, dCmd.seqNum, filename, phpLineno, watchesXML(es)), nil
+}
 
-			// Remove this one too
-			removeGdbBreakpoint(es, id2)
+// For the g (goto) prompt command. location is of the form file.php:123
+// Only the temporary breakpoint at location can stop us; the user's breakpoints are ignored
+func gotoPhpLocation(es *engineState, location string, reverse bool) (_ string, err error) {
+	colon := strings.LastIndex(location, ":")
+	if colon == -1 {
+		return "", fmt.Errorf("Please provide a location of the form file.php:123. Got: %v", location)
+	}
 
-			enableGdbBreakpoints(es, bpList)
+	phpLineno, err := strconv.Atoi(location[colon+1:])
+	if err != nil {
+		return "", fmt.Errorf("Invalid line number in: %v", location)
+	}
+
+	phpFilename, err := findSourceMapFilename(es, location[:colon])
+	if err != nil {
+		return "", err
+	}
 
-		} else {
-			// Disable all currently active breaks
-			bpList := getEnabledPhpBreakpoints(es)
-			disableGdbBreakpoints(es, bpList)
+	if !startContinuation(es) {
+		return "", errors.New("Last continuation not yet complete")
+	}
+	defer endContinuation(es, &err)
 
-			// Do this again with the php stack level breakpoint enabled
-			continueExecution(es, true)
-			enableGdbBreakpoints(es, bpList)
+	bpList := getEnabledPhpBreakpoints(es)
+	disableGdbBreakpoints(es, bpList)
+	defer enableGdbBreakpoints(es, bpList)
+
+	id, breakErr := setPhpBreakpointInGdb(es, phpFilename, phpLineno, false, false)
+	if breakErr != nil {
+		return "", errors.New(breakErr.message)
+	}
+
+	_, userBreakPointHit := continueExecution(es, reverse)
+	removeGdbBreakpoint(es, id)
+
+	if es.programExit != nil {
+		return "", fmt.Errorf("Did not reach %v. %v", location, es.programExit)
+	}
+
+	if !userBreakPointHit {
+		return "", fmt.Errorf("Did not reach %v", location)
+	}
+
+	// From the break location of the statement to its master location (as we do for run)
+	gotoMasterBpLocation(es, false)
+	return currentPhpLocation(es)
+}
 
-			// Cleanup
-			removeGdbBreakpoint(es, id)
+// For the c prompt command. Continues statement by statement in the given direction until the PHP expression
+// condition is true. The condition is evaluated in the diversion session at every statement, so this is slow
+// Like g, the user's breakpoints are ignored
+func continueUntilCondition(es *engineState, condition string, reverse bool) (_ string, err error) {
+	if condition == "" {
+		return "", errors.New("Please provide a PHP expression e.g. c $i > 10")
+	}
+
+	if isEvalSafeEnabled(es) {
+		err := checkEvalSafe(condition)
+		if err != nil {
+			return "", err
 		}
+	}
 
-		// Note that we run in forward direction, even though we're in reverse mode
-		gotoMasterBpLocation(es, false)
+	if !startContinuation(es) {
+		return "", errors.New("Last continuation not yet complete")
 	}
+	defer endContinuation(es, &err)
 
-	filename := xSlashSgdb(es.gdbSession, "filename")
-	phpLineno := xSlashDgdb(es.gdbSession, "lineno")
+	bpList := getEnabledPhpBreakpoints(es)
+	disableGdbBreakpoints(es, bpList)
+	defer enableGdbBreakpoints(es, bpList)
+
+	deadline := time.Now().Add(conditionalContinueTimeout)
+	for i := 1; i <= conditionalContinueMaxStatements; i++ {
+		gotoMasterBpLocation(es, reverse)
+		if es.programExit != nil {
+			return "", fmt.Errorf("Condition was never true. %v", es.programExit)
+		}
+
+		location, err := currentPhpLocation(es)
+		if err != nil {
+			return "", err
+		}
+
+		satisfied, err := evalPhpCondition(es, condition)
+		if err != nil {
+			return "", fmt.Errorf("Stopped at %v as the condition could not be evaluated: %v", location, err)
+		}
+
+		if satisfied {
+			return location, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("Gave up after %v (%v statements). Stopped at %v", conditionalContinueTimeout, i, location)
+		}
+	}
+
+	return "", fmt.Errorf("Gave up after %v statements", conditionalContinueMaxStatements)
+}
+
+// The condition is cast to bool so xdebug always answers with a bool property: <property type="bool"...><![CDATA[1]]></property>
+func evalPhpCondition(es *engineState, condition string) (bool, error) {
+	result, err := evalWatch(es, fmt.Sprintf("(bool)(%v)", condition))
+	if err != nil {
+		return false, err
+	}
+
+	if strings.Contains(result, "<error") || !strings.Contains(result, `type="bool"`) {
+		return false, fmt.Errorf("Unexpected eval result: %v", result)
+	}
+
+	return strings.Contains(result, "<![CDATA[1]]>"), nil
+}
+
+// The commands that move through the replay in a direction. See bounceLastMove()
+var gMoveCommands = map[string]bool{
+	"run":       true,
+	"step_into": true,
+	"step_over": true,
+	"step_out":  true,
+}
+
+// What the IDE's run/step commands do in either direction. See ExplainMoves
+var gMoveExplanations = map[string][2]string{
+	"run": {
+		"running forward until a breakpoint or the end of the execution",
+		"running backward until a breakpoint or the start of the execution",
+	},
+	"step_into": {
+		"going to the next PHP statement, into a function call if there is one",
+		"going to the previous PHP statement, into the end of a function call if there is one",
+	},
+	"step_over": {
+		"going to the next PHP statement in this function (stops at breakpoints on the way)",
+		"going to the previous PHP statement in this function (stops at breakpoints on the way)",
+	},
+	"step_out": {
+		"running forward until this function returns to its caller",
+		"running backward until just before this function was called",
+	},
+}
+
+// ExplainMoves is toggled at the prompt while the IDE moves
+var explainMovesMutex sync.Mutex
+
+// Returns the new setting
+func toggleExplainMoves() bool {
+	explainMovesMutex.Lock()
+	defer explainMovesMutex.Unlock()
+	ExplainMoves = !ExplainMoves
+	return ExplainMoves
+}
+
+func explainMove(dCmd dbgpCmd) {
+	explainMovesMutex.Lock()
+	explain := ExplainMoves
+	explainMovesMutex.Unlock()
+	if !explain {
+		return
+	}
+
+	explanation := gMoveExplanations[dCmd.command][0]
+	if dCmd.reverse {
+		explanation = gMoveExplanations[dCmd.command][1]
+	}
+
+	logInfof(color.FgCyan, "dontbug: %v %v: %v", directionName(dCmd.reverse), dCmd.command, explanation)
+}
+
+// For the b (bounce) prompt command e.g. step forward in the IDE and then immediately back over the same transition
+func bounceLastMove(es *engineState) (string, error) {
+	es.moveMutex.Lock()
+	lastMoveCmd := es.lastMoveCmd
+	es.moveMutex.Unlock()
+	if lastMoveCmd == nil {
+		return "", errors.New("The IDE has not sent a run or step command yet")
+	}
+
+	dCmd := *lastMoveCmd
+	dCmd.reverse = !dCmd.reverse
+	direction := "forward"
+	if dCmd.reverse {
+		direction = "reverse"
+	}
+	logInfof(color.FgYellow, "dontbug: Running %v in %v", dCmd.command, direction)
+
+	_, err := gDbgpCmdHandlers[dCmd.command](es, dCmd)
+	if err != nil {
+		return "", fmt.Errorf("%v failed: %v", dCmd.command, err)
+	}
+
+	if es.programExit != nil {
+		return "", fmt.Errorf("Reached the end of the execution. The PHP program %v", es.programExit)
+	}
+
+	return currentPhpLocation(es)
+}
+
+// The file can be given as a full file:// URI, an absolute path or a path suffix like src/index.php as long as it is unique
+func findSourceMapFilename(es *engineState, name string) (string, error) {
+	if strings.HasPrefix(name, "file://") {
+		if _, ok := es.sourceMap[name]; ok {
+			return name, nil
+		}
+		return "", fmt.Errorf("%v is not in the PHP sources that were recorded", name)
+	}
+
+	if _, ok := es.sourceMap["file://"+name]; ok {
+		return "file://" + name, nil
+	}
+
+	var matches []string
+	for filename := range es.sourceMap {
+		if strings.HasSuffix(filename, "/"+name) {
+			matches = append(matches, filename)
+		}
+	}
+
+	if len(matches) == 0 {
+		return "", fmt.Errorf("%v is not in the PHP sources that were recorded", name)
+	}
+
+	if len(matches) > 1 {
+		return "", fmt.Errorf("%v is ambiguous. It could be any of: %v", name, strings.Join(matches, ", "))
+	}
 
-	return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, command, dCmd.seqNum, filename, phpLineno)
+	return matches[0], nil
 }
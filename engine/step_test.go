@@ -0,0 +1,79 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+)
+
+// a.php calls f() on line 2 whose body is b.php:10-11
+func fakeProgramWithCall() []fakeStatement {
+	return []fakeStatement{
+		{"file:///a.php", 1, 0},
+		{"file:///a.php", 2, 0},
+		{"file:///b.php", 10, 1},
+		{"file:///b.php", 11, 1},
+		{"file:///a.php", 3, 0},
+		{"file:///a.php", 4, 0},
+	}
+}
+
+// Goes to the statement at location (with breakpoints the test sets later not in the way)
+func fakeGoto(t *testing.T, es *engineState, f *fakeGdb, location string) {
+	for f.location() != location {
+		mustHandle(t, es, "step_into -i 1")
+		if es.programExit != nil {
+			t.Fatalf("Never got to %v", location)
+		}
+	}
+}
+
+func TestStepOverStopsAtBreakpointInCalledFunction(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgramWithCall()...)
+	defer f.close()
+
+	fakeGoto(t, es, f, "file:///a.php:2")
+	mustSetBreakpoint(t, es, "file:///b.php", 11)
+
+	mustHandle(t, es, "step_over -i 2")
+	if location := f.location(); location != "file:///b.php:11" {
+		t.Errorf("step_over stopped at %v instead of the breakpoint at file:///b.php:11", location)
+	}
+}
+
+func TestReverseStepOverStopsAtBreakpointInCalledFunction(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgramWithCall()...)
+	defer f.close()
+
+	fakeGoto(t, es, f, "file:///a.php:3")
+	mustSetBreakpoint(t, es, "file:///b.php", 10)
+
+	mustHandle(t, es, "step_over -i 2 -z 1")
+	if location := f.location(); location != "file:///b.php:10" {
+		t.Errorf("Reverse step_over stopped at %v instead of the breakpoint at file:///b.php:10", location)
+	}
+}
+
+func TestReverseStepOverWithoutBreakpoints(t *testing.T) {
+	es, f := newFakeReplay(t, fakeProgramWithCall()...)
+	defer f.close()
+
+	fakeGoto(t, es, f, "file:///a.php:3")
+
+	mustHandle(t, es, "step_over -i 2 -z 1")
+	if location := f.location(); location != "file:///a.php:2" {
+		t.Errorf("Reverse step_over went to %v instead of over the call to file:///a.php:2", location)
+	}
+}
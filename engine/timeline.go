@@ -0,0 +1,105 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var gRRTicksRegexp = regexp.MustCompile(`tick:? (\d+)`)
+
+// Where the replay is in rr's timeline. Unlike a PHP location this is absolute: the same event and tick are the
+// same point of the execution in every replay of the trace. The event can be given to replay --start-event
+type rrPosition struct {
+	event int64
+	ticks int64 // -1 if rr did not tell us (older versions of rr don't have when-ticks)
+}
+
+func (p rrPosition) String() string {
+	if p.ticks < 0 {
+		return fmt.Sprintf("rr event %v", p.event)
+	}
+
+	return fmt.Sprintf("rr event %v, tick %v", p.event, p.ticks)
+}
+
+// gdb must not be running i.e. we must be at a break or at the end of the execution
+func getRRPosition(es *engineState) (rrPosition, error) {
+	output, err := gdbConsoleCommand(es, "when")
+	if err != nil {
+		return rrPosition{}, err
+	}
+
+	matches := gRREventRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		return rrPosition{}, fmt.Errorf("Could not understand the event reported by rr: %q", output)
+	}
+
+	position := rrPosition{ticks: -1}
+	position.event, _ = strconv.ParseInt(matches[1], 10, 64)
+
+	output, err = gdbConsoleCommand(es, "when-ticks")
+	if matches := gRRTicksRegexp.FindStringSubmatch(output); err == nil && matches != nil {
+		position.ticks, _ = strconv.ParseInt(matches[1], 10, 64)
+	}
+
+	return position, nil
+}
+
+// For the where prompt command
+func printRRPosition(es *engineState) error {
+	if status, _ := getStatus(es); status == statusRunning {
+		return errors.New("Last continuation not yet complete")
+	}
+
+	position, err := getRRPosition(es)
+	if err != nil {
+		return err
+	}
+
+	if es.programExit != nil {
+		fmt.Printf("At the end of the execution: %v\n", position)
+		return nil
+	}
+
+	location, err := currentPhpLocation(es)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("At %v: %v\n", location, position)
+	return nil
+}
+
+// The <dontbug:position> extension element of the status response so that IDEs can show where in the
+// timeline the replay is. Only for IDEs that opted in with feature_set -n dontbug_status_position -v 1 as it costs
+// two gdb console commands per status. Only call this at a break. Returns "" if rr did not tell us
+func positionXML(es *engineState) string {
+	position, err := getRRPosition(es)
+	if err != nil {
+		Verboseln("dontbug: Could not get the rr position for status:", err)
+		return ""
+	}
+
+	if position.ticks < 0 {
+		return fmt.Sprintf(`<dontbug:position xmlns:dontbug="https://github.com/sidkshatriya/dontbug" event="%v"/>`, position.event)
+	}
+
+	return fmt.Sprintf(`<dontbug:position xmlns:dontbug="https://github.com/sidkshatriya/dontbug" event="%v" ticks="%v"/>`,
+		position.event, position.ticks)
+}
@@ -0,0 +1,66 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// A rough idea of how slow runs in either direction will be. rr only tells us the number of events by
+// dumping the whole trace (which takes about as long as a replay) so we look at the trace directory instead:
+// rr writes to it throughout the recording so the file modification times span the recording
+// Files rr hardlinked into the trace (e.g. the PHP executable) are skipped: they don't take up any more space
+// and have the modification time of the original
+func printTraceSummary(rrTraceDir string) {
+	var size int64
+	var first, last time.Time
+	err := filepath.Walk(rrTraceDir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			return nil
+		}
+
+		size += info.Size()
+		modTime := info.ModTime()
+		if first.IsZero() || modTime.Before(first) {
+			first = modTime
+		}
+		if modTime.After(last) {
+			last = modTime
+		}
+		return nil
+	})
+	if err != nil || first.IsZero() {
+		Verboseln("dontbug: Could not summarize the rr trace", rrTraceDir, err)
+		return
+	}
+
+	// Truncated to the second to keep it readable
+	duration := last.Sub(first) / time.Second * time.Second
+	summary := fmt.Sprintf("dontbug: The rr trace is %v on disk and was recorded over about %v", humanSize(size), duration)
+	if duration == 0 {
+		summary = fmt.Sprintf("dontbug: The rr trace is %v on disk", humanSize(size))
+	}
+
+	logInfof(color.FgYellow, "%v", summary)
+}
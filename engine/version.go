@@ -0,0 +1,121 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The version of the dontbug zend extension (see PHP_DONTBUG_VERSION in php_dontbug.h) this dontbug works with
+	dontbugExpectedExtVersion = "0.0.1"
+
+	// Change this whenever the layout of the generated dontbug_break.c changes
+	dontbugBreakFormatVersion = 1
+)
+
+var dontbugExtVersionRegexp = regexp.MustCompile(`#define\s+PHP_DONTBUG_VERSION\s+"([^"]*)"`)
+
+// DetectedVersions is what dontbug finds installed on this system.
+// A field holds an explanatory message if that particular version could not be found
+type DetectedVersions struct {
+	RR        string `json:"rr"`
+	RRPath    string `json:"rr_path"`
+	Gdb       string `json:"gdb"`
+	GdbPath   string `json:"gdb_path"`
+	Extension string `json:"extension"`
+	ExtDir    string `json:"extension_dir"`
+}
+
+// DetectVersions probes the rr and gdb executables and the dontbug zend extension
+// Unlike CheckRRExecutable() etc. it never exits; any problems are reported in the result
+func DetectVersions(rrExecutable, gdbExecutable, installLocation string) DetectedVersions {
+	var dv DetectedVersions
+	dv.RRPath, dv.RR = detectExecutableVersion(rrExecutable)
+	dv.GdbPath, dv.Gdb = detectExecutableVersion(gdbExecutable)
+
+	extDir, err := getAbsNoSymExtDir(installLocation)
+	if err != nil {
+		dv.Extension = fmt.Sprintf("unknown (%v)", err)
+		return dv
+	}
+
+	dv.ExtDir = extDir
+	version, err := getDontbugExtVersion(extDir)
+	if err != nil {
+		dv.Extension = fmt.Sprintf("unknown (%v)", err)
+		return dv
+	}
+
+	dv.Extension = version
+	return dv
+}
+
+// rr and gdb both have the version as the last word of the first line of --version
+func detectExecutableVersion(executable string) (string, string) {
+	path, err := exec.LookPath(executable)
+	if err != nil {
+		return "", fmt.Sprintf("not found (%v)", err)
+	}
+
+	firstLine, err := getVersionLine(path)
+	if err != nil {
+		return path, fmt.Sprintf("unknown (%v)", err)
+	}
+
+	spaceAr := strings.Fields(firstLine)
+	if len(spaceAr) == 0 {
+		return path, "unknown (empty --version output)"
+	}
+
+	return path, spaceAr[len(spaceAr)-1]
+}
+
+// Only warns as a mismatched extension may still work e.g. during development
+func checkDontbugExtVersion(extDir string) {
+	version, err := getDontbugExtVersion(extDir)
+	if err != nil {
+		logWarnf(color.FgYellow, "dontbug: Could not determine the version of the dontbug zend extension: %v", err)
+		return
+	}
+
+	if version != dontbugExpectedExtVersion {
+		logWarnf(color.FgYellow, "dontbug: The dontbug zend extension in %v is version %v but this dontbug expects version %v. "+
+			"Please make sure --install-location points to the dontbug sources this dontbug was built from",
+			extDir, version, dontbugExpectedExtVersion)
+	}
+}
+
+// The version of the dontbug zend extension is defined in its header file
+func getDontbugExtVersion(extDir string) (string, error) {
+	headerFile := path.Clean(extDir + "/php_dontbug.h")
+	contents, err := ioutil.ReadFile(headerFile)
+	if err != nil {
+		return "", err
+	}
+
+	matches := dontbugExtVersionRegexp.FindSubmatch(contents)
+	if matches == nil {
+		return "", fmt.Errorf("PHP_DONTBUG_VERSION not found in %v", headerFile)
+	}
+
+	return string(matches[1]), nil
+}
@@ -0,0 +1,156 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Watch expressions are evaluated at every stop and sent along with the status/run/step responses
+// so that the IDE does not need an eval round trip for each of them.
+//
+// They can be managed by the IDE via:
+// - feature_set -n dontbug_watch -v <expression>: add a watch expression
+// - feature_set -n dontbug_watch_remove -v <expression>: remove a watch expression
+// - feature_get -n dontbug_watch: list the watch expressions, one per line
+// and at the (dontbug) prompt via the w and wd commands
+const (
+	featureWatch       = "dontbug_watch"
+	featureWatchRemove = "dontbug_watch_remove"
+
+	// The transaction id of evals dontbug does on its own. Only the contents of the response are used so this
+	// never reaches the IDE (and is not tied to whatever command the IDE sent last)
+	internalTransactionID = 0
+)
+
+// Watch expressions are evaluated at every stop so they are checked like evals are. See checkEvalSafe()
+func addWatch(es *engineState, expression string) error {
+	if isEvalSafeEnabled(es) {
+		err := checkEvalSafe(expression)
+		if err != nil {
+			return err
+		}
+	}
+
+	es.watchesMutex.Lock()
+	es.watches = append(es.watches, expression)
+	es.watchesMutex.Unlock()
+	return nil
+}
+
+// Returns false if there is no such watch expression
+func removeWatch(es *engineState, expression string) bool {
+	es.watchesMutex.Lock()
+	defer es.watchesMutex.Unlock()
+
+	for i, watch := range es.watches {
+		if watch == expression {
+			es.watches = append(es.watches[:i], es.watches[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns false if there is no watch expression at this index (as shown by printWatches())
+func removeWatchAt(es *engineState, index int) bool {
+	es.watchesMutex.Lock()
+	defer es.watchesMutex.Unlock()
+
+	if index < 0 || index >= len(es.watches) {
+		return false
+	}
+
+	es.watches = append(es.watches[:index], es.watches[index+1:]...)
+	return true
+}
+
+// A copy of the watch expressions that can be used without holding watchesMutex
+func getWatches(es *engineState) []string {
+	es.watchesMutex.Lock()
+	defer es.watchesMutex.Unlock()
+	return append([]string(nil), es.watches...)
+}
+
+// Evaluates all watch expressions in the diversion session at the current position and returns the
+// <dontbug:watches> extension element. Returns "" if there are no watch expressions
+// A watch expression that cannot be evaluated never aborts the stop; the error is reported for that watch instead
+func watchesXML(es *engineState) string {
+	watches := getWatches(es)
+	if len(watches) == 0 {
+		return ""
+	}
+
+	bpList := getEnabledPhpBreakpoints(es)
+	disableAllGdbBreakpoints(es)
+	defer enableGdbBreakpoints(es, bpList)
+
+	var buf bytes.Buffer
+	buf.WriteString(`<dontbug:watches xmlns:dontbug="https://github.com/sidkshatriya/dontbug">`)
+	for _, expression := range watches {
+		result, err := evalWatch(es, expression)
+		if err != nil {
+			buf.WriteString(fmt.Sprintf(`<dontbug:watch expression="%v" error="%v"></dontbug:watch>`, html.EscapeString(expression), html.EscapeString(err.Error())))
+			continue
+		}
+
+		buf.WriteString(fmt.Sprintf(`<dontbug:watch expression="%v">%v</dontbug:watch>`, html.EscapeString(expression), result))
+	}
+	buf.WriteString(`</dontbug:watches>`)
+
+	return buf.String()
+}
+
+// Returns the contents of the eval response i.e. without the enclosing <response> element
+func evalWatch(es *engineState, expression string) (result string, err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	command := fmt.Sprintf("eval -i %v -- %v", internalTransactionID, base64.StdEncoding.EncodeToString([]byte(expression)))
+	response, err := diversionSessionCmd(es, command)
+	if err != nil {
+		return "", err
+	}
+
+	start := strings.Index(response, ">")
+	end := strings.LastIndex(response, "</response>")
+	if start == -1 || end == -1 || end < start {
+		return "", fmt.Errorf("Unexpected eval response: %v", response)
+	}
+
+	return response[start+1 : end], nil
+}
+
+// For the (dontbug) prompt
+func printWatches(es *engineState) {
+	watches := getWatches(es)
+	if len(watches) == 0 {
+		fmt.Println("No watch expressions. Add one with: w <expression>")
+		return
+	}
+
+	for i, watch := range watches {
+		fmt.Printf("[%v] %v\n", i, watch)
+	}
+}
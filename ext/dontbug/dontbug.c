@@ -41,10 +41,16 @@ PHP_MSHUTDOWN_FUNCTION(dontbug) {
     return SUCCESS;
 }
 
+// Called at the start of every PHP request. The engine counts the hits here for 'dontbug replay --request'
+void dontbug_request_start() {
+    return; //@@@ request -- breakpoint position for counting PHP requests
+}
+
 PHP_RINIT_FUNCTION(dontbug) {
 #if defined(COMPILE_DL_DONTBUG) && defined(ZTS)
     ZEND_TSRMLS_CACHE_UPDATE();
 #endif
+    dontbug_request_start();
     return SUCCESS;
 }
 
@@ -74,6 +80,7 @@ zend_module_entry dontbug_module_entry = {
         STANDARD_MODULE_PROPERTIES };
 
 
+// IMPORTANT -- The dontbug engine sets its breakpoints on the lines marked with @@@ comments. DONT REMOVE THEM
 void dontbug_statement_handler(zend_op_array *op_array) {
     zend_execute_data* execute_data = EG(current_execute_data);
 
@@ -88,7 +95,7 @@ void dontbug_statement_handler(zend_op_array *op_array) {
         int lineno = execute_data->opline->lineno;
 
         // stack depth
-        unsigned long level = XG(level);
+        unsigned long level = XG(level); //@@@ start -- temporary breakpoint to get a replay going
 
         // level related breakpoints
         dontbug_level_location(level, filename, lineno);
@@ -96,7 +103,70 @@ void dontbug_statement_handler(zend_op_array *op_array) {
         // Pass the zend_string and not the cstring
         dontbug_break_location(op_array->filename, execute_data, lineno, level);
 
-        return;  // master breakpoint position
+        return;  //@@@ master -- breakpoint position for stepping
+    }
+}
+
+// Is the statement about to be executed the first statement of the current function?
+// Note that the statement handler is called on the ZEND_EXT_STMT opcode that precedes every statement
+int dontbug_is_function_entry(zend_execute_data *execute_data) {
+    zend_op_array *op_array = &execute_data->func->op_array;
+    const zend_op *op = op_array->opcodes;
+
+    while (op < execute_data->opline && op->opcode != ZEND_EXT_STMT) {
+        op++;
+    }
+
+    return op == execute_data->opline;
+}
+
+// Is the statement about to be executed a return statement of the current function?
+int dontbug_is_function_return(zend_execute_data *execute_data) {
+    zend_op_array *op_array = &execute_data->func->op_array;
+    const zend_op *end = op_array->opcodes + op_array->last;
+    const zend_op *op = execute_data->opline + 1;
+
+    for (; op < end && op->opcode != ZEND_EXT_STMT; op++) {
+        if (op->opcode == ZEND_RETURN || op->opcode == ZEND_RETURN_BY_REF || op->opcode == ZEND_GENERATOR_RETURN) {
+            return 1;
+        }
+    }
+
+    return 0;
+}
+
+// Opcode handlers that were installed before ours (e.g. by Xdebug). We chain to them
+static user_opcode_handler_t dontbug_prev_opcode_handlers[256];
+
+// 1 if the opcode handlers were installed. The engine reads this to know whether opcode granularity stepping works
+int dontbug_opcode_stepping = 0;
+
+// Called on every opcode of user code. Used by the engine for opcode granularity stepping
+// The parameter names are important: the engine evaluates filename, lineno and level here
+void dontbug_opcode_location(char *filename, int lineno, unsigned long level, zend_uchar opcode) {
+    return; //@@@ opcode -- breakpoint position for opcode granularity stepping
+}
+
+static int dontbug_opcode_handler(zend_execute_data *execute_data) {
+    const zend_op *opline = execute_data->opline;
+
+    if (ZEND_USER_CODE(execute_data->func->type) && execute_data->func->op_array.filename) {
+        dontbug_opcode_location(ZSTR_VAL(execute_data->func->op_array.filename), opline->lineno, XG(level), opline->opcode);
+    }
+
+    user_opcode_handler_t prev = dontbug_prev_opcode_handlers[opline->opcode];
+    if (prev) {
+        return prev(execute_data);
+    }
+
+    return ZEND_USER_OPCODE_DISPATCH;
+}
+
+static void dontbug_set_opcode_handlers() {
+    int i;
+    for (i = 0; i < 256; i++) {
+        dontbug_prev_opcode_handlers[i] = zend_get_user_opcode_handler(i);
+        zend_set_user_opcode_handler(i, dontbug_opcode_handler);
     }
 }
 
@@ -112,6 +182,26 @@ static char* dontbug_xml_cstringify(xdebug_xml_node *node) {
     return node_xstringified->d;
 }
 
+// xdebug normally sets the frame it reads locals and $this from (for eval and for property_get/context_get at
+// depth 0) when it breaks. In the diversion session xdebug never broke at this point in the replay so those are
+// whatever they were when xdebug last did something. Make them the innermost PHP frame i.e. where we are stopped
+// property_get/context_get with a depth > 0 still work as xdebug then sets them for the requested frame itself
+static void dontbug_activate_innermost_frame() {
+    zend_execute_data *execute_data = EG(current_execute_data);
+    while (execute_data && (!execute_data->func || !ZEND_USER_CODE(execute_data->func->type))) {
+        execute_data = execute_data->prev_execute_data;
+    }
+
+    if (!execute_data) {
+        return;
+    }
+
+    // Also attaches the compiled variables (i.e. the locals) to the symbol table
+    XG(active_symbol_table) = zend_rebuild_symbol_table();
+    XG(active_execute_data) = execute_data;
+    XG(This) = Z_TYPE(execute_data->This) == IS_OBJECT ? &execute_data->This : NULL;
+}
+
 // Note: this function is always called from GDB
 // - This is also why this function is extern
 // - Additionally, this function is never called by any other function in this Zend extension
@@ -126,6 +216,8 @@ char* dontbug_xdebug_cmd(char* command) {
         exit(1);
     }
 
+    dontbug_activate_innermost_frame();
+
     // Outer wrapper <reponse></response>
     xdebug_xml_node *wrapper_node = xdebug_xml_node_init("response");
 
@@ -150,6 +242,73 @@ char* dontbug_xdebug_cmd(char* command) {
     exit(1);
 }
 
+// Like dontbug_xdebug_cmd() but with the show_hidden, max_children, max_data, max_depth and extended_properties
+// features set by the IDE
+// The diversion session starts afresh for every command so feature values can't simply be set once
+//
+// If "setup_command" is non-empty it is run first and its response is discarded e.g. an eval that assigns
+// a value to a variable which "command" then inspects. It too must see the locals and $this of the current frame
+char* dontbug_xdebug_cmd_with_options(char* setup_command, char* command, int show_hidden, int max_children, int max_data, int max_depth, int extended_properties) {
+    dontbug_activate_innermost_frame();
+
+    xdebug_var_export_options *options = (xdebug_var_export_options *) XG(context).options;
+    if (options) {
+        options->show_hidden = show_hidden;
+        options->max_children = max_children;
+        options->max_data = max_data;
+        options->max_depth = max_depth;
+        options->extended_properties = extended_properties;
+    }
+
+    if (setup_command && strlen(setup_command) > 0) {
+        xdebug_xml_node *setup_node = xdebug_xml_node_init("response");
+        xdebug_dbgp_parse_option(&XG(context), setup_command, 0, setup_node);
+    }
+
+    return dontbug_xdebug_cmd(command);
+}
+
+// Makes the PHP frame at depth (0 is the innermost PHP frame) the current one. Returns 0 if there is no such frame
+static int dontbug_select_frame(int depth) {
+    zend_execute_data *execute_data = EG(current_execute_data);
+    while (execute_data) {
+        if (execute_data->func && ZEND_USER_CODE(execute_data->func->type)) {
+            if (depth == 0) {
+                break;
+            }
+            depth--;
+        }
+        execute_data = execute_data->prev_execute_data;
+    }
+
+    if (!execute_data) {
+        return 0;
+    }
+
+    // Nothing survives the diversion session so this does not need to be restored
+    EG(current_execute_data) = execute_data;
+    return 1;
+}
+
+// Like dontbug_xdebug_cmd() but command is run in the PHP frame at depth (0 is the innermost PHP frame) e.g. so that
+// an eval sees the locals and $this of that frame. Returns an empty string if there is no such frame
+char* dontbug_xdebug_cmd_in_frame(char* command, int depth) {
+    if (!dontbug_select_frame(depth)) {
+        return "";
+    }
+
+    return dontbug_xdebug_cmd(command);
+}
+
+// dontbug_xdebug_cmd_in_frame() and dontbug_xdebug_cmd_with_options() combined
+char* dontbug_xdebug_cmd_in_frame_with_options(char* command, int depth, int show_hidden, int max_children, int max_data, int max_depth, int extended_properties) {
+    if (!dontbug_select_frame(depth)) {
+        return "";
+    }
+
+    return dontbug_xdebug_cmd_with_options("", command, show_hidden, max_children, max_data, max_depth, extended_properties);
+}
+
 ZEND_DLEXPORT int dontbug_zend_startup(zend_extension *extension) {
     zend_extension *xdebug_zend_ext = zend_get_extension("Xdebug");
     if (xdebug_zend_ext == NULL) {
@@ -163,6 +322,15 @@ ZEND_DLEXPORT int dontbug_zend_startup(zend_extension *extension) {
         fprintf(stderr, "dontbug zend extension: Xdebug entrypoint not found\n");
     }
 
+    // Our handler runs on every opcode, slowing down the whole recording, and replaces the handlers of extensions
+    // that set theirs later. So it is only installed for 'dontbug record --opcode-stepping' (dontbug.opcode_stepping=1)
+    // Zend modules (including Xdebug) have already been started, so any opcode handlers they set can be chained
+    zend_long opcode_stepping = 0;
+    if (cfg_get_long("dontbug.opcode_stepping", &opcode_stepping) == SUCCESS && opcode_stepping) {
+        dontbug_set_opcode_handlers();
+        dontbug_opcode_stepping = 1;
+    }
+
     // It is important that this message is last vis-a-vis above messages; ordering matters
     // This specific string is searched for by the dontbug engine - DONT CHANGE IT!
     fprintf(stderr, "dontbug zend extension: dontbug.so successfully loaded by PHP\n");
@@ -42,7 +42,16 @@ ZEND_TSRMLS_CACHE_EXTERN()
 
 void dontbug_break_location(zend_string* filename, zend_execute_data *execute_data, int lineno, unsigned long level);
 void dontbug_level_location(unsigned long level, char* filename, int lineno);
+void dontbug_function_location(zend_execute_data *execute_data);
+void dontbug_opcode_location(char *filename, int lineno, unsigned long level, zend_uchar opcode);
+
+int dontbug_is_function_entry(zend_execute_data *execute_data);
+int dontbug_is_function_return(zend_execute_data *execute_data);
 
 char* dontbug_xdebug_cmd(char* command);
+void dontbug_request_start();
+char* dontbug_xdebug_cmd_in_frame(char* command, int depth);
+char* dontbug_xdebug_cmd_with_options(char* setup_command, char* command, int show_hidden, int max_children, int max_data, int max_depth, int extended_properties);
+char* dontbug_xdebug_cmd_in_frame_with_options(char* command, int depth, int show_hidden, int max_children, int max_data, int max_depth, int extended_properties);
 
 #endif
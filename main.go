@@ -15,6 +15,7 @@
 package main
 
 import (
+	"github.com/fatih/color"
 	"github.com/sidkshatriya/dontbug/cmd"
 	"log"
 )
@@ -22,6 +23,6 @@ import (
 func main() {
 	log.SetFlags(log.Lshortfile)
 	// Light red background
-	log.SetPrefix("dontbug: \x1b[101mfatal error:\x1b[0m ")
+	log.SetPrefix("dontbug: " + color.New(color.BgHiRed).Sprint("fatal error:") + " ")
 	cmd.Execute()
 }